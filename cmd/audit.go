@@ -0,0 +1,145 @@
+// Copyright © 2019 Erin Shepherd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// An audit log records each page written to and verified on a device as a
+// line of JSON. Every entry is synced to disk as it is written, so that if
+// programming is interrupted the log still records what was done.
+//
+// Methods on a nil *auditLog do nothing
+type auditLog struct {
+	mu  sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+}
+
+// An entry in the audit log
+type auditEntry struct {
+	Time    time.Time `json:"time"`
+	Device  string    `json:"device"`
+	Event   string    `json:"event"`
+	Target  string    `json:"target,omitempty"`
+	CRC32   string    `json:"crc32,omitempty"`
+	Region  string    `json:"region,omitempty"`
+	Address *uint32   `json:"address,omitempty"`
+	Length  int       `json:"length,omitempty"`
+	Data    string    `json:"data,omitempty"`
+	Result  string    `json:"result"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// Audit log events
+const (
+	auditStart  = "start"
+	auditErase  = "erase"
+	auditWrite  = "write"
+	auditVerify = "verify"
+	auditDone   = "done"
+)
+
+// Opens the audit log at path; entries are appended to any existing log
+func openAuditLog(path string) (*auditLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, err
+	}
+
+	return &auditLog{f: f, enc: json.NewEncoder(f)}, nil
+}
+
+func (l *auditLog) Close() error {
+	if l == nil {
+		return nil
+	}
+	return l.f.Close()
+}
+
+// Records an event with outcome err. Failure to record is fatal to
+// programming, as the log would otherwise be incomplete
+func (l *auditLog) log(e auditEntry, err error) error {
+	if l == nil {
+		return nil
+	}
+
+	e.Time = time.Now().UTC()
+	switch err.(type) {
+	case nil:
+		e.Result = "ok"
+	case *mismatchError:
+		e.Result = "mismatch"
+	default:
+		e.Result = "error"
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.enc.Encode(e); err != nil {
+		return err
+	}
+	return l.f.Sync()
+}
+
+// Records an event concerning the page at address. The page contents are
+// recorded for writes
+func (l *auditLog) logPage(device, event, region string, address uint32, page []byte, err error) error {
+	e := auditEntry{
+		Device:  device,
+		Event:   event,
+		Region:  region,
+		Address: &address,
+		Length:  len(page),
+	}
+	if event == auditWrite {
+		e.Data = hex.EncodeToString(page)
+	}
+	return l.log(e, err)
+}
+
+// Records the start of programming data
+func (l *auditLog) logStart(device string, data *TargetData) error {
+	if l == nil {
+		return nil
+	}
+
+	checksum, err := data.Checksum(checksumAll)
+	if err != nil {
+		return err
+	}
+
+	return l.log(auditEntry{
+		Device: device,
+		Event:  auditStart,
+		Target: data.TargetDefinition.Name,
+		CRC32:  fmt.Sprintf("%08x", checksum),
+	}, nil)
+}
+
+// Records the outcome of programming, err
+func (l *auditLog) logDone(device string, err error) error {
+	return l.log(auditEntry{Device: device, Event: auditDone}, err)
+}
@@ -15,9 +15,11 @@
 package cmd
 
 import (
+	"bytes"
+	"encoding/hex"
 	"encoding/json"
-	"errors"
 	"fmt"
+	"strings"
 
 	"github.com/erincandescent/nuvoprog/target"
 	"github.com/spf13/cobra"
@@ -27,27 +29,50 @@ import (
 var configDecodeCmd = &cobra.Command{
 	Use:   "decode",
 	Short: "Decodes configuration bytes",
-	Long:  `Takes either a config string or an image and decodes configuration bytes`,
+	Long: `Takes either a config string or an image and decodes configuration bytes
+
+A config string shorter than the target's configuration is padded with erased
+(0xFF) bytes, and the fields depending on them are listed in a warning. With
+--strict, short config strings are rejected instead.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
-		if targetName == "" {
-			return errors.New("Target device not specified")
+		config, _ := cmd.Flags().GetString("config")
+		image, _ := cmd.Flags().GetString("image")
+		jsonOut, _ := cmd.Flags().GetBool("json")
+
+		input := config
+		if input == "" {
+			input = image
 		}
 
-		td := target.ByName(targetName)
-		if td == nil {
-			return fmt.Errorf("Target device '%s' not found", targetName)
+		td, err := lookupTarget()
+		if err != nil {
+			return configDecodeFailure(jsonOut, input, nil, err)
 		}
 
-		config, _ := cmd.Flags().GetString("config")
-		image, _ := cmd.Flags().GetString("image")
-		data, err := ReadTargetData(config, image, "", "", td, false)
+		config, err = padShortConfig(td, config)
 		if err != nil {
-			return err
+			return configDecodeFailure(jsonOut, input, nil, err)
 		}
 
-		cfgo := td.Config.NewConfig()
-		if err := cfgo.UnmarshalBinary(data.Config); err != nil {
-			return err
+		data, err := ReadTargetData(config, nil, image, "", "", td, false)
+		if err != nil {
+			return configDecodeFailure(jsonOut, input, nil, err)
+		}
+
+		cfgo, err := td.Config.Decode(data.Config)
+		if err != nil {
+			return configDecodeFailure(jsonOut, input, data.Config, err)
+		}
+
+		for _, off := range td.Config.UnmodeledBytes(data.Config) {
+			err := warn("Configuration byte %d (0x%02x) is not erased but is not decoded", off, data.Config[off])
+			if err != nil {
+				return configDecodeFailure(jsonOut, input, data.Config, err)
+			}
+		}
+
+		if jsonOut {
+			return reportJSON(cfgo, nil)
 		}
 
 		buf, err := json.MarshalIndent(cfgo, "", "    ")
@@ -61,9 +86,107 @@ var configDecodeCmd = &cobra.Command{
 	},
 }
 
+// Pads a hex configuration string which is shorter than the target's
+// configuration with erased (0xFF) bytes, so that partial configurations
+// can be decoded, and warns which fields were assumed. Under --strict,
+// the configuration is left alone so that it is rejected as too short
+func padShortConfig(td *target.Definition, config string) (string, error) {
+	cfg, err := hex.DecodeString(strings.TrimSpace(config))
+	if config == "" || err != nil || strict || len(cfg) >= int(td.Config.MinSize) {
+		return config, nil
+	}
+
+	n := len(cfg)
+	for len(cfg) < int(td.Config.ReadSize) {
+		cfg = append(cfg, 0xFF)
+	}
+
+	fields, err := assumedConfigFields(td, cfg, n)
+	if err != nil {
+		return "", err
+	}
+
+	msg := fmt.Sprintf("Configuration is %d bytes; assuming bytes %d-%d are erased (0xFF)", n, n, len(cfg)-1)
+	if len(fields) != 0 {
+		msg += fmt.Sprintf(", affecting: %s", strings.Join(fields, ", "))
+	}
+	if err := warn("%s", msg); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(cfg), nil
+}
+
+// Returns the names of the configuration fields which depend upon the
+// bytes of cfg from offset from onwards
+func assumedConfigFields(td *target.Definition, cfg []byte, from int) ([]string, error) {
+	base, err := configFields(td, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	affected := map[string]bool{}
+	buf := make([]byte, len(cfg))
+	for i := from; i < len(cfg); i++ {
+		for bit := uint(0); bit < 8; bit++ {
+			copy(buf, cfg)
+			buf[i] ^= 1 << bit
+
+			// Some bit patterns may not decode; those fields are
+			// reported by the decode proper
+			fields, err := configFields(td, buf)
+			if err != nil {
+				continue
+			}
+			for name, v := range fields {
+				if !bytes.Equal(v, base[name]) {
+					affected[name] = true
+				}
+			}
+		}
+	}
+
+	var names []string
+	for _, f := range td.Config.Fields() {
+		if affected[f.Name] {
+			names = append(names, f.Name)
+		}
+	}
+	return names, nil
+}
+
+// Structured description of a config decoding failure
+type configDecodeError struct {
+	Field  string `json:"field,omitempty"`
+	Offset *int   `json:"offset,omitempty"`
+	Input  string `json:"input"`
+	Bytes  string `json:"bytes,omitempty"`
+}
+
+// Reports a decoding failure as JSON if requested
+func configDecodeFailure(jsonOut bool, input string, raw []byte, err error) error {
+	if !jsonOut {
+		return err
+	}
+
+	out := configDecodeError{
+		Input: input,
+		Bytes: hex.EncodeToString(raw),
+	}
+
+	if cerr, ok := err.(*target.ConfigError); ok {
+		out.Field = cerr.Field
+		if cerr.Offset >= 0 {
+			out.Offset = &cerr.Offset
+		}
+	}
+
+	return reportJSON(out, err)
+}
+
 func init() {
 	configCmd.AddCommand(configDecodeCmd)
 
 	configDecodeCmd.Flags().StringP("image", "i", "", "Image file, e.g. image.ihx")
 	configDecodeCmd.Flags().StringP("config", "c", "", "Configuration, e.g. 6FFBFFFF or @config.json")
+	addJSONFlag(configDecodeCmd)
 }
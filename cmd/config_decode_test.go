@@ -0,0 +1,70 @@
+// Copyright © 2019 Erin Shepherd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/erincandescent/nuvoprog/target"
+)
+
+func TestPadShortConfig(t *testing.T) {
+	td := target.ByName("n76e003")
+	cases := []struct {
+		name, config, expected string
+	}{
+		{"short", "7F", "7fffffffffffffff"},
+		{"exact", "7FFFFFFF", "7FFFFFFF"},
+		{"read size", "7FFFFFFFFFFFFFFF", "7FFFFFFFFFFFFFFF"},
+		{"long", "7FFFFFFFFFFFFFFF00", "7FFFFFFFFFFFFFFF00"},
+		{"not hex", "@config.json", "@config.json"},
+	}
+	for _, c := range cases {
+		got, err := padShortConfig(td, c.config)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		} else if got != c.expected {
+			t.Errorf("%s: padShortConfig(%s) = %s, expected %s", c.name, c.config, got, c.expected)
+		}
+	}
+}
+
+func TestPadShortConfigStrict(t *testing.T) {
+	td := target.ByName("n76e003")
+	defer func(s bool) { strict = s }(strict)
+	strict = true
+
+	got, err := padShortConfig(td, "7F")
+	if err != nil {
+		t.Fatal(err)
+	} else if got != "7F" {
+		t.Errorf("padShortConfig = %s under --strict, expected it unchanged", got)
+	}
+	if _, err := readConfig(td, got); err == nil {
+		t.Error("Short configuration accepted under --strict")
+	}
+}
+
+func TestAssumedConfigFields(t *testing.T) {
+	td := target.ByName("n76e003")
+	fields, err := assumedConfigFields(td, []byte{0x7F, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"wdt"}; !reflect.DeepEqual(fields, expected) {
+		t.Errorf("Fields depending on byte 3 = %v, expected %v", fields, expected)
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright © 2019 Erin Shepherd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/erincandescent/nuvoprog/protocol"
+	"github.com/erincandescent/nuvoprog/target"
+	"github.com/spf13/cobra"
+)
+
+var errConfigsDiffer = errors.New("Configurations differ")
+
+// configDiffCmd represents the config diff command
+var configDiffCmd = &cobra.Command{
+	Use:   "diff A B",
+	Short: "Compare two configurations",
+	Long: `Decodes two configurations and prints the fields which differ.
+
+Each configuration may be given as hex bytes, JSON, @file.json, or
+"device" to read the configuration of the connected target. Exits
+with status 2 if the configurations differ`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if targetName == "" {
+			return errors.New("Target device not specified")
+		}
+
+		td := target.ByName(targetName)
+		if td == nil {
+			return unknownTargetError(targetName)
+		}
+
+		a, err := configArg(td, args[0])
+		if err != nil {
+			return err
+		}
+
+		b, err := configArg(td, args[1])
+		if err != nil {
+			return err
+		}
+
+		diffs, err := configFieldDiffs(td, a, b)
+		if err != nil {
+			return err
+		}
+
+		for _, d := range diffs {
+			fmt.Println(d)
+		}
+
+		if len(diffs) != 0 {
+			return reportedError{errConfigsDiffer}
+		}
+		return nil
+	},
+}
+
+// Reads a configuration argument, which may be "device"
+func configArg(td *target.Definition, arg string) ([]byte, error) {
+	if arg == "device" {
+		return readDeviceConfig()
+	}
+	return readConfig(td, arg)
+}
+
+// Returns a description ("field: old -> new") of each field which differs
+// between configurations a and b
+func configFieldDiffs(td *target.Definition, a, b []byte) ([]string, error) {
+	af, err := configFields(td, a)
+	if err != nil {
+		return nil, err
+	}
+
+	bf, err := configFields(td, b)
+	if err != nil {
+		return nil, err
+	}
+
+	var diffs []string
+	for _, f := range td.Config.Fields() {
+		if !bytes.Equal(af[f.Name], bf[f.Name]) {
+			diffs = append(diffs, fmt.Sprintf("%s: %s -> %s", f.Name, af[f.Name], bf[f.Name]))
+		}
+	}
+	return diffs, nil
+}
+
+// Decodes configuration bytes into their JSON field values
+func configFields(td *target.Definition, cfg []byte) (map[string]json.RawMessage, error) {
+	cfgo, err := td.Config.Decode(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	buf, err := json.Marshal(cfgo)
+	if err != nil {
+		return nil, err
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(buf, &fields); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+// Reads the configuration bytes of the connected target
+func readDeviceConfig() ([]byte, error) {
+	dev, td, err := connectToTarget()
+	if err != nil {
+		return nil, err
+	}
+	defer resetAndCloseDevice(dev)
+
+	return dev.ReadMemory(protocol.ConfigSpace, 0, td.Config.ReadSize)
+}
+
+func init() {
+	configCmd.AddCommand(configDiffCmd)
+}
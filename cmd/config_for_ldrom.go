@@ -0,0 +1,118 @@
+// Copyright © 2019 Erin Shepherd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/erincandescent/nuvoprog/target"
+	"github.com/spf13/cobra"
+)
+
+// configForLDROMCmd represents the config for-ldrom command
+var configForLDROMCmd = &cobra.Command{
+	Use:   "for-ldrom SIZE",
+	Short: "Generate a configuration with a given LDROM size",
+	Long: `Prints the target's default configuration, with LDROM set to SIZE
+(e.g. 4k) and booting from the region given by --boot, as hex bytes and as
+JSON. Either may be passed to --config; further fields can be changed with
+--set. This is a starting point for setting up a bootloader`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		td, err := lookupTarget()
+		if err != nil {
+			return err
+		}
+
+		size, err := parseSize(args[0])
+		if err != nil {
+			return err
+		}
+
+		boot, _ := cmd.Flags().GetString("boot")
+		if boot == "ldrom" && size == 0 {
+			return errors.New("Cannot boot from LDROM when it is empty")
+		}
+
+		cfg, err := defaultConfig(td)
+		if err != nil {
+			return err
+		}
+
+		if cfg, err = setLDROMSize(td, cfg, size); err != nil {
+			return err
+		}
+
+		if cfg, err = applyConfigSets(td, cfg, []string{"boot_select=" + boot}); err != nil {
+			return err
+		}
+
+		cfgo, err := td.Config.Decode(cfg)
+		if err != nil {
+			return err
+		}
+
+		buf, err := json.MarshalIndent(cfgo, "", "    ")
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("%X\n", cfg)
+		fmt.Println(string(buf))
+		return nil
+	},
+}
+
+// Sets the ldrom_size field of cfg to the value which gives an LDROM of
+// size bytes. The field's values are target specific, so each is tried
+func setLDROMSize(td *target.Definition, cfg []byte, size uint) ([]byte, error) {
+	var sizes []string
+	for _, f := range td.Config.Fields() {
+		if f.Name != "ldrom_size" {
+			continue
+		}
+
+		for _, v := range f.Values {
+			buf, err := applyConfigSets(td, cfg, []string{"ldrom_size=" + v})
+			if err != nil {
+				return nil, err
+			}
+
+			cfgo, err := td.Config.Decode(buf)
+			if err != nil {
+				return nil, err
+			}
+
+			if cfgo.GetLDROMSize() == size {
+				return buf, nil
+			}
+			sizes = append(sizes, fmt.Sprintf("%dk", cfgo.GetLDROMSize()/1024))
+		}
+	}
+
+	if sizes == nil {
+		return nil, fmt.Errorf("%s does not support LDROM", td.Name)
+	}
+	return nil, fmt.Errorf("LDROM size of %d bytes not supported by %s; expected one of %s",
+		size, td.Name, strings.Join(sizes, ", "))
+}
+
+func init() {
+	configCmd.AddCommand(configForLDROMCmd)
+	configForLDROMCmd.Flags().String("boot", "aprom", "Region to boot from: aprom or ldrom")
+}
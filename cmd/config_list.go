@@ -0,0 +1,55 @@
+// Copyright © 2019 Erin Shepherd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/erincandescent/nuvoprog/target"
+	"github.com/spf13/cobra"
+)
+
+// configListCmd represents the config list command
+var configListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List configuration fields",
+	Long:  `Lists each configuration field of the target and its permitted values`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if targetName == "" {
+			return errors.New("Target device not specified")
+		}
+
+		td := target.ByName(targetName)
+		if td == nil {
+			return unknownTargetError(targetName)
+		}
+
+		for _, f := range td.Config.Fields() {
+			if f.Values == nil {
+				fmt.Println(f.Name)
+			} else {
+				fmt.Printf("%s: %s\n", f.Name, strings.Join(f.Values, "|"))
+			}
+		}
+
+		return nil
+	},
+}
+
+func init() {
+	configCmd.AddCommand(configListCmd)
+}
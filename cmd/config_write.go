@@ -0,0 +1,110 @@
+// Copyright © 2019 Erin Shepherd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/erincandescent/nuvoprog/protocol"
+	"github.com/spf13/cobra"
+)
+
+// configWriteCmd represents the config write command
+var configWriteCmd = &cobra.Command{
+	Use:   "write",
+	Short: "Write device configuration",
+	Long: `Writes the configuration bytes of the target device, without erasing flash.
+
+With --preserve, any configuration bits not modeled by nuvoprog (e.g. reserved
+or calibration bits) are preserved from the device's current configuration.
+
+Flash bits can only be cleared without an erase; if the new configuration
+requires bits to be set, the write will fail verification and the device
+must be reprogrammed with 'program' instead`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		config, _ := cmd.Flags().GetString("config")
+		sets, _ := cmd.Flags().GetStringArray("set")
+		preserve, _ := cmd.Flags().GetBool("preserve")
+
+		if config == "" && len(sets) == 0 {
+			return errors.New("No configuration specified")
+		}
+
+		dev, td, err := connectToTarget()
+		if err != nil {
+			return err
+		}
+		defer resetAndCloseDevice(dev)
+
+		current, err := dev.ReadMemory(protocol.ConfigSpace, 0, td.Config.ReadSize)
+		if err != nil {
+			return err
+		}
+
+		cfg := current
+		if config != "" {
+			cfg, err = readConfig(td, config)
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(sets) != 0 {
+			cfg, err = applyConfigSets(td, cfg, sets)
+			if err != nil {
+				return err
+			}
+		}
+
+		if preserve {
+			cfgo, err := td.Config.Decode(cfg)
+			if err != nil {
+				return err
+			}
+
+			cfg, err = td.Config.EncodePreserving(cfgo, current)
+			if err != nil {
+				return err
+			}
+		}
+
+		for len(cfg) < int(td.Config.WriteSize) {
+			cfg = append(cfg, 0xFF)
+		}
+
+		if err := dev.WriteMemory(protocol.ConfigSpace, 0, cfg[:td.Config.WriteSize]); err != nil {
+			return err
+		}
+
+		readback, err := dev.ReadMemory(protocol.ConfigSpace, 0, td.Config.ReadSize)
+		if err != nil {
+			return err
+		}
+
+		if !bytes.HasPrefix(cfg, readback) {
+			return errors.New("Configuration verification failed; a chip erase may be required")
+		}
+
+		return nil
+	},
+}
+
+func init() {
+	configCmd.AddCommand(configWriteCmd)
+	configWriteCmd.Flags().StringP("config", "c", "", "Configuration, e.g. 6FFBFFFF or @config.json")
+	configWriteCmd.Flags().StringArray("set", nil, "Set a configuration field, e.g. wdt=disabled (repeatable)")
+	configWriteCmd.Flags().Bool("preserve", false, "Preserve configuration bits which are not modeled")
+}
@@ -16,60 +16,116 @@ package cmd
 import (
 	"errors"
 	"fmt"
+	"log"
+	"os"
+	"strings"
 
 	"github.com/erincandescent/nuvoprog/protocol"
 	"github.com/erincandescent/nuvoprog/target"
+	"github.com/fatih/color"
 )
 
-func connectToTarget() (*protocol.Device, *target.Definition, error) {
-	devs, err := protocol.Connect()
+// Opens the (single) connected programmer and checks its firmware version
+func openProgrammer() (*protocol.Device, error) {
+	dev, err := findProgrammer()
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
-	switch {
-	case len(devs) == 0:
-		return nil, nil, errors.New("No programmer found")
-	case len(devs) > 1:
-		for _, dev := range devs {
+	if recordFile != "" {
+		f, err := os.Create(recordFile)
+		if err != nil {
 			dev.Close()
+			return nil, err
 		}
-		return nil, nil, errors.New("Multiple programmers found - you must specify one")
+		dev.Record(f)
 	}
 
-	dev := devs[0]
-	// Defer like this to avoid capturing the value of dev now
-	defer func() { dev.Close() }()
+	if err := checkProgrammer(dev); err != nil {
+		dev.Close()
+		return nil, err
+	}
 
+	return dev, nil
+}
+
+// Checks the programmer's firmware version, and warns if it senses no
+// target voltage
+func checkProgrammer(dev *protocol.Device) error {
 	ver, err := dev.GetVersion()
 	if err != nil {
-		return nil, nil, err
+		if devicePath != "" {
+			return fmt.Errorf("%s did not respond as a programmer: %v", devicePath, err)
+		}
+		return err
 	}
 
-	if ver.FirmwareVersion < protocol.FirmwareVersionRequired {
-		return nil, nil, errors.New("Your programmer's firmware is out of date")
+	if assumeTargetPresent {
+		log.Printf("Programmer firmware version %s not checked (--assume-target-present)", ver.FirmwareVersion)
+	} else if ver.FirmwareVersion < protocol.FirmwareVersion(minFirmware) {
+		return fmt.Errorf("Your programmer's firmware (version %s) is out of date; "+
+			"version %d or later is required (see --min-firmware)", ver.FirmwareVersion, minFirmware)
 	}
 
-	if targetName == "" {
-		return nil, nil, errors.New("Target device not specified")
+	if ver.NoTargetVoltage() {
+		return warn("Programmer senses no target voltage; is the target connected and powered?")
+	}
+	return nil
+}
+
+// Opens the programmer given by --device, or otherwise the single
+// programmer found by enumeration
+func findProgrammer() (*protocol.Device, error) {
+	if devicePath != "" {
+		dev, err := protocol.OpenPath(devicePath)
+		if err != nil {
+			return nil, fmt.Errorf("Opening %s: %v", devicePath, err)
+		}
+		return dev, nil
 	}
 
-	targetDev := target.ByName(targetName)
-	if targetDev == nil {
-		return nil, nil, fmt.Errorf("Target device '%s' not found", targetName)
+	devs, err := protocol.Connect()
+	if err != nil {
+		return nil, err
 	}
 
+	switch {
+	case len(devs) == 0:
+		return nil, errors.New("No programmer found")
+	case len(devs) > 1:
+		for _, dev := range devs {
+			dev.Close()
+		}
+		return nil, errors.New("Multiple programmers found - you must specify one")
+	}
+	return devs[0], nil
+}
+
+// Returns the ICP clock to use for the target, applying any --icp-clock
+// override
+func targetClock(td *target.Definition) (uint32, error) {
+	if icpClock == 0 {
+		return td.DefaultClock, nil
+	} else if td.MaxClock != 0 && icpClock > td.MaxClock {
+		return 0, fmt.Errorf("ICP clock %d kHz exceeds %s maximum of %d kHz", icpClock, td.Name, td.MaxClock)
+	}
+	return icpClock, nil
+}
+
+// Configures the programmer for the specified chip family and ICP clock
+// and places the target into ICP mode
+func enterICPMode(dev *protocol.Device, family protocol.ChipFamily, clock uint32) error {
 	// Most of this structure is TODO
 	cfg := protocol.Config{
-		Clock:       1000,
-		ChipFamily:  targetDev.Family,
+		Clock:       clock,
+		ChipFamily:  family,
 		Voltage:     3300,
 		PowerTarget: 0,
 		USBFuncE:    0,
 	}
 
 	if err := dev.SetConfig(cfg); err != nil {
-		return nil, nil, err
+		return err
 	}
 
 	if err := dev.Reset(protocol.Reset{
@@ -77,33 +133,130 @@ func connectToTarget() (*protocol.Device, *target.Definition, error) {
 		Connection: protocol.ConnectICPMode,
 		Mode:       protocol.ResetExtMode,
 	}); err != nil {
-		return nil, nil, err
+		return err
 	}
 
-	if err := dev.Reset(protocol.Reset{
+	return dev.Reset(protocol.Reset{
 		Type:       protocol.ResetNoneNuLink,
 		Connection: protocol.ConnectICPMode,
 		Mode:       protocol.ResetExtMode,
-	}); err != nil {
+	})
+}
+
+// Returns an error describing an unknown --target, suggesting the closest
+// match or otherwise listing the known targets
+func unknownTargetError(name string) error {
+	names := target.Names()
+	if suggestion := didYouMean(name, names); suggestion != "" {
+		return fmt.Errorf("Target device '%s' not found%s", name, suggestion)
+	}
+	return fmt.Errorf("Target device '%s' not found (known targets: %s)",
+		name, strings.Join(names, ", "))
+}
+
+// Returns the target selected by --target
+func lookupTarget() (*target.Definition, error) {
+	if targetName == "" {
+		return nil, errors.New("Target device not specified")
+	}
+
+	td := target.ByName(targetName)
+	if td == nil {
+		return nil, unknownTargetError(targetName)
+	}
+	return td, nil
+}
+
+func connectToTarget() (*protocol.Device, *target.Definition, error) {
+	targetDev, err := lookupTarget()
+	if err != nil {
 		return nil, nil, err
 	}
 
-	devID, err := dev.CheckID()
+	clock, err := targetClock(targetDev)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	if devID != targetDev.DeviceID {
-		return nil, nil, errors.New("Unsupported device")
+	dev, err := openProgrammer()
+	if err != nil {
+		return nil, nil, commsError{err}
+	}
+	if err := attachTarget(dev, targetDev, clock); err != nil {
+		dev.Close()
+		return nil, nil, err
+	}
+	return dev, targetDev, nil
+}
+
+// Connects to the target through dev, retrying up to --connect-retries
+// times
+func attachTarget(dev *protocol.Device, td *target.Definition, clock uint32) error {
+	if assumeTargetPresent {
+		if strict {
+			return errors.New("--assume-target-present cannot be used with --strict")
+		}
+		color.New(color.FgRed, color.Bold).Fprintf(os.Stderr,
+			"WARNING: --assume-target-present: safety checks are disabled; assuming the target is a %s\n", td.Name)
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := identifyTarget(dev, td, clock)
+		if err == nil {
+			break
+		} else if attempt >= connectRetries {
+			return err
+		}
+
+		log.Printf("Connection attempt %d failed (%s), retrying", attempt+1, err)
+		resetTarget(dev)
+	}
+
+	dev.SetSpaceSize(protocol.ConfigSpace, uint32(td.Config.WriteSize))
+	for _, s := range td.Spaces {
+		dev.SetSpaceSize(s.Space, s.Size)
+	}
+	return nil
+}
+
+// Enters ICP mode and checks that the connected device is the target
+func identifyTarget(dev *protocol.Device, targetDev *target.Definition, clock uint32) error {
+	if err := enterICPMode(dev, targetDev.Family, clock); err != nil {
+		return commsError{err}
+	}
+
+	if assumeTargetPresent {
+		// The ID of a new chip may not be known (or even readable); report
+		// it for the porter's benefit, but do not act upon it
+		if devID, err := dev.ReadID(); err != nil {
+			log.Printf("Reading device ID failed (%s); ignored (--assume-target-present)", err)
+		} else {
+			log.Printf("Device ID %s not checked (--assume-target-present)", devID)
+		}
+		return nil
+	}
+
+	devID, err := dev.CheckID()
+	if err != nil {
+		return commsError{err}
 	}
 
-	// Swivel to prevent defer closing our device
-	d2 := dev
-	dev = nil
-	return d2, targetDev, nil
+	if devID != targetDev.DeviceID {
+		if other := target.ByID(targetDev.Family, devID); other != nil {
+			return fmt.Errorf("Connected device is %s, not %s", other.Name, targetDev.Name)
+		}
+		return fmt.Errorf("Unsupported device (ID %s)", devID)
+	}
+	return nil
 }
 
 func resetAndCloseDevice(dev *protocol.Device) {
+	resetTarget(dev)
+	dev.Close()
+}
+
+// Releases the target from ICP mode, letting it run
+func resetTarget(dev *protocol.Device) {
 	// Experimentally observed sequence of commands to get the device to run again
 	dev.Reset(protocol.Reset{
 		Type:       protocol.ResetAuto,
@@ -122,5 +275,4 @@ func resetAndCloseDevice(dev *protocol.Device) {
 		Connection: protocol.ConnectDisconnect,
 		Mode:       protocol.ResetExtMode,
 	})
-	dev.Close()
 }
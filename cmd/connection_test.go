@@ -0,0 +1,42 @@
+// Copyright © 2019 Erin Shepherd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/erincandescent/nuvoprog/protocol"
+	"github.com/erincandescent/nuvoprog/target"
+)
+
+func TestAttachNoTarget(t *testing.T) {
+	defer func(n int) { connectRetries = n }(connectRetries)
+	connectRetries = 0
+
+	td := target.ByName("n76e003")
+	for _, id := range []protocol.DeviceID{0, 0xFFFFFFFF} {
+		dev, sim := simDevice(td)
+		sim.DeviceID = id
+
+		err := attachTarget(dev, td, 1000)
+		if cerr, ok := err.(commsError); !ok || !errors.Is(cerr.error, protocol.ErrTargetNotResponding) {
+			t.Errorf("Attaching with ID %s: got %v, expected ErrTargetNotResponding", id, err)
+		}
+		if code := exitCode(err); code != exitCommsFailure {
+			t.Errorf("Attaching with ID %s: exit code %d, expected %d", id, code, exitCommsFailure)
+		}
+	}
+}
@@ -28,28 +28,74 @@ var devicesCmd = &cobra.Command{
 	Short: "List connected programmers",
 	Long:  `Lisy connected programmers and their firmware versions`,
 	RunE: func(cmd *cobra.Command, args []string) error {
+		jsonOut, _ := cmd.Flags().GetBool("json")
+
 		devs, err := protocol.Connect()
 		if err != nil {
+			if jsonOut {
+				return reportJSON(nil, err)
+			}
 			return err
 		}
 
+		var infos []deviceInfo
 		for _, dev := range devs {
-			fmt.Printf("[%s] ", dev.Path())
+			info := deviceInfo{Path: dev.Path(), Serial: dev.Serial()}
 			ver, err := dev.GetVersion()
+			if err != nil {
+				info.Error = err.Error()
+			} else {
+				info.Product = ver.ProductID.String()
+				info.FirmwareVersion = uint32(ver.FirmwareVersion)
+				info.MaxPayload = dev.MaxPayloadSize()
+				if ver.Flags&protocol.FlagIsNulinkPro != 0 {
+					info.TargetVoltage = ver.TargetVoltage
+					info.USBVoltage = ver.USBVoltage
+					info.NoTarget = ver.NoTargetVoltage()
+				}
+			}
+			infos = append(infos, info)
+
+			if jsonOut {
+				continue
+			}
+
+			fmt.Printf("[%s] ", dev.Path())
 			if err != nil {
 				color.Red(err.Error())
 				fmt.Println()
 				continue
 			}
 
-			fmt.Println(ver)
+			fmt.Printf("%s; max payload: %d bytes\n", ver, dev.MaxPayloadSize())
+			if ver.NoTargetVoltage() {
+				color.Yellow("  No target voltage; is the target connected and powered?")
+			}
+		}
+
+		if jsonOut {
+			return reportJSON(infos, nil)
 		}
 		return nil
 	},
 }
 
+// Structured description of a programmer, as printed by devices --json
+type deviceInfo struct {
+	Path            string `json:"path"`
+	Serial          string `json:"serial,omitempty"`
+	Product         string `json:"product,omitempty"`
+	FirmwareVersion uint32 `json:"firmware_version,omitempty"`
+	MaxPayload      int    `json:"max_payload,omitempty"`
+	TargetVoltage   uint16 `json:"target_voltage_mv,omitempty"`
+	USBVoltage      uint16 `json:"usb_voltage_mv,omitempty"`
+	NoTarget        bool   `json:"no_target,omitempty"`
+	Error           string `json:"error,omitempty"`
+}
+
 func init() {
 	rootCmd.AddCommand(devicesCmd)
+	addJSONFlag(devicesCmd)
 
 	// Here you will define your flags and configuration settings.
 
@@ -0,0 +1,141 @@
+// Copyright © 2019 Erin Shepherd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/erincandescent/nuvoprog/protocol"
+	"github.com/erincandescent/nuvoprog/target"
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+)
+
+// ICP clocks (kHz) tried by diagnose-wiring, fastest first
+var diagnoseClocks = []uint32{1000, 250, 50}
+
+// diagnoseWiringCmd represents the diagnose-wiring command
+var diagnoseWiringCmd = &cobra.Command{
+	Use:   "diagnose-wiring",
+	Short: "Diagnose wiring between the programmer and target",
+	Long: `Attempts to identify the target at several ICP clock speeds and
+suggests likely wiring faults from the way in which it fails.
+
+The programmer cannot report the state of individual ICP pins, so the
+diagnosis is based on the device ID read back: a DAT line held low reads
+as all zeros and one floating or held high reads as all ones, while an ID
+which only reads correctly at low clock speeds suggests long or poorly
+connected wires. Diagnoses are hints, not certainties`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		family := protocol.ChipFamily(protocol.ChipFamily1T8051)
+		var td *target.Definition
+		if targetName != "" {
+			var err error
+			if td, err = lookupTarget(); err != nil {
+				return err
+			}
+			family = td.Family
+		}
+
+		dev, err := openProgrammer()
+		if err != nil {
+			return err
+		}
+		defer resetAndCloseDevice(dev)
+
+		if ver, err := dev.GetVersion(); err != nil {
+			return commsError{err}
+		} else if ver.NoTargetVoltage() {
+			color.Yellow("No target voltage sensed; check VDD and GND, and that the target is powered")
+		}
+
+		ids := make([]protocol.DeviceID, len(diagnoseClocks))
+		for i, clock := range diagnoseClocks {
+			if i > 0 {
+				resetTarget(dev)
+			}
+
+			if err := enterICPMode(dev, family, clock); err != nil {
+				return commsError{err}
+			}
+
+			if ids[i], err = dev.ReadID(); err != nil {
+				return commsError{err}
+			}
+			fmt.Printf("%5d kHz: device ID 0x%08x\n", clock, uint32(ids[i]))
+		}
+
+		fmt.Println()
+		diagnoseIDs(family, td, ids)
+		return nil
+	},
+}
+
+// Prints the likely cause of the device IDs read at each of diagnoseClocks
+func diagnoseIDs(family protocol.ChipFamily, td *target.Definition, ids []protocol.DeviceID) {
+	valid := func(id protocol.DeviceID) bool {
+		return id != 0 && id != 0xFFFFFFFF
+	}
+
+	// Index of the fastest clock at which the ID read is valid and agrees
+	// with every slower clock
+	good := len(ids)
+	for i := len(ids) - 1; i >= 0 && valid(ids[i]) && ids[i] == ids[len(ids)-1]; i-- {
+		good = i
+	}
+
+	allEqual := true
+	for _, id := range ids {
+		allEqual = allEqual && id == ids[0]
+	}
+
+	switch {
+	case allEqual && ids[0] == 0:
+		color.Red("DAT appears stuck low")
+		fmt.Println("Check the DAT connection, and that the target is powered (VDD and GND)")
+
+	case allEqual && ids[0] == 0xFFFFFFFF:
+		color.Red("DAT appears stuck high or floating")
+		fmt.Println("Check the DAT and CLK connections, and that RST is connected; the")
+		fmt.Println("target cannot enter ICP mode unless the programmer can reset it.")
+		fmt.Println("DAT and CLK may be swapped")
+
+	case good == len(ids):
+		color.Red("Device ID is unstable")
+		fmt.Println("Check the CLK connection and the ground between programmer and target.")
+		fmt.Println("DAT and CLK may be swapped, or other circuitry may be loading the ICP pins")
+
+	case good > 0:
+		color.Yellow("Device ID only reads reliably at %d kHz or below", diagnoseClocks[good])
+		fmt.Println("Wires may be too long or poorly connected; shorten them, or use")
+		fmt.Printf("--icp-clock %d\n", diagnoseClocks[good])
+
+	default:
+		id := ids[0]
+		other := target.ByID(family, id)
+		switch {
+		case td != nil && id != td.DeviceID && other != nil:
+			color.Yellow("Connected device is %s, not %s", other.Name, td.Name)
+		case other == nil:
+			color.Yellow("Target responds, but device ID %s is not a supported target", id)
+		default:
+			color.Green("Wiring OK: found %s", other.Name)
+		}
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(diagnoseWiringCmd)
+}
@@ -0,0 +1,90 @@
+// Copyright © 2019 Erin Shepherd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/erincandescent/nuvoprog/protocol"
+	"github.com/fatih/color"
+	"github.com/karalabe/hid"
+	"github.com/spf13/cobra"
+)
+
+const udevRule = `SUBSYSTEM=="hidraw", ATTRS{idVendor}=="0416", MODE="0666"`
+
+// doctorCmd represents the doctor command
+var doctorCmd = &cobra.Command{
+	Use:   "doctor",
+	Short: "Diagnose programmer connection problems",
+	Long: `Enumerates HID devices, looking for anything which looks like a
+Nuvoton programmer, and checks that it can be opened`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if !hid.Supported() {
+			color.Red("HID support is not available on this platform (%s/%s)",
+				runtime.GOOS, runtime.GOARCH)
+			return nil
+		}
+
+		found, usable, denied := 0, 0, 0
+		for _, info := range hid.Enumerate(0, 0) {
+			supported := protocol.IsSupported(info.VendorID, info.ProductID)
+			if !supported && info.VendorID != protocol.VendorNuvoton {
+				continue
+			}
+			found++
+
+			fmt.Printf("[%s] %04x:%04x %s %s\n", info.Path,
+				info.VendorID, info.ProductID, info.Manufacturer, info.Product)
+			if !supported {
+				color.Yellow("  Nuvoton device with unrecognised product ID; not a supported programmer")
+				continue
+			}
+
+			dev, err := info.Open()
+			if err != nil {
+				color.Red("  Unable to open: %s", err)
+				denied++
+				continue
+			}
+			dev.Close()
+			color.Green("  OK")
+			usable++
+		}
+
+		switch {
+		case found == 0:
+			fmt.Println("No Nuvoton devices found. Check that the programmer is plugged in,")
+			fmt.Println("and that its USB cable carries data")
+		case usable == 0 && denied == 0:
+			fmt.Println("No supported programmers found")
+		}
+
+		if denied > 0 && runtime.GOOS == "linux" {
+			fmt.Println()
+			fmt.Println("To allow access to Nuvoton programmers without root, install the udev rule")
+			fmt.Println()
+			fmt.Println("    " + udevRule)
+			fmt.Println()
+			fmt.Println("as /etc/udev/rules.d/50-nuvoton.rules, then replug the programmer")
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(doctorCmd)
+}
@@ -0,0 +1,222 @@
+// Copyright © 2019 Erin Shepherd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/erincandescent/nuvoprog/ihex"
+	"github.com/erincandescent/nuvoprog/srec"
+	"github.com/spf13/cobra"
+)
+
+// Image file format
+type imageFormat int
+
+const (
+	formatIHex imageFormat = iota
+	formatBinary
+	formatSREC
+)
+
+func (f imageFormat) String() string {
+	switch f {
+	case formatIHex:
+		return "ihex"
+	case formatBinary:
+		return "binary"
+	case formatSREC:
+		return "srec"
+	default:
+		return fmt.Sprintf("imageFormat(%d)", int(f))
+	}
+}
+
+// Determines file format from the file name (or URL path). Anything
+// unrecognised (including stdin/stdout) is treated as Intel Hex
+func formatForName(name string) imageFormat {
+	ext := filepath.Ext(name)
+	if isURL(name) {
+		if u, err := url.Parse(name); err == nil {
+			ext = path.Ext(u.Path)
+		}
+	}
+
+	switch strings.ToLower(ext) {
+	case ".bin":
+		return formatBinary
+	case ".srec", ".s19", ".s28", ".s37", ".mot":
+		return formatSREC
+	default:
+		return formatIHex
+	}
+}
+
+// Determines the format of an image file from its first bytes: Intel Hex
+// records start with ':' and S-records with 'S' and a digit (in either case
+// after any line breaks). Other content is only taken to be raw binary if
+// it is not text; otherwise it is treated as (malformed) Intel Hex, so that
+// e.g. a corrupt first line is reported rather than programmed
+func detectFormat(br *bufio.Reader) imageFormat {
+	buf, _ := br.Peek(64)
+	buf = bytes.TrimLeft(buf, "\r\n")
+
+	switch {
+	case len(buf) >= 1 && buf[0] == ':':
+		return formatIHex
+	case len(buf) >= 2 && buf[0] == 'S' && buf[1] >= '0' && buf[1] <= '9':
+		return formatSREC
+	case isText(buf):
+		// Including empty files; let the Intel Hex reader report any
+		// invalid line (or, under --strict, the missing EOF record)
+		return formatIHex
+	default:
+		return formatBinary
+	}
+}
+
+// Reports whether buf looks like (UTF-8) text, i.e. contains no control
+// characters other than whitespace. A partial character at the end of
+// buf is ignored
+func isText(buf []byte) bool {
+	for len(buf) > 0 && utf8.FullRune(buf) {
+		r, n := utf8.DecodeRune(buf)
+		if r == utf8.RuneError && n == 1 {
+			return false
+		} else if unicode.IsControl(r) && !strings.ContainsRune("\t\r\n\f\v", r) {
+			return false
+		}
+		buf = buf[n:]
+	}
+	return true
+}
+
+// Returns a reader for the blocks of the image file read from rd, in the
+// format determined by detectFormat. Raw binaries are placed at binOffset
+func detectBlockReader(rd io.Reader, binOffset uint32) (blockReader, imageFormat) {
+	br := bufio.NewReader(rd)
+	f := detectFormat(br)
+	return newBlockReader(f, br, binOffset), f
+}
+
+// Returns the --record-length, which must be valid for Intel Hex, or 0 if
+// it was not given
+func recordLength(cmd *cobra.Command) (int, error) {
+	if !cmd.Flags().Changed("record-length") {
+		return 0, nil
+	}
+
+	n, _ := cmd.Flags().GetInt("record-length")
+	if n < 1 || n > 255 {
+		return 0, fmt.Errorf("Record length %d out of range; must be 1 to 255", n)
+	}
+	return n, nil
+}
+
+// Source of data blocks from an image file
+type blockReader interface {
+	Next() (ihex.Block, error)
+}
+
+// Sink for data blocks into an image file
+type blockWriter interface {
+	Write(addr uint32, buf []byte) error
+	Close() error
+}
+
+func newBlockReader(f imageFormat, rd io.Reader, binOffset uint32) blockReader {
+	switch f {
+	case formatBinary:
+		return &binReader{r: rd, base: binOffset}
+	case formatSREC:
+		return srec.NewReader(rd)
+	default:
+		// Truncated files are detected under --strict
+		hrd := ihex.NewReader(rd)
+		hrd.RequireEOF = strict
+		return hrd
+	}
+}
+
+func newBlockWriter(f imageFormat, w io.WriteCloser, binOffset uint32) blockWriter {
+	switch f {
+	case formatBinary:
+		return &binWriter{w: w, base: binOffset}
+	case formatSREC:
+		return srec.NewWriter(w)
+	default:
+		return ihex.NewWriter(w)
+	}
+}
+
+// Reads a raw binary file as a single block at base
+type binReader struct {
+	r    io.Reader
+	base uint32
+	done bool
+}
+
+func (r *binReader) Next() (ihex.Block, error) {
+	if r.done {
+		return ihex.Block{}, io.EOF
+	}
+	r.done = true
+
+	buf, err := ioutil.ReadAll(r.r)
+	if err != nil {
+		return ihex.Block{}, err
+	}
+
+	return ihex.Block{Address: r.base, Data: buf}, nil
+}
+
+// Writes a raw binary file starting at base, filling gaps with 0xFF
+type binWriter struct {
+	w    io.WriteCloser
+	base uint32
+	buf  []byte
+}
+
+func (w *binWriter) Write(addr uint32, buf []byte) error {
+	if addr < w.base {
+		return fmt.Errorf("Block at 0x%08x is below binary base address 0x%08x", addr, w.base)
+	}
+
+	off := int(addr - w.base)
+	for len(w.buf) < off+len(buf) {
+		w.buf = append(w.buf, 0xFF)
+	}
+	copy(w.buf[off:], buf)
+	return nil
+}
+
+func (w *binWriter) Close() error {
+	if _, err := w.w.Write(w.buf); err != nil {
+		abortWrite(w.w)
+		return err
+	}
+
+	return w.w.Close()
+}
@@ -0,0 +1,57 @@
+// Copyright © 2019 Erin Shepherd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bufio"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/erincandescent/nuvoprog/target"
+)
+
+func TestDetectFormat(t *testing.T) {
+	cases := []struct {
+		name   string
+		input  string
+		format imageFormat
+	}{
+		{"ihex", ":00000001FF\n", formatIHex},
+		{"ihex after blank lines", "\r\n\n:00000001FF\n", formatIHex},
+		{"srec", "S00600004844521B\n", formatSREC},
+		{"empty", "", formatIHex},
+		{"binary", "\x02\x00\x06\xe4\xf5\x81", formatBinary},
+		{"invalid utf-8", "\xff\xfe\xfd", formatBinary},
+		{"byte order mark", "\xef\xbb\xbf:00000001FF\n", formatIHex},
+		{"leading spaces", "  :00000001FF\n", formatIHex},
+		{"corrupt first line", "garbage\n:00000001FF\n", formatIHex},
+	}
+
+	for _, c := range cases {
+		f := detectFormat(bufio.NewReader(strings.NewReader(c.input)))
+		if f != c.format {
+			t.Errorf("%s: detected %s, expected %s", c.name, f, c.format)
+		}
+	}
+}
+
+func TestReadRejectsText(t *testing.T) {
+	d := NewTargetData(target.ByName("n76e003"))
+	rd := ioutil.NopCloser(strings.NewReader("  :00000001FF\n"))
+	if err := d.read(rd, 0, uint32(len(d.Data)), readOptions{}, false, "aprom"); err == nil {
+		t.Error("Text with leading spaces was accepted")
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright © 2019 Erin Shepherd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+// imageChecksumCmd represents the image checksum command
+var imageChecksumCmd = &cobra.Command{
+	Use:   "checksum",
+	Short: "Print the CRC32 of an image",
+	Long: `Prints the CRC32 of a region of an image, as checked by verify --checksum
+and reported by program.
+
+The checksum is the CRC-32 used by zlib (IEEE 802.3 polynomial) over the
+whole region, at the size selected by the image's configuration, with
+unprogrammed bytes as 0xFF. The all region is APROM followed by LDROM`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		td, err := lookupTarget()
+		if err != nil {
+			return err
+		}
+
+		config, _ := cmd.Flags().GetString("config")
+		image, _ := cmd.Flags().GetString("image")
+		aprom, _ := cmd.Flags().GetString("aprom")
+		ldrom, _ := cmd.Flags().GetString("ldrom")
+		region, _ := cmd.Flags().GetString("region")
+
+		d, err := ReadTargetData(config, nil, image, aprom, ldrom, td, true)
+		if err != nil {
+			return err
+		}
+
+		checksum, err := d.Checksum(region)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("%08x\n", checksum)
+		return nil
+	},
+}
+
+func init() {
+	imageCmd.AddCommand(imageChecksumCmd)
+	imageChecksumCmd.Flags().String("region", checksumAll, "Region to checksum: aprom, ldrom or all")
+}
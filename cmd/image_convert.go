@@ -0,0 +1,115 @@
+// Copyright © 2019 Erin Shepherd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"errors"
+	"io"
+
+	"github.com/erincandescent/nuvoprog/ihex"
+	"github.com/erincandescent/nuvoprog/target"
+	"github.com/spf13/cobra"
+)
+
+// imageConvertCmd represents the image convert command
+var imageConvertCmd = &cobra.Command{
+	Use:   "convert",
+	Short: "Convert image file formats",
+	Long: `Converts an image between file formats, preserving addresses.
+
+The format of the input is detected from its contents. The format of the
+output is determined by its extension (.bin for raw binary, .srec, .s19,
+.s28, .s37 or .mot for S-records, otherwise Intel Hex). Raw binary files are
+placed at the address given by --bin-offset.
+
+Raw binary output does not include configuration, which would otherwise pad
+it to the configuration's address. Configuration is recognised by its
+address for the --target, or if none is given, for any known target`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		in, _ := cmd.Flags().GetString("in")
+		out, _ := cmd.Flags().GetString("out")
+		binOffset, _ := cmd.Flags().GetUint32("bin-offset")
+
+		if in == "" || out == "" {
+			return errors.New("Both input and output files must be specified")
+		}
+
+		rd, err := openRead(in)
+		if err != nil {
+			return err
+		}
+		defer rd.Close()
+
+		ws, err := openWrite(out)
+		if err != nil {
+			return err
+		}
+
+		var targets []*target.Definition
+		if targetName != "" {
+			td, err := lookupTarget()
+			if err != nil {
+				return err
+			}
+			targets = append(targets, td)
+		} else {
+			for _, name := range target.Names() {
+				targets = append(targets, target.ByName(name))
+			}
+		}
+
+		format := formatForName(out)
+		brd, _ := detectBlockReader(rd, binOffset)
+		bw := newBlockWriter(format, ws, binOffset)
+		for {
+			b, err := brd.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return err
+			}
+
+			if format == formatBinary && isConfigBlock(targets, b) {
+				if err := warn("Configuration at 0x%x not written to raw binary output", b.Address); err != nil {
+					return err
+				}
+				continue
+			}
+
+			if err := bw.Write(b.Address, b.Data); err != nil {
+				return err
+			}
+		}
+
+		return bw.Close()
+	},
+}
+
+// Reports whether b lies in the configuration space of any of targets
+func isConfigBlock(targets []*target.Definition, b ihex.Block) bool {
+	for _, td := range targets {
+		if _, ok := configAddress(td, b); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func init() {
+	imageCmd.AddCommand(imageConvertCmd)
+	imageConvertCmd.Flags().String("in", "", "Input file, e.g. image.ihx")
+	imageConvertCmd.Flags().String("out", "", "Output file, e.g. image.bin")
+	imageConvertCmd.Flags().Uint32("bin-offset", 0, "Address of the start of raw binary files")
+}
@@ -0,0 +1,44 @@
+// Copyright © 2019 Erin Shepherd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"testing"
+
+	"github.com/erincandescent/nuvoprog/ihex"
+	"github.com/erincandescent/nuvoprog/target"
+)
+
+func TestIsConfigBlock(t *testing.T) {
+	td := target.ByName("n76e003")
+	targets := []*target.Definition{td}
+
+	cases := []struct {
+		name    string
+		address uint32
+		length  int
+		want    bool
+	}{
+		{"program", 0, 16, false},
+		{"config", td.Config.IHexOffset, 5, true},
+		{"config overrun", td.Config.IHexOffset, 64, false},
+	}
+	for _, c := range cases {
+		b := ihex.Block{Address: c.address, Data: make([]byte, c.length)}
+		if got := isConfigBlock(targets, b); got != c.want {
+			t.Errorf("%s: isConfigBlock = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
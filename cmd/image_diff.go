@@ -0,0 +1,119 @@
+// Copyright © 2019 Erin Shepherd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+
+	"github.com/erincandescent/nuvoprog/target"
+	"github.com/spf13/cobra"
+)
+
+var errImagesDiffer = errors.New("Images differ")
+
+// imageDiffCmd represents the image diff command
+var imageDiffCmd = &cobra.Command{
+	Use:   "diff A B",
+	Short: "Compare two images",
+	Long: `Compares two images for the target, printing the CRC32 of each (as in
+'image checksum'). If the CRC32s and configurations match, the images are
+reported as identical; otherwise, or with --detailed, the configuration and
+each range of addresses which differ are printed.
+
+Unprogrammed bytes are treated as 0xFF, so images which differ only in which
+erased bytes they specify are identical. Images need not contain a
+configuration; a missing configuration is treated as erased. Ranges given
+with --exclude (e.g. for serial numbers) are not compared; addresses are as
+in the image files. Exits with status 2 if the images differ`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		td, err := lookupTarget()
+		if err != nil {
+			return err
+		}
+
+		excludeArgs, _ := cmd.Flags().GetStringArray("exclude")
+		exclude, err := parseAddrRanges(excludeArgs)
+		if err != nil {
+			return err
+		}
+
+		var images [2]*TargetData
+		var checksums [2]uint32
+		for i, name := range args {
+			images[i], err = readImageFile(name, td)
+			if err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+
+			// As Checksum(checksumAll), which covers all of program memory,
+			// but without requiring a configuration
+			checksums[i] = crc32.ChecksumIEEE(images[i].Data)
+			fmt.Printf("%s: CRC32 %08x\n", name, checksums[i])
+		}
+
+		a, b := images[0], images[1]
+		detailed, _ := cmd.Flags().GetBool("detailed")
+		if checksums[0] == checksums[1] && a.configEqual(b.Config) && !detailed {
+			fmt.Println("Images are identical")
+			return nil
+		}
+
+		for _, d := range images {
+			for i := range d.Data {
+				if exclude.contains(uint32(i)) {
+					d.Data[i] = 0xFF
+				}
+			}
+		}
+
+		equal, blocks := a.Equal(b)
+		for _, blk := range blocks {
+			if blk.Address == td.Config.IHexOffset {
+				fmt.Printf("config: %X -> %X\n", a.Config, b.Config)
+				continue
+			}
+			fmt.Printf("0x%04x-0x%04x differs\n", blk.Address, blk.Address+uint32(len(blk.Data))-1)
+		}
+
+		if !equal {
+			return reportedError{errImagesDiffer}
+		}
+		fmt.Println("Images are identical")
+		return nil
+	},
+}
+
+// Reads the image file name for td, which need not contain a configuration
+func readImageFile(name string, td *target.Definition) (*TargetData, error) {
+	rd, err := openRead(name)
+	if err != nil {
+		return nil, err
+	}
+
+	d := NewTargetData(td)
+	if err := d.read(rd, 0, uint32(td.ProgMemSize), readOptions{}, true, "image"); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func init() {
+	imageCmd.AddCommand(imageDiffCmd)
+	imageDiffCmd.Flags().Bool("detailed", false, "List differences even if the CRC32s match")
+	imageDiffCmd.Flags().StringArray("exclude", nil, "Address range to ignore, e.g. 0x1F00-0x1FFF (repeatable)")
+}
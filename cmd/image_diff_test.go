@@ -0,0 +1,42 @@
+// Copyright © 2019 Erin Shepherd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"testing"
+
+	"github.com/erincandescent/nuvoprog/target"
+)
+
+func TestReadImageFileWithoutConfig(t *testing.T) {
+	td := target.ByName("n76e003")
+	name := writeTemp(t, "image.ihx", ":020010001234A8\n:00000001FF\n")
+
+	d, err := readImageFile(name, td)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(d.Config) != 0 {
+		t.Errorf("Unexpected configuration %X", d.Config)
+	} else if d.Data[0x10] != 0x12 || d.Data[0x11] != 0x34 {
+		t.Errorf("Unexpected data % x", d.Data[0x10:0x12])
+	}
+
+	// A missing configuration is equivalent to an erased one
+	erased := NewTargetData(td)
+	erased.Config = []byte{0xFF, 0xFF, 0xFF, 0xFF}
+	if !d.configEqual(erased.Config) {
+		t.Error("Missing configuration differs from erased configuration")
+	}
+}
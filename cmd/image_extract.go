@@ -0,0 +1,99 @@
+// Copyright © 2019 Erin Shepherd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+// imageExtractCmd represents the image extract command
+var imageExtractCmd = &cobra.Command{
+	Use:   "extract",
+	Short: "Extract an address range from an image",
+	Long: `Extracts the bytes from --offset to --offset+--length of the program
+memory image (APROM and LDROM) into a standalone file.
+
+The output format is determined by its extension (.bin for raw binary,
+otherwise Intel Hex). Intel Hex output keeps the original addresses; raw
+binary output starts at --offset. If --length is not given, the range
+extends to the end of program memory`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		td, err := lookupTarget()
+		if err != nil {
+			return err
+		}
+
+		config, _ := cmd.Flags().GetString("config")
+		image, _ := cmd.Flags().GetString("image")
+		aprom, _ := cmd.Flags().GetString("aprom")
+		ldrom, _ := cmd.Flags().GetString("ldrom")
+		output, _ := cmd.Flags().GetString("output")
+		offset, _ := cmd.Flags().GetUint32("offset")
+		length, _ := cmd.Flags().GetUint32("length")
+
+		if output == "" {
+			return errors.New("Output file not specified")
+		}
+
+		d, err := ReadTargetData(config, nil, image, aprom, ldrom, td, true)
+		if err != nil {
+			return err
+		}
+
+		size := uint64(len(d.Data))
+		if !cmd.Flags().Changed("length") {
+			if uint64(offset) < size {
+				length = uint32(size - uint64(offset))
+			}
+		}
+
+		if err := checkRange(offset, length, size); err != nil {
+			return err
+		}
+
+		ws, err := openWrite(output)
+		if err != nil {
+			return err
+		}
+
+		w := newBlockWriter(formatForName(output), ws, offset)
+		if err := w.Write(offset, d.Data[offset:offset+length]); err != nil {
+			return err
+		}
+		return w.Close()
+	},
+}
+
+// Checks that the length bytes from offset lie within an image of size
+// bytes. Ranges are reported inclusive of both ends
+func checkRange(offset, length uint32, size uint64) error {
+	if length == 0 {
+		return fmt.Errorf("Range at 0x%04x is empty", offset)
+	} else if uint64(offset)+uint64(length) > size {
+		return fmt.Errorf("Range 0x%04x-0x%04x is outside the image (0x0000-0x%04x)",
+			offset, uint64(offset)+uint64(length)-1, size-1)
+	}
+	return nil
+}
+
+func init() {
+	imageCmd.AddCommand(imageExtractCmd)
+	imageExtractCmd.Flags().StringP("output", "o", "", "Output file, e.g. cal.bin")
+	imageExtractCmd.Flags().Uint32("offset", 0, "Address of the start of the range")
+	imageExtractCmd.Flags().Uint32("length", 0, "Length of the range in bytes")
+}
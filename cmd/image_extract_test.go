@@ -0,0 +1,40 @@
+// Copyright © 2019 Erin Shepherd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import "testing"
+
+func TestCheckRange(t *testing.T) {
+	cases := []struct {
+		offset, length uint32
+		want           string
+	}{
+		{0, 0x4800, ""},
+		{0x4000, 0x800, ""},
+		{0x4000, 0, "Range at 0x4000 is empty"},
+		{0x4000, 0x801, "Range 0x4000-0x4800 is outside the image (0x0000-0x47ff)"},
+		{0xffffffff, 2, "Range 0xffffffff-0x100000000 is outside the image (0x0000-0x47ff)"},
+	}
+	for _, c := range cases {
+		err := checkRange(c.offset, c.length, 0x4800)
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+		if got != c.want {
+			t.Errorf("checkRange(0x%x, 0x%x) = %q, want %q", c.offset, c.length, got, c.want)
+		}
+	}
+}
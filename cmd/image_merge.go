@@ -15,8 +15,8 @@
 package cmd
 
 import (
+	"encoding/hex"
 	"errors"
-	"fmt"
 
 	"github.com/erincandescent/nuvoprog/target"
 	"github.com/spf13/cobra"
@@ -26,7 +26,24 @@ import (
 var imageMergeCmd = &cobra.Command{
 	Use:   "merge",
 	Short: "Merge image files",
-	Long:  `Merges configuration, APROM and optionally LDROM images into a composite image`,
+	Long: `Merges configuration, APROM and optionally LDROM images into a composite image
+
+With --base, the base image is loaded first and the other inputs are merged
+on top of it, so that an image can be built up over several runs. Erased
+(0xFF) bytes in the inputs leave the base unchanged. Inputs may not change
+bytes which the base already programs, or change its configuration, unless
+--overwrite is given. The base's configuration is used to place APROM and
+LDROM unless --config or --image is given.
+
+Raw binary inputs are loaded at --bin-offset from the start of their region
+(program memory for --image, APROM for --aprom and LDROM for --ldrom). With
+--reject-overlaps, inputs (or records of one input) which write an address
+twice with different values are an error; otherwise the later value wins,
+and --aprom or --ldrom replace the corresponding region of --image.
+
+The output is written as Motorola S-records if its name ends in .srec, .s19,
+.s28, .s37 or .mot, as raw binary (program memory only, without the
+configuration) if it ends in .bin, and otherwise as Intel Hex`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		if targetName == "" {
 			return errors.New("Target device not specified")
@@ -34,7 +51,7 @@ var imageMergeCmd = &cobra.Command{
 
 		td := target.ByName(targetName)
 		if td == nil {
-			return fmt.Errorf("Target device '%s' not found", targetName)
+			return unknownTargetError(targetName)
 		}
 
 		config, _ := cmd.Flags().GetString("config")
@@ -43,16 +60,59 @@ var imageMergeCmd = &cobra.Command{
 		ldrom, _ := cmd.Flags().GetString("ldrom")
 		output, _ := cmd.Flags().GetString("output")
 
-		d, err := ReadTargetData(config, image, aprom, ldrom, td, true)
+		base, _ := cmd.Flags().GetString("base")
+		overwrite, _ := cmd.Flags().GetBool("overwrite")
+
+		var bd *TargetData
+		if base != "" {
+			var err error
+			if bd, err = ReadTargetData("", nil, base, "", "", td, true); err != nil {
+				return err
+			}
+
+			// Place APROM and LDROM using the base's configuration,
+			// unless another is given
+			if config == "" && image == "" {
+				config = hex.EncodeToString(bd.Config)
+			}
+		}
+
+		var readOpts readOptions
+		readOpts.binOffset, _ = cmd.Flags().GetUint32("bin-offset")
+		readOpts.rejectOverlaps, _ = cmd.Flags().GetBool("reject-overlaps")
+		d, err := readTargetData(config, nil, image, aprom, ldrom, td, base == "", readOpts)
 		if err != nil {
 			return err
 		}
 
+		if bd != nil {
+			if err := bd.Overlay(d, overwrite); err != nil {
+				return err
+			}
+			d = bd
+		}
+
+		d.PreserveRecords, _ = cmd.Flags().GetBool("preserve-records")
+		if d.RecordLength, err = recordLength(cmd); err != nil {
+			return err
+		}
+		d.Format = formatForName(output)
+
 		w, err := openWrite(output)
 		if err != nil {
 			return err
 		}
-		d.Write(w)
+		if err := d.Write(w); err != nil {
+			return err
+		}
+
+		outputConfig, _ := cmd.Flags().GetString("output-config")
+		if outputConfig != "" {
+			if len(d.Config) == 0 {
+				return warn("No configuration present; not writing %s", outputConfig)
+			}
+			return d.WriteConfigJSON(outputConfig)
+		}
 
 		return nil
 	},
@@ -61,4 +121,11 @@ var imageMergeCmd = &cobra.Command{
 func init() {
 	imageCmd.AddCommand(imageMergeCmd)
 	imageMergeCmd.Flags().StringP("output", "o", "", "Output file, e.g. image.ihx")
+	imageMergeCmd.Flags().String("base", "", "Existing image to merge the inputs on top of, e.g. base.ihx")
+	imageMergeCmd.Flags().Bool("overwrite", false, "Allow inputs to replace data and configuration in --base")
+	imageMergeCmd.Flags().Bool("reject-overlaps", false, "Reject inputs which write differing values to the same address")
+	imageMergeCmd.Flags().Uint32("bin-offset", 0, "Offset from the start of their region at which to load raw binary inputs")
+	imageMergeCmd.Flags().Int("record-length", 0, "Maximum length of Intel Hex data records, e.g. 16 (defaults to the target's page size)")
+	imageMergeCmd.Flags().Bool("preserve-records", false, "Split data into records as in the input files, rather than 32 byte records")
+	imageMergeCmd.Flags().String("output-config", "", "Also write the decoded configuration as JSON, e.g. config.json")
 }
@@ -0,0 +1,114 @@
+// Copyright © 2019 Erin Shepherd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/erincandescent/nuvoprog/target"
+	"github.com/spf13/cobra"
+)
+
+// Parses a size, either as a number (e.g. 18432, 0x4800) or as a number
+// of kilobytes (e.g. 18k)
+func parseSize(arg string) (uint, error) {
+	s := strings.ToLower(strings.TrimSpace(arg))
+	mult := uint64(1)
+	if strings.HasSuffix(s, "k") || strings.HasSuffix(s, "kb") {
+		s = strings.TrimSuffix(strings.TrimSuffix(s, "b"), "k")
+		mult = 1024
+	}
+
+	n, err := strconv.ParseUint(s, 0, 32)
+	if err != nil {
+		return 0, fmt.Errorf("'%s' not understood as a size", arg)
+	}
+	return uint(n * mult), nil
+}
+
+// imagePadCmd represents the image pad command
+var imagePadCmd = &cobra.Command{
+	Use:   "pad",
+	Short: "Pad an image to a fixed size",
+	Long: `Pads an image to a fixed size (by default, the target's program memory
+size), filling unused space with 0xFF or the byte given by --fill`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		image, _ := cmd.Flags().GetString("image")
+		output, _ := cmd.Flags().GetString("output")
+		sizeArg, _ := cmd.Flags().GetString("size")
+		fill, _ := cmd.Flags().GetUint8("fill")
+
+		if image == "" {
+			return errors.New("No input files specified")
+		} else if output == "" {
+			return errors.New("No output file specified")
+		}
+
+		// Without a target, the image is read as plain program memory
+		var td target.Definition
+		if targetName != "" {
+			if def := target.ByName(targetName); def != nil {
+				td = *def
+			} else {
+				return unknownTargetError(targetName)
+			}
+		}
+
+		switch {
+		case sizeArg != "":
+			size, err := parseSize(sizeArg)
+			if err != nil {
+				return err
+			}
+			td.ProgMemSize = size
+		case targetName == "":
+			return errors.New("Size or target device must be specified")
+		}
+
+		rd, err := openRead(image)
+		if err != nil {
+			return err
+		}
+
+		d := NewTargetData(&td)
+		if err := d.read(rd, 0, uint32(td.ProgMemSize), readOptions{}, targetName != "", "image"); err != nil {
+			return err
+		}
+
+		for i := range d.Data {
+			if !d.isWritten(uint32(i)) {
+				d.Data[i] = fill
+			}
+		}
+
+		ws, err := openWrite(output)
+		if err != nil {
+			return err
+		}
+
+		d.Format = formatForName(output)
+		return d.Write(ws)
+	},
+}
+
+func init() {
+	imageCmd.AddCommand(imagePadCmd)
+	imagePadCmd.Flags().StringP("output", "o", "", "Output file, e.g. image.ihx")
+	imagePadCmd.Flags().String("size", "", "Size to pad to, e.g. 12k (defaults to the target's program memory size)")
+	imagePadCmd.Flags().Uint8("fill", 0xFF, "Fill byte")
+}
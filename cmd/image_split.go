@@ -15,9 +15,7 @@
 package cmd
 
 import (
-	"encoding/json"
 	"errors"
-	"fmt"
 
 	"github.com/erincandescent/nuvoprog/target"
 	"github.com/spf13/cobra"
@@ -27,7 +25,16 @@ import (
 var imageSplit = &cobra.Command{
 	Use:   "split",
 	Short: "Split image files",
-	Long:  `Splits an image file into APROM, LDROM and Config components`,
+	Long: `Splits an image file into APROM, LDROM and Config components
+
+Instead of individual output filenames, --output-template may be given;
+its {region} placeholder is replaced with config, aprom or ldrom for each
+output (the configuration is always written as JSON). {target}, {date}
+and {time} are also available.
+
+APROM and LDROM are written as raw binary (the whole region, with 0xFF for
+unprogrammed bytes) if their names end in .bin, as S-records if they end in
+.srec, .s19, .s28, .s37 or .mot, and otherwise as Intel Hex`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		if targetName == "" {
 			return errors.New("Target device not specified")
@@ -35,44 +42,51 @@ var imageSplit = &cobra.Command{
 
 		td := target.ByName(targetName)
 		if td == nil {
-			return fmt.Errorf("Target device '%s' not found", targetName)
+			return unknownTargetError(targetName)
 		}
 
 		config, _ := cmd.Flags().GetString("config")
 		image, _ := cmd.Flags().GetString("image")
 		aprom, _ := cmd.Flags().GetString("aprom")
 		ldrom, _ := cmd.Flags().GetString("ldrom")
-
-		d, err := ReadTargetData("", image, "", "", td, true)
-		if err != nil {
-			return err
-		}
-
-		if config != "" {
-			if len(d.Config) == 0 {
-				return errors.New("Asked to write config which is not present")
+		outDir, _ := cmd.Flags().GetString("output-dir")
+		outTemplate, _ := cmd.Flags().GetString("output-template")
+
+		vars := templateVars(targetName)
+		outputs := []*string{&config, &aprom, &ldrom}
+		for i, region := range []string{"config", "aprom", "ldrom"} {
+			if outTemplate == "" && *outputs[i] == "" {
+				continue
 			}
 
-			cfg, err := td.Config.Decode(d.Config)
+			vars["region"] = region
+			name, err := outputName(outDir, outTemplate, *outputs[i], vars)
 			if err != nil {
 				return err
 			}
+			*outputs[i] = name
+		}
 
-			buf, err := json.MarshalIndent(cfg, "", "    ")
-			if err != nil {
-				return err
-			}
+		d, err := ReadTargetData("", nil, image, "", "", td, true)
+		if err != nil {
+			return err
+		}
 
-			f, err := openWrite(config)
-			if err != nil {
-				return err
-			}
+		d.PreserveRecords, _ = cmd.Flags().GetBool("preserve-records")
+		if d.RecordLength, err = recordLength(cmd); err != nil {
+			return err
+		}
 
-			if _, err := f.Write(buf); err != nil {
-				return err
+		if outTemplate != "" && len(d.Config) == 0 {
+			config = ""
+		}
+
+		if config != "" {
+			if len(d.Config) == 0 {
+				return errors.New("Asked to write config which is not present")
 			}
 
-			if err := f.Close(); err != nil {
+			if err := d.WriteConfigJSON(config); err != nil {
 				return err
 			}
 		}
@@ -83,6 +97,7 @@ var imageSplit = &cobra.Command{
 				return err
 			}
 
+			d.Format = formatForName(aprom)
 			if err := d.WriteAPROM(f); err != nil {
 				return err
 			}
@@ -94,6 +109,7 @@ var imageSplit = &cobra.Command{
 				return err
 			}
 
+			d.Format = formatForName(ldrom)
 			if err := d.WriteLDROM(f); err != nil {
 				return err
 			}
@@ -105,4 +121,8 @@ var imageSplit = &cobra.Command{
 
 func init() {
 	imageCmd.AddCommand(imageSplit)
+	imageSplit.Flags().String("output-template", "", "Output filename template, e.g. board-{region}.ihx")
+	imageSplit.Flags().Int("record-length", 0, "Maximum length of Intel Hex data records, e.g. 16 (defaults to the target's page size)")
+	imageSplit.Flags().Bool("preserve-records", false, "Split data into records as in the input file, rather than 32 byte records")
+	imageSplit.Flags().String("output-dir", "", "Directory in which to write output files")
 }
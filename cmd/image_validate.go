@@ -0,0 +1,121 @@
+// Copyright © 2019 Erin Shepherd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/erincandescent/nuvoprog/ihex"
+	"github.com/spf13/cobra"
+)
+
+// imageValidateCmd represents the image validate command
+var imageValidateCmd = &cobra.Command{
+	Use:   "validate FILE",
+	Short: "Check that an Intel Hex file is well formed",
+	Long: `Reads an Intel Hex file, checking record syntax and checksums, that it
+ends with an EOF record, and that no two records write the same address.
+Problems are reported with line numbers. If the file is valid, the address
+ranges it covers are printed.
+
+No target is needed. Exits with a non-zero status if any problem is found`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name := args[0]
+		rd, err := openRead(name)
+		if err != nil {
+			return err
+		}
+		defer rd.Close()
+
+		type record struct {
+			ihex.Span
+			line int
+		}
+
+		var records []record
+		hrd := ihex.NewReader(rd)
+		hrd.RequireEOF = true
+		for {
+			b, err := hrd.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return fmt.Errorf("%s:%d: %v", name, hrd.Line(), err)
+			}
+
+			if len(b.Data) == 0 {
+				continue
+			}
+
+			records = append(records, record{
+				Span: ihex.Span{Address: b.Address, Length: uint32(len(b.Data))},
+				line: hrd.Line(),
+			})
+		}
+
+		sort.SliceStable(records, func(i, j int) bool {
+			return records[i].Address < records[j].Address
+		})
+
+		// Report overlaps, and merge adjacent records into extents
+		end := func(s ihex.Span) uint64 {
+			return uint64(s.Address) + uint64(s.Length)
+		}
+
+		overlaps := 0
+		var extents []ihex.Span
+		var last record
+		total := uint64(0)
+		for i, r := range records {
+			total += uint64(r.Length)
+			if i > 0 && uint64(r.Address) < end(last.Span) {
+				fmt.Fprintf(os.Stderr, "%s:%d: Record at 0x%08x overlaps record on line %d\n",
+					name, r.line, r.Address, last.line)
+				overlaps++
+			}
+
+			if n := len(extents); n > 0 && uint64(r.Address) <= end(extents[n-1]) {
+				if end(r.Span) > end(extents[n-1]) {
+					extents[n-1].Length = uint32(end(r.Span) - uint64(extents[n-1].Address))
+				}
+			} else {
+				extents = append(extents, r.Span)
+			}
+
+			// Compare against whichever earlier record extends furthest
+			if i == 0 || end(r.Span) > end(last.Span) {
+				last = r
+			}
+		}
+
+		if overlaps > 0 {
+			return fmt.Errorf("%s: %d overlapping records", name, overlaps)
+		}
+
+		fmt.Printf("%s: %d records, %d data bytes\n", name, len(records), total)
+		for _, e := range extents {
+			fmt.Printf("  0x%08x-0x%08x (%d bytes)\n", e.Address, e.Address+e.Length-1, e.Length)
+		}
+		return nil
+	},
+}
+
+func init() {
+	imageCmd.AddCommand(imageValidateCmd)
+}
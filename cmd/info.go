@@ -0,0 +1,96 @@
+// Copyright © 2019 Erin Shepherd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/erincandescent/nuvoprog/target"
+	"github.com/spf13/cobra"
+)
+
+// infoCmd represents the info command
+var infoCmd = &cobra.Command{
+	Use:   "info",
+	Short: "Show the connected target's flash layout",
+	Long: `Connects to the target, reads its configuration and prints the APROM
+and LDROM address ranges it selects. Addresses are as seen by the
+programmer, so LDROM is shown at the target's LDROM offset`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		res, err := runInfo()
+		if jsonOut, _ := cmd.Flags().GetBool("json"); jsonOut {
+			if err != nil {
+				return reportJSON(nil, err)
+			}
+			return reportJSON(res, nil)
+		} else if err != nil {
+			return err
+		}
+
+		fmt.Printf("Target: %s\n", res.Target)
+		fmt.Printf("Locked: %v\n", res.Locked)
+		fmt.Printf("APROM:  %s\n", formatRegion(res.Layout.APROM))
+		fmt.Printf("LDROM:  %s\n", formatRegion(res.Layout.LDROM))
+		return nil
+	},
+}
+
+// Description of a target, as printed by info --json
+type infoResult struct {
+	Target string        `json:"target"`
+	Locked bool          `json:"locked"`
+	Layout target.Layout `json:"layout"`
+}
+
+func runInfo() (*infoResult, error) {
+	td, err := lookupTarget()
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, err := readDeviceConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	cfgo, err := td.Config.Decode(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &infoResult{
+		Target: td.Name,
+		Locked: cfgo.IsLocked(),
+		Layout: td.Layout(cfgo),
+	}, nil
+}
+
+// Formats a region as e.g. "0x3800-0x3FFF (2KB)"
+func formatRegion(r target.Region) string {
+	if r.Size == 0 {
+		return "none"
+	}
+
+	size := fmt.Sprintf("%d bytes", r.Size)
+	if r.Size%1024 == 0 {
+		size = fmt.Sprintf("%dKB", r.Size/1024)
+	}
+	return fmt.Sprintf("0x%04X-0x%04X (%s)", r.Start, r.End(), size)
+}
+
+func init() {
+	rootCmd.AddCommand(infoCmd)
+	addJSONFlag(infoCmd)
+}
@@ -0,0 +1,96 @@
+// Copyright © 2019 Erin Shepherd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// Runs of erased bytes shorter than this do not split a populated range
+const mapMinGap = 16
+
+// Returns the [start, end) offsets of the populated (non-0xFF) ranges of buf
+func populatedRanges(buf []byte) [][2]int {
+	var ranges [][2]int
+	start, end := -1, -1
+	for i, b := range buf {
+		if b == 0xFF {
+			continue
+		}
+
+		if start >= 0 && i-end >= mapMinGap {
+			ranges = append(ranges, [2]int{start, end})
+			start = -1
+		}
+		if start < 0 {
+			start = i
+		}
+		end = i + 1
+	}
+
+	if start >= 0 {
+		ranges = append(ranges, [2]int{start, end})
+	}
+	return ranges
+}
+
+func writeMapRegion(w io.Writer, name string, base uint32, buf []byte) {
+	if len(buf) == 0 {
+		return
+	}
+
+	fmt.Fprintf(w, "%-6s 0x%04x-0x%04x %6d bytes\n", name, base, base+uint32(len(buf))-1, len(buf))
+	for _, r := range populatedRanges(buf) {
+		fmt.Fprintf(w, "       0x%04x-0x%04x %6d bytes\n",
+			base+uint32(r[0]), base+uint32(r[1])-1, r[1]-r[0])
+	}
+}
+
+// Writes a listing of the populated regions of the image and the
+// target's interrupt vectors, suitable as input to a disassembler
+func (d *TargetData) WriteMap(ws io.WriteCloser) (err error) {
+	defer func() {
+		if err != nil {
+			abortWrite(ws)
+		} else {
+			err = ws.Close()
+		}
+	}()
+
+	aprom, err := d.APROM()
+	if err != nil {
+		return err
+	}
+	ldrom, err := d.LDROM()
+	if err != nil {
+		return err
+	}
+
+	td := d.TargetDefinition
+	w := bufio.NewWriter(ws)
+	fmt.Fprintf(w, "; %s memory map\n", td.Name)
+	writeMapRegion(w, "APROM", 0, aprom)
+	writeMapRegion(w, "LDROM", uint32(td.LDROMOffset), ldrom)
+
+	if len(td.Vectors) != 0 {
+		fmt.Fprintln(w, "\nVectors")
+		for _, v := range td.Vectors {
+			fmt.Fprintf(w, "       0x%04x %s\n", v.Address, v.Name)
+		}
+	}
+	return w.Flush()
+}
@@ -0,0 +1,74 @@
+// Copyright © 2019 Erin Shepherd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/erincandescent/nuvoprog/protocol"
+	"github.com/erincandescent/nuvoprog/target"
+)
+
+type bufferCloser struct {
+	bytes.Buffer
+}
+
+func (bufferCloser) Close() error { return nil }
+
+func TestWriteMapVectors(t *testing.T) {
+	n := 0
+	for _, name := range target.Names() {
+		td := target.ByName(name)
+		if td.Family != protocol.ChipFamily1T8051 {
+			continue
+		}
+		n++
+
+		var buf bufferCloser
+		if err := simImage(td, nil).WriteMap(&buf); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		if !strings.Contains(buf.String(), "0x0000 reset\n") {
+			t.Errorf("%s: map does not list the reset vector:\n%s", name, buf.String())
+		}
+	}
+	if n == 0 {
+		t.Fatal("No 8051 targets registered")
+	}
+}
+
+func TestWriteMapRanges(t *testing.T) {
+	td := target.ByName("n76e003")
+	d := simImage(td, []byte{0x02, 0x01, 0x00})
+	copy(d.Data[0x100:], []byte{0x75, 0x81})
+
+	var buf bufferCloser
+	if err := d.WriteMap(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		"APROM  0x0000-0x47ff  18432 bytes\n",
+		"       0x0000-0x0002      3 bytes\n",
+		"       0x0100-0x0101      2 bytes\n",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("Map does not contain %q:\n%s", want, buf.String())
+		}
+	}
+}
@@ -0,0 +1,417 @@
+// Copyright © 2019 Erin Shepherd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/erincandescent/nuvoprog/protocol"
+	"github.com/erincandescent/nuvoprog/target"
+	"github.com/spf13/cobra"
+)
+
+// Error communicating with the programmer or target
+type commsError struct {
+	error
+}
+
+// Largest page size; reads carry an 8-bit length
+const maxPageSize = math.MaxUint8
+
+// Size of the command code and memory command header which precede the
+// data of a write request
+const writeHeaderSize = 12
+
+// Returns the page size to use for target, applying any --page-size
+// override
+func pageSize(cmd *cobra.Command, td *target.Definition) (int, error) {
+	if !cmd.Flags().Changed("page-size") {
+		return int(td.PageSize), nil
+	}
+
+	n, _ := cmd.Flags().GetInt("page-size")
+	return n, checkPageSize(n)
+}
+
+func checkPageSize(n int) error {
+	if n < 1 || n > maxPageSize {
+		return fmt.Errorf("Page size %d out of range; must be 1 to %d", n, maxPageSize)
+	}
+	return nil
+}
+
+// Checks that pages of n bytes can be written to dev, each in a single
+// request
+func checkWritePageSize(dev *protocol.Device, n int) error {
+	if max := dev.MaxPayloadSize() - writeHeaderSize; n > max {
+		return fmt.Errorf("Page size %d exceeds the programmer's maximum write of %d bytes", n, max)
+	}
+	return nil
+}
+
+// Returns the number of times to retry each failed read, given by --retries
+func retryCount(cmd *cobra.Command) (int, error) {
+	n, _ := cmd.Flags().GetInt("retries")
+	if n < 0 {
+		return 0, fmt.Errorf("Retry count %d must not be negative", n)
+	}
+	return n, nil
+}
+
+// Returns td with any --ldrom-offset override applied
+func withLDROMOffset(cmd *cobra.Command, td *target.Definition) (*target.Definition, error) {
+	if !cmd.Flags().Changed("ldrom-offset") {
+		return td, nil
+	}
+
+	offset, _ := cmd.Flags().GetUint("ldrom-offset")
+	if offset >= td.ProgMemSize {
+		return nil, fmt.Errorf("LDROM offset 0x%04x outside program memory (0x%04x bytes)", offset, td.ProgMemSize)
+	}
+
+	ntd := *td
+	ntd.LDROMOffset = offset
+	return &ntd, nil
+}
+
+// Checks that an LDROM of the given size fits in program memory at the
+// target's LDROM offset
+func checkLDROMBounds(td *target.Definition, size int) error {
+	if td.LDROMOffset+uint(size) > td.ProgMemSize {
+		return fmt.Errorf("LDROM (%d bytes at 0x%04x) extends beyond program memory (0x%04x bytes)",
+			size, td.LDROMOffset, td.ProgMemSize)
+	}
+	return nil
+}
+
+// Limit (exclusive) of the addresses representable in programmer commands
+const maxProtocolAddress = 1 << 16
+
+// Checks that n bytes at address are addressable by the programmer,
+// returning the address narrowed to the protocol's 16-bit address field
+func protocolAddress(address uint32, n int) (uint16, error) {
+	if address >= maxProtocolAddress || uint64(address)+uint64(n) > maxProtocolAddress {
+		return 0, fmt.Errorf("Address range 0x%x+%d exceeds the programmer's 16-bit address space", address, n)
+	}
+	return uint16(address), nil
+}
+
+// Reads len(buf) bytes starting at address into buf, in pages. Each
+// failed page is retried up to retries times before giving up; the
+// read resumes from the failed page rather than restarting.
+//
+// Returns the number of retries performed
+func readRange(dev *protocol.Device, space protocol.MemorySpace, address uint32, buf []byte, pageSize, retries int) (int, error) {
+	return readRangeOrdered(dev, space, address, buf, pageSize, retries, orderSequential)
+}
+
+// Order in which pages are read
+type pageOrder string
+
+const (
+	orderSequential pageOrder = "sequential"
+	orderReverse    pageOrder = "reverse"
+	orderRandom     pageOrder = "random"
+)
+
+func parsePageOrder(s string) (pageOrder, error) {
+	switch o := pageOrder(s); o {
+	case orderSequential, orderReverse, orderRandom:
+		return o, nil
+	default:
+		return "", fmt.Errorf("'%s' not understood for order; expected sequential, reverse or random", s)
+	}
+}
+
+// Returns the offsets of each page of an n byte range in the given order
+func pageOffsets(n, pageSize int, order pageOrder) []int {
+	var offsets []int
+	for i := 0; i < n; i += pageSize {
+		offsets = append(offsets, i)
+	}
+
+	switch order {
+	case orderReverse:
+		for i, j := 0, len(offsets)-1; i < j; i, j = i+1, j-1 {
+			offsets[i], offsets[j] = offsets[j], offsets[i]
+		}
+	case orderRandom:
+		rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+		rng.Shuffle(len(offsets), func(i, j int) {
+			offsets[i], offsets[j] = offsets[j], offsets[i]
+		})
+	}
+	return offsets
+}
+
+// As readRange, but reading pages in the specified order
+func readRangeOrdered(dev *protocol.Device, space protocol.MemorySpace, address uint32, buf []byte, pageSize, retries int, order pageOrder) (int, error) {
+	return readRangeVisiting(dev, space, address, buf, pageSize, retries, order, nil)
+}
+
+// As readRangeOrdered, calling visit (if not nil) with the address and
+// contents of each page as it is read. An error from visit stops the read
+func readRangeVisiting(dev *protocol.Device, space protocol.MemorySpace, address uint32, buf []byte, pageSize, retries int, order pageOrder, visit func(address uint32, page []byte) error) (int, error) {
+	total := 0
+	for _, i := range pageOffsets(len(buf), pageSize, order) {
+		n := len(buf) - i
+		if n > pageSize {
+			n = pageSize
+		}
+
+		if n > math.MaxUint8 {
+			return total, fmt.Errorf("Page size %d exceeds the maximum read size of %d", n, math.MaxUint8)
+		}
+
+		addr, err := protocolAddress(address+uint32(i), n)
+		if err != nil {
+			return total, err
+		}
+
+		var data []byte
+		for attempt := 0; ; attempt++ {
+			data, err = dev.ReadMemory(space, addr, uint8(n))
+			if err == nil || attempt >= retries {
+				break
+			}
+
+			log.Printf("Read of %s 0x%04x failed (%s), retrying", space, addr, err)
+			total++
+		}
+
+		if err != nil {
+			return total, commsError{err}
+		}
+
+		copy(buf[i:i+n], data)
+		if visit != nil {
+			if err := visit(address+uint32(i), buf[i:i+n]); err != nil {
+				return total, err
+			}
+		}
+	}
+
+	return total, nil
+}
+
+// Writes buf starting at address, in pages
+func writeRange(dev *protocol.Device, space protocol.MemorySpace, address uint32, buf []byte, pageSize int) error {
+	for i := 0; i < len(buf); i += pageSize {
+		n := len(buf) - i
+		if n > pageSize {
+			n = pageSize
+		}
+
+		addr, err := protocolAddress(address+uint32(i), n)
+		if err != nil {
+			return err
+		}
+
+		if err := dev.WriteMemory(space, addr, buf[i:i+n]); err != nil {
+			return commsError{err}
+		}
+	}
+
+	return nil
+}
+
+// Writes buf starting at address, in pages, reading back and verifying
+// each page before moving on to the next. A page which fails to write
+// or verify is rewritten up to retries times. As flash bits can only be
+// cleared without an erase, this corrects failed or partial writes,
+// not corrupted ones.
+//
+// Returns the number of pages which required retries
+func writeRangeVerified(dev *protocol.Device, space protocol.MemorySpace, region string, address uint32, buf []byte, pageSize, retries int) (int, error) {
+	retried := 0
+	for i := 0; i < len(buf); i += pageSize {
+		n := len(buf) - i
+		if n > pageSize {
+			n = pageSize
+		}
+		addr, err := protocolAddress(address+uint32(i), n)
+		if err != nil {
+			return retried, err
+		}
+
+		for attempt := 0; ; attempt++ {
+			err = writeVerifyPage(dev, space, region, addr, buf[i:i+n])
+			if err == nil || attempt >= retries {
+				break
+			}
+
+			log.Printf("Write of %s 0x%04x failed (%s), retrying", space, addr, err)
+			if attempt == 0 {
+				retried++
+			}
+		}
+
+		if err != nil {
+			return retried, err
+		}
+	}
+
+	return retried, nil
+}
+
+func writeVerifyPage(dev *protocol.Device, space protocol.MemorySpace, region string, addr uint16, page []byte) error {
+	if err := dev.WriteMemory(space, addr, page); err != nil {
+		return commsError{err}
+	}
+
+	readback, err := dev.ReadMemory(space, addr, uint8(len(page)))
+	if err != nil {
+		return commsError{err}
+	}
+
+	return compareRegion(region, uint32(addr), page, readback)
+}
+
+// ReadImage reads the configuration, APROM and LDROM of the device
+func ReadImage(dev *protocol.Device, td *target.Definition) (*TargetData, error) {
+	d, _, err := readImage(dev, td, int(td.PageSize), 0, orderSequential)
+	return d, err
+}
+
+// Reads the device image, retrying failed reads; returns the total number
+// of retries required
+func readImage(dev *protocol.Device, td *target.Definition, pageSize, retries int, order pageOrder) (*TargetData, int, error) {
+	return readImageVisiting(dev, td, pageSize, retries, order, nil)
+}
+
+// Called with each part of the image as it is read: the configuration, then
+// each page of APROM and LDROM. region is "config", "APROM" or "LDROM".
+// An error stops the read
+type pageVisitor func(region string, address uint32, page []byte) error
+
+// As readImage, calling visit (if not nil) with each part of the image as
+// it is read
+func readImageVisiting(dev *protocol.Device, td *target.Definition, pageSize, retries int, order pageOrder, visit pageVisitor) (*TargetData, int, error) {
+	d := NewTargetData(td)
+
+	if td.Config.ReadSize != 0 {
+		bytes, err := dev.ReadMemory(protocol.ConfigSpace, 0, td.Config.ReadSize)
+		if err != nil {
+			return nil, 0, commsError{err}
+		}
+
+		d.Config = bytes
+		if visit != nil {
+			if err := visit("config", 0, bytes); err != nil {
+				return nil, 0, err
+			}
+		}
+	}
+
+	aprom, err := d.APROM()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ldrom, err := d.LDROM()
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := checkLDROMBounds(td, len(ldrom)); err != nil {
+		return nil, 0, err
+	}
+
+	apromRetries, err := readRangeVisiting(dev, protocol.ProgramSpace, 0, aprom, pageSize, retries, order, regionVisitor(visit, "APROM"))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ldromRetries, err := readRangeVisiting(dev, protocol.ProgramSpace, uint32(td.LDROMOffset), ldrom, pageSize, retries, order, regionVisitor(visit, "LDROM"))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return d, apromRetries + ldromRetries, nil
+}
+
+// Adapts visit to the callback of readRangeVisiting for the named region
+func regionVisitor(visit pageVisitor, region string) func(uint32, []byte) error {
+	if visit == nil {
+		return nil
+	}
+	return func(address uint32, page []byte) error {
+		return visit(region, address, page)
+	}
+}
+
+// Reads the device's contents and saves them to the named file. A locked
+// device cannot be read, so is skipped with a warning
+func backupDevice(dev *protocol.Device, td *target.Definition, name string, pageSize int) error {
+	cfg, err := dev.ReadMemory(protocol.ConfigSpace, 0, td.Config.ReadSize)
+	if err != nil {
+		return commsError{err}
+	}
+
+	if cfgo, err := td.Config.Decode(cfg); err == nil && cfgo.IsLocked() {
+		return warn("Device is locked; not backing up")
+	}
+
+	d, _, err := readImage(dev, td, pageSize, 3, orderSequential)
+	if err != nil {
+		return err
+	}
+
+	ws, err := openWrite(name)
+	if err != nil {
+		return err
+	}
+	return d.Write(ws)
+}
+
+// Approximate durations used for time estimates. These are assumptions
+// based on observed behaviour of a Nu-Link-Me, not measurements
+const (
+	estimatedEraseTime       = 500 * time.Millisecond
+	estimatedTransactionTime = 10 * time.Millisecond
+)
+
+// Number of transactions required to transfer n bytes in pages
+func pageCount(n, pageSize int) int {
+	return (n + pageSize - 1) / pageSize
+}
+
+// Returns the number of write transactions required to program data,
+// and the estimated total time (including verification if requested)
+func estimateProgramTime(data *TargetData, pageSize int, verify bool) (int, time.Duration, error) {
+	aprom, err := data.APROM()
+	if err != nil {
+		return 0, 0, err
+	}
+	ldrom, err := data.LDROM()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	writes := pageCount(len(aprom), pageSize) + pageCount(len(ldrom), pageSize)
+	if len(data.Config) != 0 {
+		writes++
+	}
+
+	transactions := writes
+	if verify {
+		transactions *= 2
+	}
+
+	return writes, estimatedEraseTime + time.Duration(transactions)*estimatedTransactionTime, nil
+}
@@ -0,0 +1,155 @@
+// Copyright © 2019 Erin Shepherd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/erincandescent/nuvoprog/protocol"
+	"github.com/erincandescent/nuvoprog/target"
+)
+
+// Returns a synthetic target like the N76E003 but with a 64KB program
+// space, so that program addresses span the protocol's 16-bit address field
+func target64K() *target.Definition {
+	td := *target.ByName("n76e003")
+	td.Name = "test64k"
+	td.ProgMemSize = 64 * 1024
+	td.LDROMOffset = 0xF000
+	return &td
+}
+
+func TestProtocolAddress(t *testing.T) {
+	cases := []struct {
+		address uint32
+		n       int
+		ok      bool
+	}{
+		{0x0000, 32, true},
+		{0xFFE0, 32, true},
+		{0xFFFF, 1, true},
+		{0xFFF0, 32, false},
+		{0x10000, 0, false},
+		{0x10000, 1, false},
+	}
+	for _, c := range cases {
+		addr, err := protocolAddress(c.address, c.n)
+		if c.ok && (err != nil || uint32(addr) != c.address) {
+			t.Errorf("protocolAddress(0x%x, %d) = 0x%04x, %v", c.address, c.n, addr, err)
+		} else if !c.ok && err == nil {
+			t.Errorf("protocolAddress(0x%x, %d) = 0x%04x; expected an error", c.address, c.n, addr)
+		}
+	}
+}
+
+func TestReadImage64K(t *testing.T) {
+	td := target64K()
+	dev, sim := simDevice(td)
+	mem := sim.Memory[protocol.ProgramSpace]
+	for i := range mem {
+		mem[i] = byte(i>>8) ^ byte(i)
+	}
+
+	d, _, err := readImage(dev, td, int(td.PageSize), 0, orderSequential)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(d.Data, mem) {
+		t.Error("Image differs from the device")
+	}
+
+	// Each page is read once; none wrap around to the start of the space
+	seen := map[uint16]bool{}
+	for _, r := range simRequests(sim, protocol.CmdReadMemory) {
+		if r.Space != protocol.ProgramSpace {
+			continue
+		} else if seen[r.Address] {
+			t.Errorf("Read 0x%04x more than once", r.Address)
+		}
+		seen[r.Address] = true
+	}
+	if !seen[0xFFE0] {
+		t.Error("Did not read the last page")
+	}
+}
+
+func TestReadRangeBeyond64K(t *testing.T) {
+	td := target64K()
+	dev, sim := simDevice(td)
+
+	buf := make([]byte, 64)
+	if _, err := readRange(dev, protocol.ProgramSpace, 0xFFE0, buf, 32, 0); err == nil {
+		t.Fatal("Read beyond 64KB succeeded")
+	}
+
+	for _, r := range simRequests(sim, protocol.CmdReadMemory) {
+		if r.Address < 0xFFE0 {
+			t.Errorf("Read wrapped around to 0x%04x", r.Address)
+		}
+	}
+}
+
+func TestShortConfigRead(t *testing.T) {
+	td := target.ByName("n76e003")
+	dev, sim := simDevice(td)
+	sim.ReadHook = func(space protocol.MemorySpace, addr uint16, data []byte) []byte {
+		if space == protocol.ConfigSpace {
+			return data[:td.Config.MinSize]
+		}
+		return data
+	}
+
+	if d, _, err := readImage(dev, td, int(td.PageSize), 0, orderSequential); err == nil {
+		t.Errorf("Short config read succeeded with config %X", d.Config)
+	}
+	if err := verifyConfig(dev, td, simImage(td, nil).Config); err == nil {
+		t.Error("Config verified against a short read")
+	}
+}
+
+func TestCheckPageSize(t *testing.T) {
+	for _, n := range []int{1, 16, 32, 255} {
+		if err := checkPageSize(n); err != nil {
+			t.Errorf("Page size %d: %v", n, err)
+		}
+	}
+	for _, n := range []int{-1, 0, 256} {
+		if checkPageSize(n) == nil {
+			t.Errorf("Page size %d accepted", n)
+		}
+	}
+}
+
+func TestWritePageSizeCheckedBeforeErase(t *testing.T) {
+	td := target.ByName("n76e003")
+	dev, sim := simDevice(td)
+
+	// V1 frames carry 62 bytes, less the 12 byte write header
+	if err := checkWritePageSize(dev, 50); err != nil {
+		t.Errorf("50 byte pages: %v", err)
+	}
+
+	_, err := programData(dev, td, simImage(td, []byte{0x02, 0x00, 0x06}), programOptions{
+		pageSize: 51,
+		order:    []programRegion{regionAPROM, regionLDROM, regionConfig},
+	})
+	if err == nil {
+		t.Fatal("Programmed with 51 byte pages")
+	}
+	if n := len(simRequests(sim, protocol.CmdEraseFlashChip)); n != 0 {
+		t.Errorf("Device erased despite an invalid page size")
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright © 2019 Erin Shepherd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+// Result of a command run with --json. Every such command prints exactly
+// one result to stdout, whether it succeeds or fails
+type jsonResult struct {
+	// One of ok, mismatch or error
+	Status string `json:"status"`
+	// Error message, if Status is not ok
+	Error string `json:"error,omitempty"`
+	// Command specific result
+	Data interface{} `json:"data,omitempty"`
+}
+
+// Adds the --json flag to cmd
+func addJSONFlag(cmd *cobra.Command) {
+	cmd.Flags().Bool("json", false, "Print the result as JSON")
+}
+
+// Prints data and err as a jsonResult. A non-nil err is returned marked as
+// reported, so that it is not printed again
+func reportJSON(data interface{}, err error) error {
+	res := jsonResult{Status: "ok", Data: data}
+	if err != nil {
+		res.Status = "error"
+		if exitCode(err) == exitMismatch {
+			res.Status = "mismatch"
+		}
+		res.Error = err.Error()
+	}
+
+	buf, merr := json.MarshalIndent(res, "", "    ")
+	if merr != nil {
+		if err == nil {
+			err = merr
+		}
+		return err
+	}
+
+	fmt.Println(string(buf))
+	if err != nil {
+		return reportedError{err}
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+// Copyright © 2019 Erin Shepherd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/erincandescent/nuvoprog/protocol"
+	"github.com/erincandescent/nuvoprog/target"
+	"github.com/spf13/cobra"
+)
+
+// probeCmd represents the probe command
+var probeCmd = &cobra.Command{
+	Use:   "probe",
+	Short: "Identify the connected target device",
+	Long: `Connects to the target device and prints its chip family and device ID,
+without requiring the device to be supported. This is useful when adding
+support for new devices`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		res, err := runProbe(cmd)
+		if jsonOut, _ := cmd.Flags().GetBool("json"); jsonOut {
+			if err != nil {
+				return reportJSON(nil, err)
+			}
+			return reportJSON(res, nil)
+		} else if err != nil {
+			return err
+		}
+
+		fmt.Printf("Chip family: 0x%08x\n", res.Family)
+		fmt.Printf("Device ID:   0x%08x\n", res.DeviceID)
+		if res.Target != "" {
+			fmt.Printf("Target:      %s\n", res.Target)
+		} else {
+			fmt.Println("Target:      unsupported")
+		}
+		return nil
+	},
+}
+
+// Identity of a connected target, as printed by probe --json
+type probeResult struct {
+	Family   uint32 `json:"family"`
+	DeviceID uint32 `json:"device_id"`
+	Target   string `json:"target,omitempty"`
+}
+
+func runProbe(cmd *cobra.Command) (*probeResult, error) {
+	family, _ := cmd.Flags().GetUint32("family")
+
+	dev, err := openProgrammer()
+	if err != nil {
+		return nil, err
+	}
+	defer resetAndCloseDevice(dev)
+
+	clock := icpClock
+	if clock == 0 {
+		clock = target.DefaultClock
+	}
+
+	if err := enterICPMode(dev, protocol.ChipFamily(family), clock); err != nil {
+		return nil, err
+	}
+
+	devID, err := dev.CheckID()
+	if err != nil {
+		return nil, err
+	}
+
+	res := &probeResult{Family: family, DeviceID: uint32(devID)}
+	if td := target.ByID(protocol.ChipFamily(family), devID); td != nil {
+		res.Target = td.Name
+	}
+	return res, nil
+}
+
+func init() {
+	rootCmd.AddCommand(probeCmd)
+	addJSONFlag(probeCmd)
+	probeCmd.Flags().Uint32("family", protocol.ChipFamily1T8051, "Chip family to configure the programmer for")
+}
@@ -15,7 +15,16 @@
 package cmd
 
 import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
 	"github.com/erincandescent/nuvoprog/protocol"
+	"github.com/erincandescent/nuvoprog/target"
+	"github.com/fatih/color"
 	"github.com/spf13/cobra"
 )
 
@@ -23,68 +32,550 @@ import (
 var programCmd = &cobra.Command{
 	Use:   "program",
 	Short: "Program a target device",
-	Long:  `Program a target device`,
+	Long: `Program a target device
+
+Flash is erased, then APROM, LDROM and the configuration are written in the
+order given by --program-order. Each region is verified as soon as it has been
+written (unless --verify=false); the configuration is always verified.
+
+The default order, aprom,ldrom,config, writes the configuration last, so that
+lock bits do not take effect until programming is complete. This suits most
+uses. Where a bootloader in LDROM must never start stale application code,
+ldrom,aprom,config writes the bootloader first. Writing config before program
+data is only useful if the configuration does not lock the device; a locked
+device cannot be verified.
+
+Inputs may be Intel Hex, S-records or raw binary. Raw binaries are loaded at
+--bin-offset from the start of their region (program memory for --image,
+APROM for --aprom and LDROM for --ldrom).
+
+The configuration is taken from --config if given, or otherwise from the
+image. Fields given with --set are then applied on top; if there is no
+other configuration, they are applied to the target's default configuration.
+Configuration in --aprom or --ldrom files is ignored, with a warning if it
+differs.
+
+With --skip-erase, the chip erase is omitted; this is only safe on a blank
+device, so verification is always performed.
+
+Some boards need time to settle after the chip erase; if the first page
+written intermittently fails to verify, try a --post-erase-delay such as 50ms.
+
+With --audit-log, a record of the erase and of each page written and verified
+(address, data and result) is appended to the given file as one JSON object
+per line. Each line is synced to disk as it is written, so an interrupted run
+still leaves a partial record; a completed run ends with a "done" entry. This
+slows programming, so is intended for production lines which need an audit
+trail.
+
+With --all, the target attached to every connected programmer is programmed
+with the same image, at most --concurrency devices at a time. The result for
+each device is reported as it completes, and the command fails if any device
+failed. --all cannot be combined with --device, --backup or --serial.
+
+With --serial AUTO, the next number from --serial-counter is written at
+--serial-addr. It is only recorded as allocated once the device has been
+programmed (and verified, if requested), so a failed run reuses it; the
+counter is locked meanwhile, so concurrent runs wait for each other.
+
+With --space, the image (addressed from the start of the space) is instead
+written to another of the target's memory spaces, as listed by 'target
+describe', and verified. The space is not erased first. Configuration must be
+programmed with --config or --set, and options specific to program memory
+(such as --skip-erase or --audit-log) are rejected.
+
+When verifying, exits with status 2 if the device contents do not match,
+or 3 if communication with the programmer or target failed`,
 	RunE: func(cmd *cobra.Command, args []string) error {
-		dev, td, err := connectToTarget()
+		// Load the image before connecting, so that the target is not held
+		// in ICP mode while (e.g.) waiting for an image on stdin
+		td, err := lookupTarget()
+		if err != nil {
+			return err
+		}
+
+		signature, _ := cmd.Flags().GetString("signature")
+		pubkey, _ := cmd.Flags().GetString("pubkey")
+		if (signature == "") != (pubkey == "") {
+			return errors.New("Both signature and public key must be specified")
+		}
+
+		space, err := selectedSpace(cmd, td)
+		if err != nil {
+			return err
+		} else if space.Space != protocol.ProgramSpace {
+			return programSpace(cmd, td, space, signature, pubkey)
+		}
+
+		td, err = withLDROMOffset(cmd, td)
+		if err != nil {
+			return err
+		}
+
+		orderS, _ := cmd.Flags().GetString("program-order")
+		order, err := parseProgramOrder(orderS)
 		if err != nil {
 			return err
 		}
-		defer resetAndCloseDevice(dev)
 
 		config, _ := cmd.Flags().GetString("config")
+		sets, _ := cmd.Flags().GetStringArray("set")
 		image, _ := cmd.Flags().GetString("image")
 		aprom, _ := cmd.Flags().GetString("aprom")
 		ldrom, _ := cmd.Flags().GetString("ldrom")
-		data, err := ReadTargetData(config, image, aprom, ldrom, td, true)
+		var readOpts readOptions
+		readOpts.binOffset, _ = cmd.Flags().GetUint32("bin-offset")
+		readOpts.rejectOverlaps, _ = cmd.Flags().GetBool("reject-overlaps")
+		data, err := readTargetData(config, sets, image, aprom, ldrom, td, true, readOpts)
 		if err != nil {
 			return err
 		}
 
-		if err := dev.EraseFlashChip(); err != nil {
-			return err
+		if signature != "" {
+			if err := verifySignature(data, signature, pubkey); err != nil {
+				return err
+			}
 		}
 
-		if len(data.Config) != 0 {
-			for len(data.Config) < int(td.Config.WriteSize) {
-				data.Config = append(data.Config, 0xFF)
+		verify, _ := cmd.Flags().GetBool("verify")
+		skipErase, _ := cmd.Flags().GetBool("skip-erase")
+		if skipErase {
+			if err := warn("Skipping erase; programming will fail verification if the device is not blank"); err != nil {
+				return err
 			}
+			verify = true
+		}
 
-			if err := dev.WriteMemory(protocol.ConfigSpace, 0, data.Config[:td.Config.WriteSize]); err != nil {
+		eachPage, _ := cmd.Flags().GetBool("verify-each-page")
+		postEraseDelay, _ := cmd.Flags().GetDuration("post-erase-delay")
+		if postEraseDelay < 0 {
+			return errors.New("Post erase delay must not be negative")
+		}
+
+		pgSize, err := pageSize(cmd, td)
+		if err != nil {
+			return err
+		}
+
+		opts := programOptions{
+			pageSize:       pgSize,
+			verify:         verify,
+			eachPage:       eachPage,
+			skipErase:      skipErase,
+			postEraseDelay: postEraseDelay,
+			order:          order,
+		}
+
+		if path, _ := cmd.Flags().GetString("audit-log"); path != "" {
+			opts.audit, err = openAuditLog(path)
+			if err != nil {
 				return err
 			}
+			defer opts.audit.Close()
 		}
 
-		apromB, err := data.APROM()
+		writes, estimate, err := estimateProgramTime(data, opts.pageSize, verify || eachPage)
 		if err != nil {
 			return err
 		}
-		ldromB, err := data.LDROM()
+		if skipErase {
+			estimate -= estimatedEraseTime
+		} else {
+			estimate += postEraseDelay
+		}
+
+		if all, _ := cmd.Flags().GetBool("all"); all {
+			concurrency, _ := cmd.Flags().GetInt("concurrency")
+			for _, flag := range []string{"backup", "serial"} {
+				if cmd.Flags().Changed(flag) {
+					return fmt.Errorf("--%s cannot be used with --all", flag)
+				}
+			}
+
+			fmt.Fprintf(os.Stderr, "Programming each device: ~%d writes, estimated %s\n", writes, estimate.Round(time.Second))
+			if err := programAll(td, data, opts, concurrency); err != nil {
+				return err
+			}
+			return printChecksum(data, opts.verify || opts.eachPage)
+		}
+
+		dev, _, err := connectToTarget()
 		if err != nil {
 			return err
 		}
+		defer resetAndCloseDevice(dev)
 
-		for i := 0; i < len(apromB); i += 32 {
-			if err := dev.WriteMemory(protocol.ProgramSpace, uint16(i), apromB[i:i+32]); err != nil {
+		if backup, _ := cmd.Flags().GetString("backup"); backup != "" {
+			// Abort if the backup fails; nothing has been modified yet
+			if err := backupDevice(dev, td, backup, opts.pageSize); err != nil {
 				return err
 			}
 		}
 
-		for i := 0; i < len(ldromB); i += 32 {
-			offs := uint16(td.LDROMOffset) + uint16(i)
-			if err := dev.WriteMemory(protocol.ProgramSpace, offs, ldromB[i:i+32]); err != nil {
+		var reservation *serialReservation
+		defer func() { reservation.release() }()
+		if serial, _ := cmd.Flags().GetString("serial"); serial != "" {
+			if !cmd.Flags().Changed("serial-addr") {
+				return errors.New("--serial requires --serial-addr")
+			}
+			addr, _ := cmd.Flags().GetUint("serial-addr")
+			counter, _ := cmd.Flags().GetString("serial-counter")
+			size, _ := cmd.Flags().GetInt("serial-size")
+
+			buf, r, err := serialBytes(serial, counter, size)
+			if err != nil {
+				return err
+			}
+			reservation = r
+
+			if err := data.patchSerial(addr, buf); err != nil {
 				return err
 			}
+			fmt.Fprintf(os.Stderr, "Serial: %X\n", buf)
 		}
 
-		return nil
+		fmt.Fprintf(os.Stderr, "Programming: ~%d writes, estimated %s\n", writes, estimate.Round(time.Second))
+		retried, err := programData(dev, td, data, opts)
+		if err != nil {
+			return err
+		}
+
+		if reservation != nil {
+			if err := reservation.commit(); err != nil {
+				return fmt.Errorf("Recording serial number in %s: %v", reservation.counter, err)
+			}
+		}
+
+		if retried > 0 {
+			fmt.Fprintf(os.Stderr, "%d pages were retried\n", retried)
+		}
+		return printChecksum(data, opts.verify || opts.eachPage)
 	},
 }
 
+// Prints the checksum of the programmed data. The programmer has no
+// checksum command, so this is computed from the image; it only describes
+// the device contents if they were verified by reading them back. It can
+// later be checked with verify --checksum
+func printChecksum(data *TargetData, verified bool) error {
+	checksum, err := data.Checksum(checksumAll)
+	if err != nil {
+		return err
+	}
+
+	if verified {
+		fmt.Fprintf(os.Stderr, "CRC32: %08x (verified by read back)\n", checksum)
+	} else {
+		fmt.Fprintf(os.Stderr, "CRC32: %08x (image; device not verified)\n", checksum)
+	}
+	return nil
+}
+
+// Programs the target attached to every connected programmer with data,
+// programming at most concurrency devices at once
+func programAll(td *target.Definition, data *TargetData, opts programOptions, concurrency int) error {
+	if concurrency < 1 {
+		return errors.New("Concurrency must be at least 1")
+	} else if devicePath != "" || recordFile != "" {
+		return errors.New("--device and --record cannot be used with --all")
+	}
+
+	clock, err := targetClock(td)
+	if err != nil {
+		return err
+	}
+
+	devs, err := protocol.Connect()
+	if err != nil {
+		return commsError{err}
+	} else if len(devs) == 0 {
+		return errors.New("No programmer found")
+	}
+
+	type result struct {
+		path string
+		err  error
+	}
+
+	jobs := make(chan *protocol.Device)
+	results := make(chan result)
+	for i := 0; i < concurrency; i++ {
+		go func() {
+			for dev := range jobs {
+				results <- result{dev.Path(), programDevice(dev, td, clock, data, opts)}
+			}
+		}()
+	}
+
+	go func() {
+		for _, dev := range devs {
+			jobs <- dev
+		}
+		close(jobs)
+	}()
+
+	failed := 0
+	for i := range devs {
+		r := <-results
+		if r.err != nil {
+			failed++
+			color.Red("[%d/%d] %s: %v", i+1, len(devs), r.path, r.err)
+		} else {
+			color.Green("[%d/%d] %s: OK", i+1, len(devs), r.path)
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d devices failed", failed, len(devs))
+	}
+	return nil
+}
+
+// Connects to the target attached to dev and programs it, closing dev
+func programDevice(dev *protocol.Device, td *target.Definition, clock uint32, data *TargetData, opts programOptions) error {
+	if err := checkProgrammer(dev); err != nil {
+		dev.Close()
+		return err
+	}
+	defer resetAndCloseDevice(dev)
+
+	if err := attachTarget(dev, td, clock); err != nil {
+		return err
+	}
+
+	_, err := programData(dev, td, data, opts)
+	return err
+}
+
+// Options controlling programData
+type programOptions struct {
+	pageSize int
+	// Verify each region after writing it
+	verify bool
+	// Verify (and retry) each page as it is written
+	eachPage bool
+	// Skip the chip erase; only safe on a blank device
+	skipErase bool
+	// Time to wait after the erase before writing
+	postEraseDelay time.Duration
+	// Order in which to write regions
+	order []programRegion
+	// Audit log of each page written and verified (may be nil)
+	audit *auditLog
+}
+
+// ProgramData erases the device and programs it with data, verifying
+// each region after writing it. The configuration is written last
+func ProgramData(dev *protocol.Device, td *target.Definition, data *TargetData) error {
+	_, err := programData(dev, td, data, programOptions{
+		pageSize: int(td.PageSize),
+		verify:   true,
+		order:    []programRegion{regionAPROM, regionLDROM, regionConfig},
+	})
+	return err
+}
+
+// Programs the device with data; returns the number of pages which
+// required retries
+func programData(dev *protocol.Device, td *target.Definition, data *TargetData, opts programOptions) (int, error) {
+	if err := opts.audit.logStart(dev.Path(), data); err != nil {
+		return 0, err
+	}
+
+	retried, err := writeRegions(dev, td, data, opts)
+	if lerr := opts.audit.logDone(dev.Path(), err); err == nil {
+		err = lerr
+	}
+	return retried, err
+}
+
+func writeRegions(dev *protocol.Device, td *target.Definition, data *TargetData, opts programOptions) (int, error) {
+	// Check before erasing, rather than leave the device blank
+	if err := checkWritePageSize(dev, opts.pageSize); err != nil {
+		return 0, err
+	}
+
+	if !opts.skipErase {
+		err := dev.EraseFlashChip()
+		if lerr := opts.audit.log(auditEntry{Device: dev.Path(), Event: auditErase}, err); lerr != nil {
+			return 0, lerr
+		} else if err != nil {
+			return 0, commsError{err}
+		}
+
+		if opts.postEraseDelay > 0 {
+			log.Printf("Waiting %s after erase", opts.postEraseDelay)
+			time.Sleep(opts.postEraseDelay)
+		}
+	}
+
+	apromB, err := data.APROM()
+	if err != nil {
+		return 0, err
+	}
+	ldromB, err := data.LDROM()
+	if err != nil {
+		return 0, err
+	}
+	if err := checkLDROMBounds(td, len(ldromB)); err != nil {
+		return 0, err
+	}
+
+	retried := 0
+	for _, region := range opts.order {
+		var address uint32
+		var buf []byte
+		switch region {
+		case regionAPROM:
+			address, buf = 0, apromB
+		case regionLDROM:
+			address, buf = uint32(td.LDROMOffset), ldromB
+		case regionConfig:
+			if err := writeConfig(dev, data, opts.audit); err != nil {
+				return retried, err
+			}
+			continue
+		}
+
+		// Pages are written individually so that each can be audited
+		for i := 0; i < len(buf); i += opts.pageSize {
+			page := buf[i:]
+			if len(page) > opts.pageSize {
+				page = page[:opts.pageSize]
+			}
+			addr := address + uint32(i)
+
+			if opts.eachPage {
+				var n int
+				n, err = writeRangeVerified(dev, protocol.ProgramSpace, string(region), addr, page, opts.pageSize, 3)
+				retried += n
+			} else {
+				err = writeRange(dev, protocol.ProgramSpace, addr, page, opts.pageSize)
+			}
+
+			if lerr := opts.audit.logPage(dev.Path(), auditWrite, string(region), addr, page, err); lerr != nil {
+				return retried, lerr
+			} else if err != nil {
+				return retried, err
+			}
+		}
+
+		if !opts.verify {
+			continue
+		}
+
+		for i := 0; i < len(buf); i += opts.pageSize {
+			page := buf[i:]
+			if len(page) > opts.pageSize {
+				page = page[:opts.pageSize]
+			}
+			addr := address + uint32(i)
+
+			err := verifyRange(dev, string(region), addr, page, opts.pageSize, 3, nil)
+			if lerr := opts.audit.logPage(dev.Path(), auditVerify, string(region), addr, page, err); lerr != nil {
+				return retried, lerr
+			} else if err != nil {
+				return retried, err
+			}
+		}
+	}
+	return retried, nil
+}
+
+// Regions which may be named in --program-order
+type programRegion string
+
+const (
+	regionAPROM  programRegion = "APROM"
+	regionLDROM  programRegion = "LDROM"
+	regionConfig programRegion = "config"
+)
+
+// Parses a comma separated --program-order, which must name each of
+// config, aprom and ldrom exactly once
+func parseProgramOrder(s string) ([]programRegion, error) {
+	var order []programRegion
+	seen := make(map[programRegion]bool)
+	for _, name := range strings.Split(s, ",") {
+		var region programRegion
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "aprom":
+			region = regionAPROM
+		case "ldrom":
+			region = regionLDROM
+		case "config":
+			region = regionConfig
+		default:
+			return nil, fmt.Errorf("'%s' not understood in program order; expected config, aprom or ldrom", name)
+		}
+
+		if seen[region] {
+			return nil, fmt.Errorf("Program order names %s more than once", name)
+		}
+		seen[region] = true
+		order = append(order, region)
+	}
+
+	if len(order) != 3 {
+		return nil, errors.New("Program order must name each of config, aprom and ldrom")
+	}
+	return order, nil
+}
+
+// Writes and verifies the configuration. A bad configuration can leave the
+// device unusable, so it is checked even without --verify
+func writeConfig(dev *protocol.Device, data *TargetData, audit *auditLog) error {
+	td := data.TargetDefinition
+	if len(data.Config) == 0 {
+		return nil
+	}
+
+	// Pad a copy, as data may be shared (e.g. by programAll)
+	cfg := make([]byte, td.Config.WriteSize)
+	for i := copy(cfg, data.Config); i < len(cfg); i++ {
+		cfg[i] = 0xFF
+	}
+
+	err := dev.WriteMemory(protocol.ConfigSpace, 0, cfg)
+	if lerr := audit.logPage(dev.Path(), auditWrite, string(regionConfig), 0, cfg, err); lerr != nil {
+		return lerr
+	} else if err != nil {
+		return commsError{err}
+	}
+
+	err = verifyConfig(dev, td, cfg)
+	if lerr := audit.logPage(dev.Path(), auditVerify, string(regionConfig), 0, cfg, err); lerr != nil {
+		return lerr
+	}
+	return err
+}
+
 func init() {
 	rootCmd.AddCommand(programCmd)
+	programCmd.Flags().Uint("ldrom-offset", 0, "Override the target's LDROM address (experimental)")
+	programCmd.Flags().MarkHidden("ldrom-offset")
 	programCmd.Flags().StringP("image", "i", "", "Image file, e.g. image.ihx")
 	programCmd.Flags().StringP("config", "c", "", "Configuration, e.g. 6FFBFFFF or @config.json")
+	programCmd.Flags().StringArray("set", nil, "Set a configuration field, e.g. wdt=disabled (repeatable)")
 	programCmd.Flags().StringP("aprom", "a", "", "APROM file e.g. aprom.ihx")
 	programCmd.Flags().StringP("ldrom", "l", "", "LDROM file e.g. ldrom.ihx")
 	programCmd.Flags().BoolP("verify", "V", true, "Verify memory contents")
+	programCmd.Flags().Bool("verify-each-page", false, "Read back and verify each page as it is written, retrying failed pages")
+	programCmd.Flags().String("program-order", "aprom,ldrom,config", "Order in which to write regions")
+	programCmd.Flags().Bool("skip-erase", false, "Don't erase before programming (the device must be blank; implies --verify)")
+	programCmd.Flags().Int("page-size", 0, "Override the target's write page size")
+	programCmd.Flags().String("serial", "", "Serial number to write: hex bytes, or AUTO to allocate from --serial-counter")
+	programCmd.Flags().Uint("serial-addr", 0, "APROM address at which to write the serial number")
+	programCmd.Flags().Int("serial-size", 4, "Size in bytes of AUTO serial numbers (written big-endian)")
+	programCmd.Flags().String("serial-counter", "nuvoprog-serial.txt", "File holding the last AUTO serial number allocated")
+	programCmd.Flags().Bool("all", false, "Program the targets of all connected programmers")
+	programCmd.Flags().Int("concurrency", 4, "With --all, the maximum number of devices to program at once")
+	programCmd.Flags().Bool("reject-overlaps", false, "Reject inputs which write differing values to the same address")
+	programCmd.Flags().Uint32("bin-offset", 0, "Offset from the start of their region at which to load raw binary inputs")
+	programCmd.Flags().String("space", "program", "Memory space to program (see target describe)")
+	programCmd.Flags().Duration("post-erase-delay", 0, "Time to wait after erasing before writing, e.g. 50ms")
+	programCmd.Flags().String("audit-log", "", "Append a JSON line describing each page written and verified to this file")
+	programCmd.Flags().String("backup", "", "Save the device's contents to this file before erasing it")
+	programCmd.Flags().String("signature", "", "Ed25519 signature over the image (raw or base64)")
+	programCmd.Flags().String("pubkey", "", "PEM encoded Ed25519 public key used to check --signature")
 }
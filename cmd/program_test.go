@@ -0,0 +1,106 @@
+// Copyright © 2019 Erin Shepherd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/erincandescent/nuvoprog/protocol"
+	"github.com/erincandescent/nuvoprog/target"
+)
+
+// Returns a ReadHook which clears bit in the first byte of config reads,
+// as if the configuration had not been written as requested
+func corruptConfig(bit byte) func(protocol.MemorySpace, uint16, []byte) []byte {
+	return func(space protocol.MemorySpace, addr uint16, data []byte) []byte {
+		if space == protocol.ConfigSpace && addr == 0 && len(data) != 0 {
+			data[0] &^= bit
+		}
+		return data
+	}
+}
+
+func TestWriteConfigVerified(t *testing.T) {
+	td := target.ByName("n76e003")
+	data := simImage(td, nil)
+	data.Config[0] = 0x7F
+
+	dev, sim := simDevice(td)
+	if err := writeConfig(dev, data, nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(simRequests(sim, protocol.CmdReadMemory)); n != 1 {
+		t.Errorf("Config read back %d times, expected once", n)
+	}
+
+	dev, sim = simDevice(td)
+	sim.ReadHook = corruptConfig(0x02)
+	err := writeConfig(dev, data, nil)
+	if e, ok := err.(*mismatchError); !ok || e.Region != "config" || e.Address != 0 {
+		t.Errorf("Expected config mismatch at 0x0000, got %v", err)
+	}
+}
+
+func TestConfigVerifiedWithoutVerify(t *testing.T) {
+	td := target.ByName("n76e003")
+	dev, sim := simDevice(td)
+	sim.ReadHook = corruptConfig(0x02)
+
+	_, err := programData(dev, td, simImage(td, []byte{0x02, 0x00, 0x06}), programOptions{
+		pageSize: int(td.PageSize),
+		order:    []programRegion{regionAPROM, regionLDROM, regionConfig},
+	})
+	if _, ok := err.(*mismatchError); !ok {
+		t.Errorf("Expected config mismatch, got %v", err)
+	}
+}
+
+func TestConfigWrittenLast(t *testing.T) {
+	td := target.ByName("n76e003")
+	dev, sim := simDevice(td)
+	data := simImage(td, bytes.Repeat([]byte{0x5A}, 100))
+	data.Config[0] = 0x7D // Locked
+
+	if err := ProgramData(dev, td, data); err != nil {
+		t.Fatal(err)
+	}
+
+	writes := simRequests(sim, protocol.CmdWriteMemory)
+	if len(writes) < 2 {
+		t.Fatalf("Only %d writes", len(writes))
+	}
+	for i, w := range writes {
+		if last := i == len(writes)-1; last != (w.Space == protocol.ConfigSpace) {
+			t.Errorf("Write %d of %d is to %s", i+1, len(writes), w.Space)
+		}
+	}
+
+	// Program data is verified before the configuration is written
+	var lastRead, configWrite int
+	for i, r := range sim.Requests {
+		switch {
+		case r.Command == protocol.CmdReadMemory && r.Space == protocol.ProgramSpace:
+			lastRead = i
+		case r.Command == protocol.CmdWriteMemory && r.Space == protocol.ConfigSpace:
+			configWrite = i
+		}
+	}
+	if lastRead == 0 {
+		t.Error("Program data was not read back")
+	} else if lastRead > configWrite {
+		t.Error("Program data was read back after the configuration was written")
+	}
+}
@@ -15,6 +15,11 @@
 package cmd
 
 import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/erincandescent/nuvoprog/ihex"
 	"github.com/erincandescent/nuvoprog/protocol"
 	"github.com/spf13/cobra"
 )
@@ -23,66 +28,170 @@ import (
 var readCmd = &cobra.Command{
 	Use:   "read [outfile.ihx]",
 	Short: "Read device flash contents",
-	Long:  `Read out the contents of the device's flash`,
-	Args:  cobra.ExactArgs(1),
+	Long: `Read out the contents of the device's flash
+
+Instead of an output filename, --output-template may be given. It may contain
+the placeholders {serial} (the programmer's serial number), {target},
+{date} and {time}
+
+The output is written as Motorola S-records if its name ends in .srec, .s19,
+.s28, .s37 or .mot, as raw binary if it ends in .bin, and otherwise as Intel
+Hex. Raw binary output contains program memory (APROM then LDROM, with 0xFF
+for unprogrammed bytes) but not the configuration. --compact and --trailer
+only apply to Intel Hex output
+
+With --mapfile, a listing of the populated ranges of program memory and of
+the target's interrupt vectors is also written, for use with a disassembler.
+The full vector table is listed for the N76E003; for other targets only the
+standard 8052 vectors (reset to timer2) are listed.
+
+With --space, another of the target's memory spaces (as listed by 'target
+describe') is read instead, and written addressed from the start of the space`,
+	Args: cobra.MaximumNArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) (err error) {
-		dev, td, err := connectToTarget()
+		outDir, _ := cmd.Flags().GetString("output-dir")
+		outTemplate, _ := cmd.Flags().GetString("output-template")
+		switch {
+		case len(args) == 0 && outTemplate == "":
+			return errors.New("No output file specified")
+		case len(args) != 0 && outTemplate != "":
+			return errors.New("Specify either an output file or --output-template, not both")
+		}
+
+		vars := templateVars(targetName)
+		vars["serial"] = ""
+		if _, err := expandTemplate(outTemplate, vars); err != nil {
+			return err
+		}
+
+		recLen, err := recordLength(cmd)
 		if err != nil {
 			return err
 		}
-		defer resetAndCloseDevice(dev)
 
-		d := NewTargetData(td)
+		retries, err := retryCount(cmd)
+		if err != nil {
+			return err
+		}
 
-		if td.Config.ReadSize != 0 {
-			bytes, err := dev.ReadMemory(protocol.ConfigSpace, 0, td.Config.ReadSize)
-			if err != nil {
-				return err
-			}
+		td, err := lookupTarget()
+		if err != nil {
+			return err
+		}
 
-			d.Config = bytes
+		space, err := selectedSpace(cmd, td)
+		if err != nil {
+			return err
+		} else if space.Space != protocol.ProgramSpace && cmd.Flags().Changed("mapfile") {
+			return fmt.Errorf("--mapfile cannot be used with --space %s", space.Name)
 		}
 
-		aprom, err := d.APROM()
+		pgSize, err := pageSize(cmd, td)
 		if err != nil {
-			return nil
+			return err
+		} else if recLen == 0 {
+			recLen = pgSize
 		}
 
-		ldrom, err := d.LDROM()
+		dev, td, err := connectToTarget()
 		if err != nil {
-			return nil
+			return err
 		}
+		defer resetAndCloseDevice(dev)
 
-		for i := 0; i < len(aprom); i += 32 {
-			data, err := dev.ReadMemory(protocol.ProgramSpace, uint16(i), 32)
-			if err != nil {
-				return err
-			}
+		td, err = withLDROMOffset(cmd, td)
+		if err != nil {
+			return err
+		}
 
-			copy(aprom[i:], data)
+		orderName, _ := cmd.Flags().GetString("order")
+		order, err := parsePageOrder(orderName)
+		if err != nil {
+			return err
 		}
 
-		for i := 0; i < len(ldrom); i += 32 {
-			data, err := dev.ReadMemory(protocol.ProgramSpace, uint16(i+int(td.LDROMOffset)), 32)
+		var d *TargetData
+		var spaceData []byte
+		var n int
+		if space.Space == protocol.ProgramSpace {
+			d, n, err = readImage(dev, td, pgSize, retries, order)
+		} else {
+			spaceData, n, err = readSpace(dev, space, pgSize, retries, order)
+		}
+		if err != nil {
+			return err
+		}
+
+		if n > 0 {
+			fmt.Fprintf(os.Stderr, "Read completed after %d retries\n", n)
+		}
+
+		if mapfile, _ := cmd.Flags().GetString("mapfile"); mapfile != "" {
+			ws, err := openWrite(mapfile)
 			if err != nil {
 				return err
 			}
 
-			copy(ldrom[i:], data)
+			if err := d.WriteMap(ws); err != nil {
+				return err
+			}
+		}
+
+		vars["serial"] = dev.Serial()
+		name := ""
+		if len(args) != 0 {
+			name = args[0]
+		}
+		name, err = outputName(outDir, outTemplate, name, vars)
+		if err != nil {
+			return err
 		}
 
-		w, err := openWrite(args[0])
+		ws, err := openWrite(name)
 		if err != nil {
 			return err
 		}
-		d.Write(w)
 
-		return nil
+		format := formatForName(name)
+		if d != nil && format == formatBinary {
+			return writeBinBlock(ws, d.Data)
+		}
+
+		var w blockWriter
+		if format == formatIHex {
+			hw := ihex.NewWriter(ws)
+			hw.Trailer, _ = cmd.Flags().GetBool("trailer")
+			hw.SkipFill, _ = cmd.Flags().GetBool("compact")
+			hw.RecordLength = recLen
+			w = hw
+		} else {
+			w = newBlockWriter(format, ws, 0)
+		}
+
+		if d == nil {
+			if err := w.Write(0, spaceData); err != nil {
+				return err
+			}
+			return w.Close()
+		}
+		return d.writeBlocks(w)
 	},
 }
 
 func init() {
 	rootCmd.AddCommand(readCmd)
+	readCmd.Flags().Uint("ldrom-offset", 0, "Override the target's LDROM address (experimental)")
+	readCmd.Flags().MarkHidden("ldrom-offset")
+	readCmd.Flags().Int("page-size", 0, "Override the target's read page size")
+	readCmd.Flags().Int("retries", 3, "Number of times to retry each failed read")
+	readCmd.Flags().String("order", "sequential", "Order in which to read pages: sequential, reverse or random")
+	readCmd.Flags().String("space", "program", "Memory space to read (see target describe)")
+	readCmd.Flags().Int("record-length", 0, "Maximum length of Intel Hex data records, e.g. 16 (defaults to the page size)")
+	readCmd.Flags().Bool("compact", false, "Omit records containing only erased (0xFF) bytes")
+	readCmd.Flags().String("output-template", "", "Output filename template, e.g. {serial}-{date}.ihx")
+	readCmd.Flags().String("output-dir", "", "Directory in which to write the output file")
+	readCmd.Flags().String("mapfile", "", "Also write a listing of populated regions and vectors to this file")
+	readCmd.Flags().Bool("trailer", false, "Append a length/CRC trailer so truncated files can be detected")
 
 	// Here you will define your flags and configuration settings.
 
@@ -20,14 +20,67 @@ import (
 	"log"
 	"os"
 
+	"github.com/erincandescent/nuvoprog/protocol"
+	"github.com/fatih/color"
 	"github.com/spf13/cobra"
 
 	_ "github.com/erincandescent/nuvoprog/target/all"
 )
 
 var cfgFile string
-var verbose bool
+var verbose int
 var targetName string
+var recordFile string
+var icpClock uint32
+var minFirmware uint32
+var devicePath string
+var noColor bool
+var connectRetries int
+var strict bool
+var assumeTargetPresent bool
+
+// Wraps errors which the command has already reported to the user
+// (e.g. in structured form)
+type reportedError struct {
+	error
+}
+
+// Prints a warning to stderr. With --strict, the warning is instead
+// returned as an error, which the caller must return
+func warn(format string, args ...interface{}) error {
+	if strict {
+		return fmt.Errorf(format+" (--strict)", args...)
+	}
+
+	fmt.Fprintf(os.Stderr, "Warning: "+format+"\n", args...)
+	return nil
+}
+
+// Exit statuses
+const (
+	exitFailure      = 1
+	exitMismatch     = 2
+	exitCommsFailure = 3
+)
+
+func exitCode(err error) int {
+	if rerr, ok := err.(reportedError); ok {
+		err = rerr.error
+	}
+
+	if err == errConfigsDiffer || err == errImagesDiffer {
+		return exitMismatch
+	}
+
+	switch err.(type) {
+	case *mismatchError, *checksumMismatchError:
+		return exitMismatch
+	case commsError:
+		return exitCommsFailure
+	default:
+		return exitFailure
+	}
+}
 
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
@@ -36,18 +89,30 @@ var rootCmd = &cobra.Command{
 	Long: `A tool for programming Nuvoton devices, particularly
 	focusing on their modern 8051 family`,
 	PersistentPreRun: func(cmd *cobra.Command, args []string) {
-		if !verbose {
+		if verbose == 0 {
 			log.SetOutput(ioutil.Discard)
 		}
+		if verbose >= 2 {
+			protocol.FrameLog.SetOutput(os.Stderr)
+		}
+
+		// color disables itself when stdout is not a terminal
+		if noColor || os.Getenv("NO_COLOR") != "" {
+			color.NoColor = true
+		}
 	},
 }
 
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
-	if err := rootCmd.Execute(); err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+	err := rootCmd.Execute()
+	removeUnclosedOutputs()
+	if err != nil {
+		if _, ok := err.(reportedError); !ok {
+			fmt.Println(err)
+		}
+		os.Exit(exitCode(err))
 	}
 }
 
@@ -55,8 +120,16 @@ func init() {
 	// Here you will define your flags and configuration settings.
 	// Cobra supports persistent flags, which, if defined here,
 	// will be global for your application.
-	rootCmd.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, "make verbose (enable debug logging)")
+	rootCmd.PersistentFlags().CountVarP(&verbose, "verbose", "v", "make verbose (-v: log operations, -vv: also log raw frames)")
 	rootCmd.PersistentFlags().StringVarP(&targetName, "target", "t", "", "target device")
+	rootCmd.PersistentFlags().Uint32Var(&icpClock, "icp-clock", 0, "ICP clock in kHz (defaults to the target's default)")
+	rootCmd.PersistentFlags().Uint32Var(&minFirmware, "min-firmware", uint32(protocol.FirmwareVersionRequired), "minimum programmer firmware version to accept")
+	rootCmd.PersistentFlags().StringVar(&devicePath, "device", "", "programmer HID device path (e.g. /dev/hidraw0); skips enumeration")
+	rootCmd.PersistentFlags().IntVar(&connectRetries, "connect-retries", 2, "number of times to retry connecting to the target")
+	rootCmd.PersistentFlags().BoolVar(&strict, "strict", false, "treat warnings as errors")
+	rootCmd.PersistentFlags().BoolVar(&assumeTargetPresent, "assume-target-present", false, "skip the programmer firmware and device ID checks (expert use: bringing up new targets)")
+	rootCmd.PersistentFlags().BoolVar(&noColor, "no-color", false, "disable colored output")
+	rootCmd.PersistentFlags().StringVar(&recordFile, "record", "", "record programmer communications to a session log")
 
 	// Cobra also supports local flags, which will only run
 	// when this action is called directly.
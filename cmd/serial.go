@@ -0,0 +1,166 @@
+// Copyright © 2019 Erin Shepherd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Time to wait for another nuvoprog instance to release the serial counter.
+// The counter is held while a device is programmed, so this must cover a
+// whole programming run
+const serialLockTimeout = 2 * time.Minute
+
+// A serial number reserved from a counter file. The counter file is locked
+// until the reservation is committed or released, so that concurrent
+// nuvoprog instances cannot allocate the same number
+type serialReservation struct {
+	counter string
+	lock    string
+	next    uint64
+}
+
+// Reserves the next serial number from the counter file. A lock file
+// serialises concurrent nuvoprog instances.
+//
+// The counter file holds the last serial number allocated, in decimal
+func reserveSerial(counter string) (*serialReservation, error) {
+	lock := counter + ".lock"
+	deadline := time.Now().Add(serialLockTimeout)
+	for {
+		f, err := os.OpenFile(lock, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			f.Close()
+			break
+		} else if !os.IsExist(err) {
+			return nil, err
+		} else if time.Now().After(deadline) {
+			return nil, fmt.Errorf("Timed out waiting for lock %s", lock)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	var last uint64
+	buf, err := ioutil.ReadFile(counter)
+	if err == nil {
+		last, err = strconv.ParseUint(strings.TrimSpace(string(buf)), 10, 64)
+		if err != nil {
+			os.Remove(lock)
+			return nil, fmt.Errorf("Parsing serial counter %s: %v", counter, err)
+		}
+	} else if !os.IsNotExist(err) {
+		os.Remove(lock)
+		return nil, err
+	}
+
+	return &serialReservation{counter: counter, lock: lock, next: last + 1}, nil
+}
+
+// Records the reserved serial number as allocated in the counter file and
+// releases the lock
+func (r *serialReservation) commit() error {
+	defer r.release()
+
+	tmp := r.counter + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(strconv.FormatUint(r.next, 10)+"\n"), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, r.counter); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// Releases the lock without allocating the reserved serial number, so that
+// it is reused by the next run. Does nothing if r is nil or was already
+// committed or released
+func (r *serialReservation) release() {
+	if r == nil || r.lock == "" {
+		return
+	}
+	os.Remove(r.lock)
+	r.lock = ""
+}
+
+// Returns the serial number bytes for a --serial argument: either hex
+// bytes, or AUTO to allocate the next value from the counter file, encoded
+// big-endian in size bytes.
+//
+// For AUTO, the number is only reserved: the caller must commit the returned
+// reservation once the device has been programmed, or release it
+func serialBytes(arg, counter string, size int) ([]byte, *serialReservation, error) {
+	if !strings.EqualFold(arg, "auto") {
+		buf, err := hex.DecodeString(arg)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Serial '%s' must be AUTO or hex bytes", arg)
+		}
+		return buf, nil, nil
+	}
+
+	if size < 1 || size > 8 {
+		return nil, nil, errors.New("Serial size must be between 1 and 8 bytes")
+	}
+
+	r, err := reserveSerial(counter)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	n := r.next
+	if size < 8 && n >= 1<<(8*uint(size)) {
+		r.release()
+		return nil, nil, fmt.Errorf("Serial %d does not fit in %d bytes", n, size)
+	}
+
+	buf := make([]byte, size)
+	for i := size - 1; i >= 0; i-- {
+		buf[i] = byte(n)
+		n >>= 8
+	}
+	return buf, r, nil
+}
+
+// Patches serial into the program memory of data at addr
+func (d *TargetData) patchSerial(addr uint, serial []byte) error {
+	aprom, err := d.APROM()
+	if err != nil {
+		return err
+	}
+
+	if addr+uint(len(serial)) > uint(len(aprom)) {
+		return fmt.Errorf("Serial (%d bytes at 0x%04x) does not fit in APROM (0x%04x bytes)",
+			len(serial), addr, len(aprom))
+	}
+
+	for _, b := range aprom[addr : addr+uint(len(serial))] {
+		if b != 0xFF {
+			if err := warn("Serial number overwrites non-blank image data at 0x%04x", addr); err != nil {
+				return err
+			}
+			break
+		}
+	}
+
+	copy(aprom[addr:], serial)
+	return nil
+}
@@ -0,0 +1,68 @@
+// Copyright © 2019 Erin Shepherd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+)
+
+func TestSerialCommittedOnlyOnSuccess(t *testing.T) {
+	counter := filepath.Join(t.TempDir(), "serial.txt")
+
+	// A failed run releases its number for reuse
+	buf, r, err := serialBytes("auto", counter, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, []byte{0, 1}) {
+		t.Fatalf("first serial = %X, want 0001", buf)
+	}
+	r.release()
+
+	buf, r, err = serialBytes("auto", counter, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, []byte{0, 1}) {
+		t.Fatalf("serial after release = %X, want 0001", buf)
+	}
+	if err := r.commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	buf, r, err = serialBytes("auto", counter, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.release()
+	if !bytes.Equal(buf, []byte{0, 2}) {
+		t.Fatalf("serial after commit = %X, want 0002", buf)
+	}
+}
+
+func TestSerialHexNotReserved(t *testing.T) {
+	buf, r, err := serialBytes("00ab", filepath.Join(t.TempDir(), "serial.txt"), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r != nil {
+		t.Error("hex serial returned a reservation")
+	}
+	if !bytes.Equal(buf, []byte{0x00, 0xab}) {
+		t.Errorf("serial = %X, want 00AB", buf)
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright © 2019 Erin Shepherd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+)
+
+var ErrSignatureInvalid = errors.New("Image signature verification failed")
+
+func readAll(arg string) ([]byte, error) {
+	f, err := openRead(arg)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ioutil.ReadAll(f)
+}
+
+// Reads a PEM encoded (PKIX) Ed25519 public key
+func readPublicKey(arg string) (ed25519.PublicKey, error) {
+	buf, err := readAll(arg)
+	if err != nil {
+		return nil, err
+	}
+
+	blk, _ := pem.Decode(buf)
+	if blk == nil {
+		return nil, errors.New("Public key is not PEM encoded")
+	}
+
+	key, err := x509.ParsePKIXPublicKey(blk.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	pk, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, errors.New("Public key is not an Ed25519 key")
+	}
+	return pk, nil
+}
+
+// Reads a signature, either raw or base64 encoded
+func readSignature(arg string) ([]byte, error) {
+	buf, err := readAll(arg)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(buf) == ed25519.SignatureSize {
+		return buf, nil
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(buf)))
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return nil, errors.New("Signature is not a raw or base64 encoded Ed25519 signature")
+	}
+	return sig, nil
+}
+
+// Verifies an Ed25519 signature over the normalized target data
+func verifySignature(d *TargetData, sigFile, keyFile string) error {
+	return verifySignatureBytes(d.Normalized(), sigFile, keyFile)
+}
+
+// Verifies an Ed25519 signature over buf
+func verifySignatureBytes(buf []byte, sigFile, keyFile string) error {
+	pk, err := readPublicKey(keyFile)
+	if err != nil {
+		return err
+	}
+
+	sig, err := readSignature(sigFile)
+	if err != nil {
+		return err
+	}
+
+	if !ed25519.Verify(pk, buf, sig) {
+		return ErrSignatureInvalid
+	}
+	return nil
+}
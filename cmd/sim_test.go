@@ -0,0 +1,65 @@
+// Copyright © 2019 Erin Shepherd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/erincandescent/nuvoprog/protocol"
+	"github.com/erincandescent/nuvoprog/target"
+	_ "github.com/erincandescent/nuvoprog/target/all"
+)
+
+func TestMain(m *testing.M) {
+	// As without --verbose, discard the (very noisy) protocol log
+	log.SetOutput(ioutil.Discard)
+	os.Exit(m.Run())
+}
+
+// Returns a device connected to a simulated programmer with an erased td
+// attached
+func simDevice(td *target.Definition) (*protocol.Device, *protocol.SimTransport) {
+	sizes := map[protocol.MemorySpace]uint32{}
+	for _, s := range td.MemorySpaces() {
+		sizes[s.Space] = s.Size
+	}
+
+	sim := protocol.NewSimTransport(td.DeviceID, sizes)
+	return protocol.NewDevice("sim", sim, protocol.NewV1Framer()), sim
+}
+
+// Returns target data for td with the default configuration and the
+// given APROM contents
+func simImage(td *target.Definition, aprom []byte) *TargetData {
+	d := NewTargetData(td)
+	d.Config = bytes.Repeat([]byte{0xFF}, int(td.Config.ReadSize))
+	copy(d.Data, aprom)
+	return d
+}
+
+// Returns the simulated requests with the given command
+func simRequests(sim *protocol.SimTransport, cmd protocol.CommandCode) []protocol.SimRequest {
+	var reqs []protocol.SimRequest
+	for _, r := range sim.Requests {
+		if r.Command == cmd {
+			reqs = append(reqs, r)
+		}
+	}
+	return reqs
+}
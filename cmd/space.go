@@ -0,0 +1,135 @@
+// Copyright © 2019 Erin Shepherd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/erincandescent/nuvoprog/protocol"
+	"github.com/erincandescent/nuvoprog/target"
+	"github.com/spf13/cobra"
+)
+
+// Flags of program which only apply to program space
+var programSpaceOnlyFlags = []string{
+	"aprom", "ldrom", "config", "set", "all", "concurrency", "serial",
+	"serial-addr", "serial-size", "serial-counter", "backup", "ldrom-offset",
+	"verify", "verify-each-page", "skip-erase", "program-order",
+	"post-erase-delay", "audit-log", "bin-offset", "reject-overlaps",
+}
+
+// Returns the memory space selected by --space
+func selectedSpace(cmd *cobra.Command, td *target.Definition) (target.Space, error) {
+	name, _ := cmd.Flags().GetString("space")
+	return td.SpaceByName(name)
+}
+
+// Reads the image file name as the contents of space s, addressed from the
+// start of the space. The result extends to the last byte given by the
+// image, with any gaps filled with 0xFF
+func readSpaceImage(name string, s target.Space) ([]byte, error) {
+	rd, err := openRead(name)
+	if err != nil {
+		return nil, err
+	}
+	defer rd.Close()
+
+	var buf []byte
+	brd, _ := detectBlockReader(rd, 0)
+	for {
+		b, err := brd.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		end := uint64(b.Address) + uint64(len(b.Data))
+		if end > uint64(s.Size) {
+			return nil, fmt.Errorf("Data at 0x%04x-0x%04x exceeds %s space (0x%x bytes)",
+				b.Address, end-1, s.Name, s.Size)
+		}
+
+		for uint64(len(buf)) < end {
+			buf = append(buf, 0xFF)
+		}
+		copy(buf[b.Address:], b.Data)
+	}
+	return buf, nil
+}
+
+// Writes the image given by --image to space s, which is not erased first,
+// then verifies it. If sigFile is given, the image is checked against it
+// before connecting
+func programSpace(cmd *cobra.Command, td *target.Definition, s target.Space, sigFile, keyFile string) error {
+	if s.Space == protocol.ConfigSpace {
+		return errors.New("Configuration cannot be programmed with --space; use --config or --set")
+	}
+
+	for _, flag := range programSpaceOnlyFlags {
+		if cmd.Flags().Changed(flag) {
+			return fmt.Errorf("--%s cannot be used with --space %s", flag, s.Name)
+		}
+	}
+
+	image, _ := cmd.Flags().GetString("image")
+	if image == "" {
+		return fmt.Errorf("No image specified for %s space", s.Name)
+	}
+
+	buf, err := readSpaceImage(image, s)
+	if err != nil {
+		return err
+	}
+
+	if sigFile != "" {
+		if err := verifySignatureBytes(buf, sigFile, keyFile); err != nil {
+			return err
+		}
+	}
+
+	pageSz, err := pageSize(cmd, td)
+	if err != nil {
+		return err
+	}
+
+	dev, _, err := connectToTarget()
+	if err != nil {
+		return err
+	}
+	defer resetAndCloseDevice(dev)
+
+	if err := checkWritePageSize(dev, pageSz); err != nil {
+		return err
+	}
+	if err := writeRange(dev, s.Space, 0, buf, pageSz); err != nil {
+		return err
+	}
+
+	readback := make([]byte, len(buf))
+	if _, err := readRange(dev, s.Space, 0, readback, pageSz, 3); err != nil {
+		return err
+	}
+	return compareRegion(s.Name, 0, buf, readback)
+}
+
+// Reads the whole of space s
+func readSpace(dev *protocol.Device, s target.Space, pageSize, retries int, order pageOrder) ([]byte, int, error) {
+	buf := make([]byte, s.Size)
+	n, err := readRangeOrdered(dev, s.Space, 0, buf, pageSize, retries, order)
+	return buf, n, err
+}
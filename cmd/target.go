@@ -0,0 +1,30 @@
+// Copyright © 2019 Erin Shepherd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+)
+
+// targetCmd represents the target command
+var targetCmd = &cobra.Command{
+	Use:   "target",
+	Short: "Target information",
+	Long:  `Commands describing the supported target devices`,
+}
+
+func init() {
+	rootCmd.AddCommand(targetCmd)
+}
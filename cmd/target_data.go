@@ -16,16 +16,28 @@ package cmd
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"io/ioutil"
+	"math"
+	"math/rand"
+	"net/http"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/erincandescent/nuvoprog/ihex"
+	"github.com/erincandescent/nuvoprog/protocol"
+	"github.com/erincandescent/nuvoprog/srec"
 	"github.com/erincandescent/nuvoprog/target"
 )
 
@@ -33,20 +45,96 @@ type TargetData struct {
 	TargetDefinition *target.Definition
 	Config           []byte
 	Data             []byte
+
+	// Record layout of the Intel Hex files the data was read from, at
+	// image addresses
+	Layout ihex.Layout
+	// If set, Write, WriteAPROM and WriteLDROM use the same record
+	// boundaries as Layout
+	PreserveRecords bool
+	// Maximum Intel Hex data record length used by Write, WriteAPROM and
+	// WriteLDROM (defaults to the target's page size)
+	RecordLength int
+	// Format written by Write, WriteAPROM and WriteLDROM: Intel Hex
+	// (the default), S-records or raw binary. Raw binary images contain
+	// only program memory, not the configuration
+	Format imageFormat
+
+	// Bitmap of the bytes of Data written by inputs
+	written []uint64
+}
+
+// Returned when inputs write differing values to the same address
+type overlapError struct {
+	Address uint32
+}
+
+func (e *overlapError) Error() string {
+	return fmt.Sprintf("Overlapping data at 0x%04x", e.Address)
+}
+
+// Options for reading input images
+type readOptions struct {
+	// Offset from the start of its region at which to load a raw binary
+	binOffset uint32
+	// Reject inputs which write differing values to the same address,
+	// whether within one file or across files
+	rejectOverlaps bool
 }
 
-func (d *TargetData) read(rd io.ReadCloser, offset, length uint32, config bool, kind string) (err error) {
+// Reads an image file in any format recognised by detectFormat into the
+// region of length bytes at offset. Raw binaries are loaded opts.binOffset
+// bytes from the start of the region
+func (d *TargetData) read(rd io.ReadCloser, offset, length uint32, opts readOptions, config bool, kind string) (err error) {
 	defer rd.Close()
-	hrd := ihex.NewReader(rd)
+
+	// Record layout is only retained for Intel Hex
+	brd, format := detectBlockReader(rd, opts.binOffset)
+	hrd, _ := brd.(*ihex.Reader)
+	if hrd != nil {
+		hrd.KeepLayout = true
+		hrd.Coalesce = true
+	}
+
+	defer func() {
+		if hrd == nil {
+			return
+		}
+		for _, s := range hrd.Layout {
+			if s.Address < length {
+				s.Address += offset
+			}
+			d.Layout = append(d.Layout, s)
+		}
+	}()
+
+	// Configuration blocks read; these may be split across records
+	var cfg []byte
 
 	var b ihex.Block
-	for b, err = hrd.Next(); err == nil; b, err = hrd.Next() {
+	for b, err = brd.Next(); err == nil; b, err = brd.Next() {
+		cfgAddr, isConfig := configAddress(d.TargetDefinition, b)
 		switch {
-		case b.Address+uint32(len(b.Data)) <= length:
+		case uint64(b.Address)+uint64(len(b.Data)) <= uint64(length):
+			if err := d.markWritten(offset+b.Address, b.Data, opts.rejectOverlaps); err != nil {
+				return err
+			}
 			copy(d.Data[offset+b.Address:], b.Data)
 
-		case b.Address == d.TargetDefinition.Config.IHexOffset && config:
-			d.Config = b.Data
+		case format == formatBinary:
+			return fmt.Errorf("Binary of %d bytes at 0x%04x overruns %s (0x%x bytes)",
+				len(b.Data), b.Address, kind, length)
+
+		case isConfig:
+			end := int(cfgAddr) + len(b.Data)
+			for len(cfg) < end {
+				cfg = append(cfg, 0xFF)
+			}
+			copy(cfg[cfgAddr:], b.Data)
+
+		case kind == "ldrom":
+			return fmt.Errorf("Block 0x%08x+%02d out of range for ldrom (LDROM is %d bytes; is this an APROM image?)",
+				b.Address, len(b.Data), length)
 
 		default:
 			return fmt.Errorf("Block 0x%08x+%02d out of range for %s", b.Address, len(b.Data), kind)
@@ -55,18 +143,60 @@ func (d *TargetData) read(rd io.ReadCloser, offset, length uint32, config bool,
 
 	if err == io.EOF {
 		err = nil
+		switch {
+		case cfg == nil:
+		case config:
+			d.Config = cfg
+		case !d.configEqual(cfg):
+			// The configuration has already been determined (and the
+			// regions laid out according to it)
+			err = warn("Configuration in %s (%X) differs from that being used (%X); ignoring it", kind, cfg, d.Config)
+		}
 	}
 
 	return
 }
 
+// Returns the config space address of b, if it lies within config space
+func configAddress(td *target.Definition, b ihex.Block) (uint16, bool) {
+	space, addr, err := td.SpaceAddress(b.Address)
+	if err != nil || space != protocol.ConfigSpace || uint(addr)+uint(len(b.Data)) > uint(td.Config.WriteSize) {
+		return 0, false
+	}
+	return addr, true
+}
+
+// Records that data is to be written at addr. If rejectOverlaps is set,
+// returns an *overlapError if an earlier write put a different value at any
+// of its addresses
+func (d *TargetData) markWritten(addr uint32, data []byte, rejectOverlaps bool) error {
+	if d.written == nil {
+		d.written = make([]uint64, (len(d.Data)+63)/64)
+	}
+
+	for i, v := range data {
+		a := addr + uint32(i)
+		bit := uint64(1) << (a % 64)
+		if rejectOverlaps && d.written[a/64]&bit != 0 && d.Data[a] != v {
+			return &overlapError{a}
+		}
+		d.written[a/64] |= bit
+	}
+	return nil
+}
+
+// Reports whether an input has written the byte of Data at addr
+func (d *TargetData) isWritten(addr uint32) bool {
+	return d.written != nil && d.written[addr/64]&(uint64(1)<<(addr%64)) != 0
+}
+
 func (d *TargetData) APROM() ([]byte, error) {
 	cfg, err := d.TargetDefinition.Config.Decode(d.Config)
 	if err != nil {
 		return nil, err
 	}
 
-	size := d.TargetDefinition.ProgMemSize - cfg.GetLDROMSize()
+	size := d.TargetDefinition.Layout(cfg).APROM.Size
 	return d.Data[:size], nil
 }
 
@@ -76,7 +206,7 @@ func (d *TargetData) LDROM() ([]byte, error) {
 		return nil, err
 	}
 
-	apsize := d.TargetDefinition.ProgMemSize - cfg.GetLDROMSize()
+	apsize := d.TargetDefinition.Layout(cfg).APROM.Size
 
 	if int(apsize) != len(d.Data) {
 		return d.Data[apsize:], nil
@@ -85,8 +215,205 @@ func (d *TargetData) LDROM() ([]byte, error) {
 	}
 }
 
-func (d *TargetData) Write(ws io.WriteCloser) (err error) {
+// Normalized returns a deterministic representation of the target data:
+// the 0xFF-padded program memory followed by the configuration bytes
+// padded with 0xFF to the target's write size
+func (d *TargetData) Normalized() []byte {
+	buf := make([]byte, 0, len(d.Data)+int(d.TargetDefinition.Config.WriteSize))
+	buf = append(buf, d.Data...)
+	buf = append(buf, d.Config...)
+	for i := len(d.Config); i < int(d.TargetDefinition.Config.WriteSize); i++ {
+		buf = append(buf, 0xFF)
+	}
+	return buf
+}
+
+// Regions which may be checksummed
+const (
+	checksumAPROM = "aprom"
+	checksumLDROM = "ldrom"
+	checksumAll   = "all"
+)
+
+// Returns the CRC-32 (IEEE 802.3, as used by zlib) of region: aprom, ldrom,
+// or all (APROM followed by LDROM). Each region is checksummed in full, at
+// the size selected by the configuration, with unprogrammed bytes as 0xFF
+func (d *TargetData) Checksum(region string) (uint32, error) {
+	aprom, err := d.APROM()
+	if err != nil {
+		return 0, err
+	}
+	ldrom, err := d.LDROM()
+	if err != nil {
+		return 0, err
+	}
+
+	switch region {
+	case checksumAPROM:
+		return crc32.ChecksumIEEE(aprom), nil
+	case checksumLDROM:
+		return crc32.ChecksumIEEE(ldrom), nil
+	case checksumAll:
+		return crc32.Update(crc32.ChecksumIEEE(aprom), crc32.IEEETable, ldrom), nil
+	default:
+		return 0, fmt.Errorf("'%s' not understood for region; expected aprom, ldrom or all", region)
+	}
+}
+
+// Returns the runs of bytes which differ between a and b, as blocks of
+// b's contents at base. Missing bytes are treated as erased (0xFF)
+func diffBlocks(base uint32, a, b []byte) []ihex.Block {
+	n := len(a)
+	if len(b) > n {
+		n = len(b)
+	}
+
+	at := func(buf []byte, i int) byte {
+		if i < len(buf) {
+			return buf[i]
+		}
+		return 0xFF
+	}
+
+	var blocks []ihex.Block
+	for i := 0; i < n; i++ {
+		if at(a, i) == at(b, i) {
+			continue
+		}
+
+		start := i
+		for i < n && at(a, i) != at(b, i) {
+			i++
+		}
+
+		buf := make([]byte, i-start)
+		for j := range buf {
+			buf[j] = at(b, start+j)
+		}
+		blocks = append(blocks, ihex.Block{Address: base + uint32(start), Data: buf})
+	}
+	return blocks
+}
+
+// Returns whether the configurations are equivalent. Where both decode,
+// the decoded fields (and any bytes beyond them) are compared, so that
+// encodings which differ only in unused bits are equal
+func (d *TargetData) configEqual(other []byte) bool {
+	cs := &d.TargetDefinition.Config
+	a, aerr := cs.Decode(d.Config)
+	b, berr := cs.Decode(other)
+	if aerr != nil || berr != nil {
+		return len(diffBlocks(0, d.Config, other)) == 0
+	}
+
+	abuf, aerr := json.Marshal(a)
+	bbuf, berr := json.Marshal(b)
+	if aerr != nil || berr != nil || !bytes.Equal(abuf, bbuf) {
+		return false
+	}
+
+	var aext, bext []byte
+	if uint(len(d.Config)) > cs.MinSize {
+		aext = d.Config[cs.MinSize:]
+	}
+	if uint(len(other)) > cs.MinSize {
+		bext = other[cs.MinSize:]
+	}
+	return len(diffBlocks(0, aext, bext)) == 0
+}
+
+// Equal compares d with other, returning whether they are equal and the
+// blocks of other which differ (addressed as in an image file)
+func (d *TargetData) Equal(other *TargetData) (bool, []ihex.Block) {
+	var blocks []ihex.Block
+	if !d.configEqual(other.Config) {
+		blocks = append(blocks, ihex.Block{
+			Address: d.TargetDefinition.Config.IHexOffset,
+			Data:    other.Config,
+		})
+	}
+
+	blocks = append(blocks, diffBlocks(0, d.Data, other.Data)...)
+	return len(blocks) == 0, blocks
+}
+
+// Merges other on top of d. Erased (0xFF) bytes in other leave d's
+// contents unchanged; other bytes overlap d's unless d is erased there or
+// already holds the same value. Overlaps, and a differing configuration,
+// are errors unless overwrite is set, in which case other's contents win
+func (d *TargetData) Overlay(other *TargetData, overwrite bool) error {
+	if !overwrite {
+		if len(d.Config) != 0 && !bytes.Equal(d.Config, other.Config) {
+			return errors.New("Configuration differs from the base image's (use --overwrite to replace it)")
+		}
+
+		for i, b := range other.Data {
+			if b != 0xFF && d.Data[i] != 0xFF && d.Data[i] != b {
+				return fmt.Errorf("Data at 0x%04x overlaps the base image (use --overwrite to replace it)", i)
+			}
+		}
+	}
+
+	for i, b := range other.Data {
+		if b != 0xFF {
+			d.Data[i] = b
+		}
+	}
+	d.Config = other.Config
+	d.Layout = append(d.Layout, other.Layout...)
+	return nil
+}
+
+// Returns a writer for the data from base to base+length, written at
+// address 0 if rebase is set
+func (d *TargetData) hexWriter(ws io.WriteCloser, base, length uint32, rebase bool) blockWriter {
+	if d.Format == formatSREC {
+		return srec.NewWriter(ws)
+	}
+
 	w := ihex.NewWriter(ws)
+	if d.RecordLength != 0 {
+		w.RecordLength = d.RecordLength
+	} else if d.TargetDefinition.PageSize != 0 {
+		w.RecordLength = int(d.TargetDefinition.PageSize)
+	}
+	if !d.PreserveRecords {
+		return w
+	}
+
+	w.Layout = ihex.Layout{}
+	for _, s := range d.Layout {
+		if s.Address >= base && s.Address-base < length {
+			if rebase {
+				s.Address -= base
+			}
+			w.Layout = append(w.Layout, s)
+		}
+	}
+	return w
+}
+
+func (d *TargetData) Write(ws io.WriteCloser) error {
+	if d.Format == formatBinary {
+		return writeBinBlock(ws, d.Data)
+	}
+
+	w := d.hexWriter(ws, 0, math.MaxUint32, false)
+	return d.writeBlocks(w)
+}
+
+// Writes buf even if w would otherwise skip it as erased. Config must
+// always be written, or the resulting image is unusable
+func writeUnskipped(w blockWriter, addr uint32, buf []byte) error {
+	if hw, ok := w.(*ihex.Writer); ok && hw.SkipFill {
+		hw.SkipFill = false
+		defer func() { hw.SkipFill = true }()
+	}
+	return w.Write(addr, buf)
+}
+
+// Writes config and data to w, closing it
+func (d *TargetData) writeBlocks(w blockWriter) (err error) {
 	defer func() {
 		if err == nil {
 			err = w.Close()
@@ -94,7 +421,13 @@ func (d *TargetData) Write(ws io.WriteCloser) (err error) {
 	}()
 
 	if len(d.Config) > 0 {
-		err = w.Write(d.TargetDefinition.Config.IHexOffset, d.Config)
+		var addr uint32
+		addr, err = d.TargetDefinition.FlatAddress(protocol.ConfigSpace, 0)
+		if err != nil {
+			return
+		}
+
+		err = writeUnskipped(w, addr, d.Config)
 		if err != nil {
 			return
 		}
@@ -104,8 +437,45 @@ func (d *TargetData) Write(ws io.WriteCloser) (err error) {
 	return
 }
 
-func WriteHexBlock(ws io.WriteCloser, buf []byte) (err error) {
-	w := ihex.NewWriter(ws)
+// Writes the decoded configuration as JSON to the named file
+func (d *TargetData) WriteConfigJSON(name string) error {
+	cfg, err := d.TargetDefinition.Config.Decode(d.Config)
+	if err != nil {
+		return err
+	}
+
+	buf, err := json.MarshalIndent(cfg, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	f, err := openWrite(name)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(buf); err != nil {
+		abortWrite(f)
+		return err
+	}
+
+	return f.Close()
+}
+
+func WriteHexBlock(ws io.WriteCloser, buf []byte) error {
+	return writeHexBlock(ihex.NewWriter(ws), buf)
+}
+
+// Writes buf to ws as raw binary, closing it
+func writeBinBlock(ws io.WriteCloser, buf []byte) error {
+	if _, err := ws.Write(buf); err != nil {
+		abortWrite(ws)
+		return err
+	}
+	return ws.Close()
+}
+
+func writeHexBlock(w blockWriter, buf []byte) (err error) {
 	defer func() {
 		if err == nil {
 			err = w.Close()
@@ -120,7 +490,10 @@ func (d *TargetData) WriteAPROM(ws io.WriteCloser) error {
 	if err != nil {
 		return err
 	}
-	return WriteHexBlock(ws, aprom)
+	if d.Format == formatBinary {
+		return writeBinBlock(ws, aprom)
+	}
+	return writeHexBlock(d.hexWriter(ws, 0, uint32(len(aprom)), true), aprom)
 }
 
 func (d *TargetData) WriteLDROM(ws io.WriteCloser) error {
@@ -128,17 +501,46 @@ func (d *TargetData) WriteLDROM(ws io.WriteCloser) error {
 	if err != nil {
 		return err
 	}
-	return WriteHexBlock(ws, ldrom)
+	if d.Format == formatBinary {
+		return writeBinBlock(ws, ldrom)
+	}
+	base := uint32(len(d.Data) - len(ldrom))
+	return writeHexBlock(d.hexWriter(ws, base, uint32(len(ldrom)), true), ldrom)
+}
+
+// Timeout for fetching input files from URLs
+const fetchTimeout = 60 * time.Second
+
+func isURL(arg string) bool {
+	return strings.HasPrefix(arg, "http://") || strings.HasPrefix(arg, "https://")
 }
 
 func openRead(arg string) (io.ReadCloser, error) {
-	if arg == "-" {
+	switch {
+	case arg == "-":
 		return ioutil.NopCloser(os.Stdin), nil
-	} else {
+	case isURL(arg):
+		return openURL(arg)
+	default:
 		return os.Open(arg)
 	}
 }
 
+func openURL(url string) (io.ReadCloser, error) {
+	client := &http.Client{Timeout: fetchTimeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("Fetching '%s': %s", url, resp.Status)
+	}
+
+	return resp.Body, nil
+}
+
 type stdoutW struct {
 	*bufio.Writer
 }
@@ -149,37 +551,193 @@ func (w *stdoutW) Close() error {
 
 type fileW struct {
 	*bufio.Writer
-	f *os.File
+	f    *os.File
+	name string
+	done bool
+	// Set if the destination is written directly, rather than through a
+	// temporary file. It is then never removed, as it may have existed
+	// beforehand
+	direct bool
 }
 
-func (w *fileW) Close() error {
-	nm := w.f.Name()
-	nms := strings.TrimSuffix(nm, "~")
+// Output files which have been opened (possibly by concurrent workers).
+// Any not closed by the time the command exits are removed so failed
+// commands don't leave partial output behind
+var (
+	outputMu    sync.Mutex
+	outputFiles []*fileW
+)
 
+func (w *fileW) Close() error {
+	w.done = true
 	if err := w.Flush(); err != nil {
+		w.abort()
 		return err
 	}
 
 	if err := w.f.Close(); err != nil {
+		if !w.direct {
+			os.Remove(w.f.Name())
+		}
 		return err
 	}
 
-	return os.Rename(nm, nms)
+	if w.direct {
+		return nil
+	}
+	return os.Rename(w.f.Name(), w.name)
+}
+
+func (w *fileW) abort() {
+	w.done = true
+	w.f.Close()
+	if !w.direct {
+		os.Remove(w.f.Name())
+	}
+}
+
+// Discards the output being written to w, if possible; otherwise closes it
+func abortWrite(w io.WriteCloser) {
+	if fw, ok := w.(*fileW); ok {
+		fw.abort()
+	} else {
+		w.Close()
+	}
 }
 
+func removeUnclosedOutputs() {
+	outputMu.Lock()
+	defer outputMu.Unlock()
+
+	for _, w := range outputFiles {
+		if !w.done {
+			w.abort()
+		}
+	}
+	outputFiles = nil
+}
+
+// Creates a new file in dir named prefix, a random number and suffix, with
+// permissions perm (less the umask). Unlike ioutil.TempFile, which always
+// uses 0600, this suits files which are to be renamed into place
+func createTemp(dir, prefix, suffix string, perm os.FileMode) (*os.File, error) {
+	for i := 0; ; i++ {
+		name := filepath.Join(dir, prefix+strconv.FormatUint(uint64(rand.Uint32()), 10)+suffix)
+		f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, perm)
+		if os.IsExist(err) && i < 100 {
+			continue
+		}
+		return f, err
+	}
+}
+
+// Output is written to a temporary file in the same directory and renamed
+// into place on Close. If no temporary file can be created there, we fall
+// back to writing the destination directly (which is then left in place,
+// even if incomplete, should the command fail)
 func openWrite(arg string) (io.WriteCloser, error) {
 	if arg == "-" {
 		return &stdoutW{bufio.NewWriter(os.Stdout)}, nil
-	} else {
-		f, err := os.Create(arg + "~")
+	}
+
+	dir, base := filepath.Split(arg)
+	if dir == "" {
+		dir = "."
+	}
+
+	// A replaced file keeps its mode; a new one gets the usual mode for
+	// new files (0666 less the umask)
+	perm, keep := os.FileMode(0666), false
+	if fi, err := os.Stat(arg); err == nil && fi.Mode().IsRegular() {
+		perm, keep = fi.Mode().Perm(), true
+	}
+
+	direct := false
+	f, err := createTemp(dir, "."+base+".", ".tmp", perm)
+	if err != nil {
+		f, err = os.Create(arg)
 		if err != nil {
 			return nil, err
 		}
+		direct = true
+	} else if keep {
+		// The umask applies to the new file, but not to the file it replaces
+		f.Chmod(perm)
+	}
+
+	w := &fileW{
+		Writer: bufio.NewWriter(f),
+		f:      f,
+		name:   arg,
+		direct: direct,
+	}
+
+	outputMu.Lock()
+	outputFiles = append(outputFiles, w)
+	outputMu.Unlock()
+	return w, nil
+}
+
+// Parses JSON configuration. On failure, attempts to identify the
+// offending field
+func parseConfigJSON(td *target.Definition, buf []byte) (target.Config, error) {
+	var fields map[string]json.RawMessage
+	isObject := json.Unmarshal(buf, &fields) == nil
+
+	var names []string
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if !hasConfigField(td, name) {
+			return nil, unknownFieldError(td, name)
+		}
+	}
+
+	cfgo := td.Config.NewConfig()
+	err := json.Unmarshal(buf, cfgo)
+	if err == nil {
+		return cfgo, nil
+	}
+
+	if isObject {
+		for _, name := range names {
+			field, _ := json.Marshal(map[string]json.RawMessage{name: fields[name]})
+			if ferr := json.Unmarshal(field, td.Config.NewConfig()); ferr != nil {
+				return nil, &target.ConfigError{Field: name, Offset: -1, Err: ferr}
+			}
+		}
+	}
 
-		return &fileW{
-			bufio.NewWriter(f),
-			f,
-		}, nil
+	return nil, &target.ConfigError{
+		Offset: -1,
+		Err:    fmt.Errorf("Parsing configuration: %s", err),
+	}
+}
+
+func hasConfigField(td *target.Definition, name string) bool {
+	for _, f := range td.Config.Fields() {
+		if f.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns an error describing an unknown configuration field, suggesting
+// the closest match
+func unknownFieldError(td *target.Definition, name string) error {
+	var names []string
+	for _, f := range td.Config.Fields() {
+		names = append(names, f.Name)
+	}
+
+	return &target.ConfigError{
+		Field:  name,
+		Offset: -1,
+		Err:    errors.New("Unknown field" + didYouMean(name, names)),
 	}
 }
 
@@ -190,9 +748,9 @@ func readConfig(td *target.Definition, arg string) ([]byte, error) {
 	case arg == "":
 		return nil, errors.New("No configuration specified")
 	case arg[0] == '{':
-		cfgo := td.Config.NewConfig()
-		if err := json.Unmarshal([]byte(arg), cfgo); err != nil {
-			return nil, fmt.Errorf("Parsing configuration: %s", err)
+		cfgo, err := parseConfigJSON(td, []byte(arg))
+		if err != nil {
+			return nil, err
 		}
 
 		return cfgo.MarshalBinary()
@@ -204,9 +762,15 @@ func readConfig(td *target.Definition, arg string) ([]byte, error) {
 		if err != nil {
 			return nil, err
 		} else if len(cfg) < int(td.Config.MinSize) {
-			return nil, errors.New("Specified configuration too short")
+			return nil, &target.ConfigError{
+				Offset: len(cfg),
+				Err:    errors.New("Specified configuration too short"),
+			}
 		} else if len(cfg) > int(td.Config.WriteSize) {
-			return nil, errors.New("Specified configuration too long")
+			return nil, &target.ConfigError{
+				Offset: int(td.Config.WriteSize),
+				Err:    errors.New("Specified configuration too long"),
+			}
 		} else {
 			return cfg, nil
 		}
@@ -223,9 +787,9 @@ func readConfig(td *target.Definition, arg string) ([]byte, error) {
 			return nil, err
 		}
 
-		cfgo := td.Config.NewConfig()
-		if err := json.Unmarshal(buf, cfgo); err != nil {
-			return nil, fmt.Errorf("Parsing configuration: %s", err)
+		cfgo, err := parseConfigJSON(td, buf)
+		if err != nil {
+			return nil, err
 		}
 
 		return cfgo.MarshalBinary()
@@ -247,40 +811,182 @@ func NewTargetData(td *target.Definition) *TargetData {
 	return d
 }
 
+// Returns the target's default configuration (as if all configuration
+// bytes were erased)
+func defaultConfig(td *target.Definition) ([]byte, error) {
+	buf := make([]byte, td.Config.WriteSize)
+	for i := range buf {
+		buf[i] = 0xFF
+	}
+
+	cfgo, err := td.Config.Decode(buf)
+	if err != nil {
+		return nil, err
+	}
+	return cfgo.MarshalBinary()
+}
+
+// Applies a list of field=value assignments to the configuration
+func applyConfigSets(td *target.Definition, config []byte, sets []string) ([]byte, error) {
+	cfgo, err := td.Config.Decode(config)
+	if err != nil {
+		return nil, err
+	}
+
+	buf, err := json.Marshal(cfgo)
+	if err != nil {
+		return nil, err
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(buf, &fields); err != nil {
+		return nil, err
+	}
+
+	for _, set := range sets {
+		i := strings.IndexByte(set, '=')
+		if i < 0 {
+			return nil, fmt.Errorf("'%s' not understood for set parameter; expected field=value", set)
+		}
+		name, value := strings.TrimSpace(set[:i]), strings.TrimSpace(set[i+1:])
+
+		old, ok := fields[name]
+		switch {
+		case !ok:
+			return nil, unknownFieldError(td, name)
+		case len(old) > 0 && old[0] == '"':
+			fields[name], _ = json.Marshal(value)
+		case json.Valid([]byte(value)):
+			fields[name] = json.RawMessage(value)
+		default:
+			return nil, &target.ConfigError{Field: name, Offset: -1, Err: fmt.Errorf("Invalid value '%s'", value)}
+		}
+	}
+
+	buf, err = json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+
+	cfgo, err = parseConfigJSON(td, buf)
+	if err != nil {
+		return nil, err
+	}
+	return cfgo.MarshalBinary()
+}
+
+// Warns if the configuration given explicitly differs from that in the image
+func warnConfigOverride(td *target.Definition, imageConfig, config []byte) error {
+	diffs, err := configFieldDiffs(td, imageConfig, config)
+	if err != nil {
+		if !bytes.Equal(imageConfig, config) {
+			return warn("Configuration overrides the image's configuration (%X -> %X)", imageConfig, config)
+		}
+		return nil
+	}
+
+	if len(diffs) != 0 {
+		return warn("Configuration overrides the image's configuration:\n  %s", strings.Join(diffs, "\n  "))
+	}
+	return nil
+}
+
+// Determines the configuration to use. The base configuration is, in
+// order of preference:
+//
+//  1. that given by config (--config), which replaces any in the image
+//  2. that in the image (base, which may be empty)
+//  3. if any fields are set, the target's default configuration
+//
+// Field assignments (--set) are then applied on top of the base
+func resolveConfig(td *target.Definition, base []byte, config string, sets []string) ([]byte, error) {
+	var err error
+	if config != "" {
+		imageConfig := base
+		base, err = readConfig(td, config)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(imageConfig) != 0 {
+			if err := warnConfigOverride(td, imageConfig, base); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if len(sets) != 0 {
+		if len(base) == 0 {
+			base, err = defaultConfig(td)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		base, err = applyConfigSets(td, base, sets)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(base) == 0 {
+		return nil, errors.New("No configuration bytes specified in image or config parameter " +
+			"(use --set to start from the target's default configuration)")
+	}
+	return base, nil
+}
+
 func ReadTargetData(
-	config, image, aprom, ldrom string,
+	config string, sets []string,
+	image, aprom, ldrom string,
+	td *target.Definition,
+	needImage bool,
+) (*TargetData, error) {
+	return readTargetData(config, sets, image, aprom, ldrom, td, needImage, readOptions{})
+}
+
+// As ReadTargetData, with options for reading the inputs
+func readTargetData(
+	config string, sets []string,
+	image, aprom, ldrom string,
 	td *target.Definition,
 	needImage bool,
+	opts readOptions,
 ) (*TargetData, error) {
 	var err error
 	d := NewTargetData(td)
 
-	if image == "" && aprom == "" && ldrom == "" && needImage {
+	switch {
+	case needImage && image == "" && aprom == "" && ldrom == "":
 		return nil, errors.New("No input files specified")
-	} else if image == "" && aprom == "" && ldrom == "" {
+	case image != "" && aprom != "" && ldrom != "":
 		return nil, errors.New("Can only specify maximum of two of Image, APROM and LDROM")
 	}
 
+	stdinUsers := 0
+	for _, arg := range []string{config, image, aprom, ldrom} {
+		if arg == "-" || arg == "@-" {
+			stdinUsers++
+		}
+	}
+	if stdinUsers > 1 {
+		return nil, errors.New("Only one input may be read from stdin")
+	}
+
 	if image != "" {
 		rd, err := openRead(image)
 		if err != nil {
 			return nil, err
 		}
 
-		if err := d.read(rd, 0, uint32(td.ProgMemSize), true, "image"); err != nil {
-			return nil, err
-		}
-	}
-
-	if config != "" {
-		d.Config, err = readConfig(td, config)
-		if err != nil {
+		if err := d.read(rd, 0, uint32(td.ProgMemSize), opts, true, "image"); err != nil {
 			return nil, err
 		}
 	}
 
-	if len(d.Config) == 0 {
-		return nil, errors.New("No configuration bytes specified in image or config parameter")
+	d.Config, err = resolveConfig(td, d.Config, config, sets)
+	if err != nil {
+		return nil, err
 	}
 
 	cfgo := td.Config.NewConfig()
@@ -301,11 +1007,12 @@ func ReadTargetData(
 			return nil, err
 		}
 
-		for i := 0; i < int(apromSz); i++ {
+		// Unless checking for overlaps, APROM replaces that of the image
+		for i := 0; i < int(apromSz) && !opts.rejectOverlaps; i++ {
 			d.Data[i] = 0xFF
 		}
 
-		if err := d.read(rd, 0, uint32(apromSz), true, "aprom"); err != nil {
+		if err := d.read(rd, 0, uint32(apromSz), opts, false, "aprom"); err != nil {
 			return nil, err
 		}
 	}
@@ -316,14 +1023,38 @@ func ReadTargetData(
 			return nil, err
 		}
 
-		for i := apromSz; i < td.ProgMemSize; i++ {
+		for i := apromSz; i < td.ProgMemSize && !opts.rejectOverlaps; i++ {
 			d.Data[i] = 0xFF
 		}
 
-		if err := d.read(rd, uint32(apromSz), uint32(ldromSz), true, "ldrom"); err != nil {
+		if err := d.read(rd, uint32(apromSz), uint32(ldromSz), opts, false, "ldrom"); err != nil {
+			return nil, err
+		}
+	}
+
+	if aprom != "" {
+		if err := warnIfSwapped(d, cfgo); err != nil {
 			return nil, err
 		}
 	}
 
 	return d, nil
 }
+
+// Opcode of the 8051 LJMP instruction, normally found at the reset vector
+const opLJMP = 0x02
+
+// Warns if APROM's reset vector jumps into LDROM, which suggests that an
+// LDROM (bootloader) image was given as APROM
+func warnIfSwapped(d *TargetData, cfg target.Config) error {
+	ldrom := d.TargetDefinition.Layout(cfg).LDROM
+	if ldrom.Size == 0 || len(d.Data) < 3 || d.Data[0] != opLJMP {
+		return nil
+	}
+
+	dest := uint(d.Data[1])<<8 | uint(d.Data[2])
+	if dest < ldrom.Start || dest > ldrom.End() {
+		return nil
+	}
+	return warn("APROM's reset vector jumps into LDROM (0x%04x); were --aprom and --ldrom swapped?", dest)
+}
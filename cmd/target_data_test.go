@@ -0,0 +1,424 @@
+// Copyright © 2019 Erin Shepherd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/erincandescent/nuvoprog/ihex"
+	"github.com/erincandescent/nuvoprog/target"
+)
+
+// Writes content to a file named name in a temporary directory, returning
+// its path
+func writeTemp(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadRejectOverlaps(t *testing.T) {
+	cases := []struct {
+		name    string
+		input   string
+		overlap bool
+	}{
+		{"ihex same values", ":020010001234A8\n:02001100345663\n:00000001FF\n", false},
+		{"ihex differing values", ":020010001234A8\n:010011009955\n:00000001FF\n", true},
+		{"srec same values", "S10500101234A4\nS10500101234A4\n", false},
+		{"srec differing values", "S10500101234A4\nS10400119951\n", true},
+	}
+
+	td := target.ByName("n76e003")
+	for _, c := range cases {
+		for _, reject := range []bool{false, true} {
+			d := NewTargetData(td)
+			err := d.read(ioutil.NopCloser(strings.NewReader(c.input)),
+				0, uint32(len(d.Data)), readOptions{rejectOverlaps: reject}, false, "image")
+
+			oerr, isOverlap := err.(*overlapError)
+			switch {
+			case reject && c.overlap && (!isOverlap || oerr.Address != 0x11):
+				t.Errorf("%s: expected overlap at 0x0011, got %v", c.name, err)
+			case (!reject || !c.overlap) && err != nil:
+				t.Errorf("%s (reject %v): %v", c.name, reject, err)
+			}
+		}
+	}
+}
+
+func TestReadRejectOverlapsAcrossInputs(t *testing.T) {
+	td := target.ByName("n76e003")
+	image := writeTemp(t, "image.ihx", ":020010001234A8\n:00000001FF\n")
+	same := writeTemp(t, "same.ihx", ":02001100345663\n:00000001FF\n")
+	differ := writeTemp(t, "differ.ihx", ":01001000559A\n:00000001FF\n")
+	opts := readOptions{rejectOverlaps: true}
+
+	d, err := readTargetData("FFFFFFFF", nil, image, same, "", td, true, opts)
+	if err != nil {
+		t.Fatal(err)
+	} else if d.Data[0x10] != 0x12 || d.Data[0x11] != 0x34 || d.Data[0x12] != 0x56 {
+		t.Errorf("Inputs not merged: % x", d.Data[0x10:0x13])
+	}
+
+	_, err = readTargetData("FFFFFFFF", nil, image, differ, "", td, true, opts)
+	if oerr, ok := err.(*overlapError); !ok || oerr.Address != 0x10 {
+		t.Errorf("Expected overlap at 0x0010, got %v", err)
+	}
+
+	// Without --reject-overlaps, APROM replaces the image
+	d, err = readTargetData("FFFFFFFF", nil, image, differ, "", td, true, readOptions{})
+	if err != nil {
+		t.Fatal(err)
+	} else if d.Data[0x10] != 0x55 || d.Data[0x11] != 0xFF {
+		t.Errorf("APROM did not replace image: % x", d.Data[0x10:0x12])
+	}
+}
+
+func TestReadSplitConfig(t *testing.T) {
+	d := NewTargetData(target.ByName("n76e003"))
+	input := "S208030004FFFFFFFFF4\nS2080300006FFBFFFF8C\n"
+	if err := d.read(ioutil.NopCloser(strings.NewReader(input)), 0, uint32(len(d.Data)), readOptions{}, true, "image"); err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := []byte{0x6F, 0xFB, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}; !bytes.Equal(d.Config, expected) {
+		t.Errorf("Config %X, expected %X", d.Config, expected)
+	}
+}
+
+func TestReadTracksWritten(t *testing.T) {
+	d := NewTargetData(target.ByName("n76e003"))
+	input := ":03001000FF1234A8\n:00000001FF\n"
+	if err := d.read(ioutil.NopCloser(strings.NewReader(input)), 0, uint32(len(d.Data)), readOptions{}, true, "image"); err != nil {
+		t.Fatal(err)
+	}
+
+	for addr := uint32(0x0e); addr < 0x15; addr++ {
+		expected := addr >= 0x10 && addr < 0x13
+		if d.isWritten(addr) != expected {
+			t.Errorf("isWritten(0x%04x) = %v, expected %v", addr, !expected, expected)
+		}
+	}
+}
+
+func TestUnclosedOutputsRemoved(t *testing.T) {
+	dest := writeTemp(t, "out.ihx", "original")
+
+	w, err := openWrite(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("partial")); err != nil {
+		t.Fatal(err)
+	}
+	removeUnclosedOutputs()
+
+	if buf, err := ioutil.ReadFile(dest); err != nil || string(buf) != "original" {
+		t.Errorf("Destination modified: %q, %v", buf, err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(filepath.Dir(dest), ".*.tmp")); len(files) != 0 {
+		t.Errorf("Temporary files left behind: %v", files)
+	}
+}
+
+// A writer which fails every write
+type failingWriter struct {
+	closed bool
+}
+
+func (w *failingWriter) Write(buf []byte) (int, error) {
+	return 0, errors.New("Write failed")
+}
+
+func (w *failingWriter) Close() error {
+	w.closed = true
+	return nil
+}
+
+func TestFailedWriteAborted(t *testing.T) {
+	dest := writeTemp(t, "out.bin", "original")
+	w, err := openWrite(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Fail the flush on Close, as a full disk would
+	fw := w.(*fileW)
+	fw.Writer = bufio.NewWriterSize(&failingWriter{}, 16)
+	if err := writeBinBlock(fw, make([]byte, 64)); err == nil {
+		t.Fatal("Write error not reported")
+	}
+
+	if buf, err := ioutil.ReadFile(dest); err != nil || string(buf) != "original" {
+		t.Errorf("Destination replaced after failed write: %q, %v", buf, err)
+	}
+}
+
+func TestEqual(t *testing.T) {
+	td := target.ByName("n76e003")
+	a := simImage(td, []byte{0x02, 0x00, 0x06})
+
+	if eq, blocks := a.Equal(simImage(td, []byte{0x02, 0x00, 0x06})); !eq || len(blocks) != 0 {
+		t.Errorf("Identical images: Equal = %v, %+v", eq, blocks)
+	}
+
+	b := simImage(td, []byte{0x02, 0x01, 0x07})
+	b.Data[0x100] = 0x22
+	eq, blocks := a.Equal(b)
+	expected := []ihex.Block{
+		{Address: 0x0001, Data: []byte{0x01, 0x07}},
+		{Address: 0x0100, Data: []byte{0x22}},
+	}
+	if eq || !reflect.DeepEqual(blocks, expected) {
+		t.Errorf("Differing data: Equal = %v, %+v; expected %+v", eq, blocks, expected)
+	}
+}
+
+func TestEqualConfig(t *testing.T) {
+	td := target.ByName("n76e003")
+	a := simImage(td, nil)
+
+	// Bit 6 of CONFIG0 is not used, so does not make a difference
+	b := simImage(td, nil)
+	b.Config[0] = 0xBF
+	if eq, blocks := a.Equal(b); !eq {
+		t.Errorf("Config differing in unused bits: Equal = %v, %+v", eq, blocks)
+	}
+
+	// Locked
+	b.Config[0] = 0xFD
+	eq, blocks := a.Equal(b)
+	expected := []ihex.Block{{Address: td.Config.IHexOffset, Data: b.Config}}
+	if eq || !reflect.DeepEqual(blocks, expected) {
+		t.Errorf("Differing config: Equal = %v, %+v; expected %+v", eq, blocks, expected)
+	}
+
+	// Bytes beyond the decoded region are compared directly
+	b = simImage(td, nil)
+	b.Config[5] = 0x00
+	if eq, _ := a.Equal(b); eq {
+		t.Error("Config differing beyond the decoded bytes compared equal")
+	}
+}
+
+// Replaces stdin with a pipe from which content can be read
+func pipeStdin(t *testing.T, content string) {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stdin := os.Stdin
+	os.Stdin = r
+	t.Cleanup(func() {
+		os.Stdin = stdin
+		r.Close()
+	})
+
+	go func() {
+		w.Write([]byte(content))
+		w.Close()
+	}()
+}
+
+func TestReadStdin(t *testing.T) {
+	td := target.ByName("n76e003")
+	pipeStdin(t, ":03000000020006F5\n:020000040003F7\n:040000007FFFFFFF80\n:00000001FF\n")
+
+	d, err := ReadTargetData("", nil, "-", "", "", td, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(d.Data[:4], []byte{0x02, 0x00, 0x06, 0xFF}) {
+		t.Errorf("Data begins %X", d.Data[:4])
+	}
+	if !bytes.Equal(d.Config[:4], []byte{0x7F, 0xFF, 0xFF, 0xFF}) {
+		t.Errorf("Config is %X", d.Config)
+	}
+}
+
+func TestReadStdinOnce(t *testing.T) {
+	td := target.ByName("n76e003")
+	pipeStdin(t, "")
+
+	if _, err := ReadTargetData("", nil, "", "-", "-", td, true); err == nil {
+		t.Error("Read two inputs from stdin")
+	}
+}
+
+func TestReadTargetDataInputs(t *testing.T) {
+	td := target.ByName("n76e003")
+	image := writeTemp(t, "image.ihx", ":03000000020006F5\n:020000040003F7\n:04000000FFFFFFFF00\n:00000001FF\n")
+	code := writeTemp(t, "code.ihx", ":03000000020006F5\n:00000001FF\n")
+	const noLDROM, withLDROM = "FFFFFFFF", "FFFBFFFF"
+
+	cases := []struct {
+		name                        string
+		config, image, aprom, ldrom string
+		needImage, ok               bool
+	}{
+		{"nothing", "", "", "", "", false, false},
+		{"nothing, image needed", "", "", "", "", true, false},
+		{"config only", noLDROM, "", "", "", false, true},
+		{"config only, image needed", noLDROM, "", "", "", true, false},
+		{"image", "", image, "", "", false, true},
+		{"image, image needed", "", image, "", "", true, true},
+		{"image and config", noLDROM, image, "", "", true, true},
+		{"APROM without config", "", "", code, "", true, false},
+		{"APROM and config", noLDROM, "", code, "", true, true},
+		{"APROM and image", "", image, code, "", true, true},
+		{"LDROM without LDROM config", noLDROM, "", "", code, true, false},
+		{"LDROM and config", withLDROM, "", "", code, true, true},
+		{"APROM, LDROM and config", withLDROM, "", code, code, true, true},
+		{"image, APROM and LDROM", withLDROM, image, code, code, true, false},
+	}
+	for _, c := range cases {
+		_, err := ReadTargetData(c.config, nil, c.image, c.aprom, c.ldrom, td, c.needImage)
+		if c.ok && err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		} else if !c.ok && err == nil {
+			t.Errorf("%s: expected an error", c.name)
+		}
+	}
+}
+
+func TestResolveConfigPrecedence(t *testing.T) {
+	td := target.ByName("n76e003")
+	image := []byte{0x7F, 0xFF, 0xFF, 0xFF}
+
+	cases := []struct {
+		name     string
+		image    []byte
+		config   string
+		sets     []string
+		expected []byte
+	}{
+		{"image", image, "", nil, []byte{0x7F, 0xFF, 0xFF, 0xFF}},
+		{"config replaces image", image, "EFFFFFFF", nil, []byte{0xEF, 0xFF, 0xFF, 0xFF}},
+		{"set on default", nil, "", []string{"locked=true"}, []byte{0xFD, 0xFF, 0xFF, 0xFF}},
+		{"set on image", image, "", []string{"locked=true"}, []byte{0x7D, 0xFF, 0xFF, 0xFF}},
+		{"set on config", image, "EFFFFFFF", []string{"locked=true"}, []byte{0xED, 0xFF, 0xFF, 0xFF}},
+	}
+	for _, c := range cases {
+		cfg, err := resolveConfig(td, c.image, c.config, c.sets)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		} else if len(cfg) < len(c.expected) || !bytes.Equal(cfg[:len(c.expected)], c.expected) {
+			t.Errorf("%s: config = %X, expected %X", c.name, cfg, c.expected)
+		}
+	}
+
+	if _, err := resolveConfig(td, nil, "", nil); err == nil {
+		t.Error("Resolved a configuration from nothing")
+	}
+}
+
+func TestRegionConfigIgnored(t *testing.T) {
+	td := target.ByName("n76e003")
+	// Program data and an erased configuration
+	aprom := writeTemp(t, "aprom.ihx", ":03000000020006F5\n:020000040003F7\n:04000000FFFFFFFF00\n:00000001FF\n")
+
+	d, err := ReadTargetData("7FFDFFFF", []string{"wdt=enabled"}, "", aprom, "", td, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []byte{0x7F, 0xFD, 0xFF, 0x5F}; !bytes.Equal(d.Config[:4], expected) {
+		t.Errorf("Config = %X, expected %X", d.Config, expected)
+	}
+	if !bytes.Equal(d.Data[:3], []byte{0x02, 0x00, 0x06}) {
+		t.Errorf("Data begins %X", d.Data[:3])
+	}
+
+	// The differing configuration is reported under --strict
+	defer func(s bool) { strict = s }(strict)
+	strict = true
+	if _, err := ReadTargetData("7FFDFFFF", nil, "", aprom, "", td, true); err == nil {
+		t.Error("Differing configuration in an APROM file ignored under --strict")
+	}
+}
+
+func TestRecordLengthFollowsPageSize(t *testing.T) {
+	td := *target.ByName("n76e003")
+	td.PageSize = 16
+	d := simImage(&td, bytes.Repeat([]byte{0x5A}, 32))
+
+	var buf bufferCloser
+	if err := d.WriteAPROM(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(buf.String(), ":10000000") {
+		t.Errorf("Expected 16 byte records, got\n%s", buf.String()[:40])
+	}
+}
+
+func TestOutputMode(t *testing.T) {
+	dir := t.TempDir()
+
+	// New files get the same mode as any other new file
+	probe, err := os.OpenFile(filepath.Join(dir, "probe"), os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	probe.Close()
+	fi, err := os.Stat(probe.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	newMode := fi.Mode().Perm()
+
+	// Replaced files keep their mode
+	existing := filepath.Join(dir, "existing.ihx")
+	if err := ioutil.WriteFile(existing, []byte("original"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(existing, 0664); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, mode := range map[string]os.FileMode{
+		filepath.Join(dir, "new.ihx"): newMode,
+		existing:                      0664,
+	} {
+		w, err := openWrite(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte("replaced")); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if fi, err := os.Stat(name); err != nil {
+			t.Error(err)
+		} else if fi.Mode().Perm() != mode {
+			t.Errorf("%s has mode %v, expected %v", filepath.Base(name), fi.Mode().Perm(), mode)
+		}
+	}
+}
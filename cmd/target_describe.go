@@ -0,0 +1,150 @@
+// Copyright © 2019 Erin Shepherd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/erincandescent/nuvoprog/target"
+	"github.com/spf13/cobra"
+)
+
+// Structured description of a target's memory map
+type targetDescription struct {
+	Name         string          `json:"name"`
+	Aliases      []string        `json:"aliases,omitempty"`
+	Family       string          `json:"family"`
+	DeviceID     string          `json:"device_id"`
+	ProgMemSize  uint            `json:"program_memory_size"`
+	LDROMOffset  uint            `json:"ldrom_offset"`
+	PageSize     uint            `json:"page_size"`
+	DefaultClock uint32          `json:"default_clock_khz"`
+	MaxClock     uint32          `json:"max_clock_khz,omitempty"`
+	Config       configSpaceDesc `json:"config"`
+	Spaces       []spaceDesc     `json:"spaces"`
+	Vectors      []vectorDesc    `json:"vectors,omitempty"`
+}
+
+type spaceDesc struct {
+	Name  string `json:"name"`
+	Space uint16 `json:"space"`
+	Size  uint32 `json:"size"`
+}
+
+type configSpaceDesc struct {
+	IHexOffset uint32 `json:"ihex_offset"`
+	MinSize    uint   `json:"min_size"`
+	ReadSize   uint8  `json:"read_size"`
+	WriteSize  uint8  `json:"write_size"`
+}
+
+type vectorDesc struct {
+	Name    string `json:"name"`
+	Address uint32 `json:"address"`
+}
+
+func describeTarget(td *target.Definition) targetDescription {
+	desc := targetDescription{
+		Name:         td.Name,
+		Aliases:      td.Aliases,
+		Family:       td.Family.String(),
+		DeviceID:     td.DeviceID.String(),
+		ProgMemSize:  td.ProgMemSize,
+		LDROMOffset:  td.LDROMOffset,
+		PageSize:     td.PageSize,
+		DefaultClock: td.DefaultClock,
+		MaxClock:     td.MaxClock,
+		Config: configSpaceDesc{
+			IHexOffset: td.Config.IHexOffset,
+			MinSize:    td.Config.MinSize,
+			ReadSize:   td.Config.ReadSize,
+			WriteSize:  td.Config.WriteSize,
+		},
+	}
+
+	for _, s := range td.MemorySpaces() {
+		desc.Spaces = append(desc.Spaces, spaceDesc{s.Name, uint16(s.Space), s.Size})
+	}
+
+	for _, v := range td.Vectors {
+		desc.Vectors = append(desc.Vectors, vectorDesc{v.Name, v.Address})
+	}
+	return desc
+}
+
+// targetDescribeCmd represents the target describe command
+var targetDescribeCmd = &cobra.Command{
+	Use:   "describe [target]",
+	Short: "Describe a target's memory map",
+	Long: `Prints the memory map of a target (by default, that given by --target):
+program memory size, LDROM offset, configuration space layout and the memory
+spaces which may be given to read and program --space`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 0 {
+			targetName = args[0]
+		}
+
+		td, err := lookupTarget()
+		if err != nil {
+			return err
+		}
+
+		desc := describeTarget(td)
+		if jsonOut, _ := cmd.Flags().GetBool("json"); jsonOut {
+			buf, err := json.MarshalIndent(desc, "", "    ")
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(buf))
+			return nil
+		}
+
+		fmt.Printf("%s", desc.Name)
+		if len(desc.Aliases) != 0 {
+			fmt.Printf(" (%s)", strings.Join(desc.Aliases, ", "))
+		}
+		fmt.Printf(": family %s, device ID %s\n", desc.Family, desc.DeviceID)
+		fmt.Printf("Program memory: 0x%04x bytes; LDROM at 0x%04x\n", desc.ProgMemSize, desc.LDROMOffset)
+		fmt.Printf("Page size:      %d bytes\n", desc.PageSize)
+		fmt.Printf("ICP clock:      %d kHz", desc.DefaultClock)
+		if desc.MaxClock != 0 {
+			fmt.Printf(" (maximum %d kHz)", desc.MaxClock)
+		}
+		fmt.Println()
+		fmt.Printf("Config:         image offset 0x%05x; %d bytes modeled, read %d, write %d\n",
+			desc.Config.IHexOffset, desc.Config.MinSize, desc.Config.ReadSize, desc.Config.WriteSize)
+
+		fmt.Println("Memory spaces:")
+		for _, s := range desc.Spaces {
+			fmt.Printf("    %-8s space 0x%04x, 0x%04x bytes\n", s.Name, s.Space, s.Size)
+		}
+
+		if len(desc.Vectors) != 0 {
+			fmt.Println("Vectors:")
+			for _, v := range desc.Vectors {
+				fmt.Printf("    0x%04x %s\n", v.Address, v.Name)
+			}
+		}
+		return nil
+	},
+}
+
+func init() {
+	targetCmd.AddCommand(targetDescribeCmd)
+	targetDescribeCmd.Flags().Bool("json", false, "Output as JSON")
+}
@@ -0,0 +1,79 @@
+// Copyright © 2019 Erin Shepherd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Expands {name} placeholders in an output filename template. Only the
+// placeholders named in vars are permitted
+func expandTemplate(tmpl string, vars map[string]string) (string, error) {
+	var out strings.Builder
+	for {
+		i := strings.IndexByte(tmpl, '{')
+		if i < 0 {
+			out.WriteString(tmpl)
+			break
+		}
+
+		j := strings.IndexByte(tmpl[i:], '}')
+		if j < 0 {
+			return "", fmt.Errorf("Unterminated placeholder in output template '%s'", tmpl)
+		}
+
+		name := tmpl[i+1 : i+j]
+		value, ok := vars[name]
+		if !ok {
+			return "", fmt.Errorf("Unknown placeholder '{%s}' in output template", name)
+		}
+
+		out.WriteString(tmpl[:i])
+		out.WriteString(value)
+		tmpl = tmpl[i+j+1:]
+	}
+
+	return out.String(), nil
+}
+
+// Returns the standard template variables for the current time and target
+func templateVars(targetName string) map[string]string {
+	now := time.Now()
+	return map[string]string{
+		"target": strings.ToLower(targetName),
+		"date":   now.Format("2006-01-02"),
+		"time":   now.Format("150405"),
+	}
+}
+
+// Returns the output filename: the expanded template, if given, or
+// otherwise name; relative names are placed in dir (if given)
+func outputName(dir, tmpl, name string, vars map[string]string) (string, error) {
+	if tmpl != "" {
+		var err error
+		name, err = expandTemplate(tmpl, vars)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if dir != "" && name != "-" && !filepath.IsAbs(name) {
+		name = filepath.Join(dir, name)
+	}
+	return name, nil
+}
@@ -0,0 +1,317 @@
+// Copyright © 2019 Erin Shepherd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/erincandescent/nuvoprog/protocol"
+	"github.com/erincandescent/nuvoprog/target"
+	"github.com/spf13/cobra"
+)
+
+// Returned when device contents do not match the expected data
+type mismatchError struct {
+	Region  string `json:"region"`
+	Address uint32 `json:"address"`
+}
+
+func (e *mismatchError) Error() string {
+	return fmt.Sprintf("Verification failed: %s differs at 0x%04x", e.Region, e.Address)
+}
+
+// Returned when the checksum of device contents does not match
+type checksumMismatchError struct {
+	Region   string `json:"region"`
+	Expected uint32 `json:"expected"`
+	Actual   uint32 `json:"actual"`
+}
+
+func (e *checksumMismatchError) Error() string {
+	return fmt.Sprintf("Verification failed: %s CRC32 is %08x, expected %08x", e.Region, e.Actual, e.Expected)
+}
+
+// Inclusive range of program space addresses
+type addrRange struct {
+	Start, End uint32
+}
+
+type addrRanges []addrRange
+
+func (rs addrRanges) contains(addr uint32) bool {
+	for _, r := range rs {
+		if addr >= r.Start && addr <= r.End {
+			return true
+		}
+	}
+	return false
+}
+
+// Parses an address range of the form start-end (inclusive)
+func parseAddrRange(arg string) (addrRange, error) {
+	i := strings.IndexByte(arg, '-')
+	if i < 0 {
+		return addrRange{}, fmt.Errorf("'%s' not understood as a range; expected start-end", arg)
+	}
+
+	start, err := strconv.ParseUint(strings.TrimSpace(arg[:i]), 0, 32)
+	if err != nil {
+		return addrRange{}, fmt.Errorf("'%s' not understood as a range; expected start-end", arg)
+	}
+	end, err := strconv.ParseUint(strings.TrimSpace(arg[i+1:]), 0, 32)
+	if err != nil || end < start {
+		return addrRange{}, fmt.Errorf("'%s' not understood as a range; expected start-end", arg)
+	}
+	return addrRange{uint32(start), uint32(end)}, nil
+}
+
+func parseAddrRanges(args []string) (addrRanges, error) {
+	var rs addrRanges
+	for _, arg := range args {
+		r, err := parseAddrRange(arg)
+		if err != nil {
+			return nil, err
+		}
+		rs = append(rs, r)
+	}
+	return rs, nil
+}
+
+// Compares expected and actual contents of a region, returning a
+// mismatchError describing the first difference
+func compareRegion(region string, base uint32, expected, actual []byte) error {
+	return compareRegionExcluding(region, base, expected, actual, nil)
+}
+
+// As compareRegion, ignoring any addresses in exclude
+func compareRegionExcluding(region string, base uint32, expected, actual []byte, exclude addrRanges) error {
+	for i := range expected {
+		if exclude.contains(base + uint32(i)) {
+			continue
+		}
+		if i >= len(actual) || expected[i] != actual[i] {
+			return &mismatchError{region, base + uint32(i)}
+		}
+	}
+	return nil
+}
+
+// Reads back the configuration and checks that its modeled (MinSize)
+// bytes match expected
+func verifyConfig(dev *protocol.Device, td *target.Definition, expected []byte) error {
+	cfg, err := dev.ReadMemory(protocol.ConfigSpace, 0, td.Config.ReadSize)
+	if err != nil {
+		return commsError{err}
+	}
+
+	if uint(len(expected)) > td.Config.MinSize {
+		expected = expected[:td.Config.MinSize]
+	}
+	return compareRegion("config", 0, expected, cfg)
+}
+
+// Verifies that the device contents match data. The device is read as by
+// ReadImage, but each part is compared as it is read so that a mismatch is
+// reported without reading the remainder
+func verifyTargetData(dev *protocol.Device, data *TargetData, pageSize, retries int, exclude addrRanges) error {
+	td := data.TargetDefinition
+	apromB, err := data.APROM()
+	if err != nil {
+		return err
+	}
+	ldromB, err := data.LDROM()
+	if err != nil {
+		return err
+	}
+
+	_, _, err = readImageVisiting(dev, td, pageSize, retries, orderSequential, func(region string, address uint32, page []byte) error {
+		switch region {
+		case "config":
+			expected := data.Config
+			if len(expected) > len(page) {
+				expected = expected[:len(page)]
+			}
+			return compareRegion(region, 0, expected, page)
+		case "APROM":
+			return compareRegionExcluding(region, address, apromB[address:address+uint32(len(page))], page, exclude)
+		default:
+			i := address - uint32(td.LDROMOffset)
+			return compareRegionExcluding(region, address, ldromB[i:i+uint32(len(page))], page, exclude)
+		}
+	})
+	return err
+}
+
+// Reads back program space page by page, comparing each page as it is
+// read so that a mismatch is reported without reading the remainder
+func verifyRange(dev *protocol.Device, region string, address uint32, expected []byte, pageSize, retries int, exclude addrRanges) error {
+	for i := 0; i < len(expected); i += pageSize {
+		n := len(expected) - i
+		if n > pageSize {
+			n = pageSize
+		}
+
+		buf := make([]byte, n)
+		addr := address + uint32(i)
+		if _, err := readRange(dev, protocol.ProgramSpace, addr, buf, pageSize, retries); err != nil {
+			return err
+		}
+		if err := compareRegionExcluding(region, addr, expected[i:i+n], buf, exclude); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifyCmd represents the verify command
+var verifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "Verify target device contents",
+	Long: `Verify that the contents of a target device match an image
+
+Ranges given with --exclude (e.g. for serial numbers or calibration data
+written after programming) are not compared. Addresses are as seen by the
+programmer, with LDROM at the target's LDROM offset. Excluded bytes are
+ignored whatever their value in the image, including fill (0xFF) bytes.
+
+With --checksum, no image is needed: the region given by --region is read
+and its CRC32 compared, as described in 'image checksum'. --exclude cannot be
+used with --checksum.
+
+Exits with status 2 if the contents do not match, or 3 if communication
+with the programmer or target failed`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		err := runVerify(cmd)
+		if jsonOut, _ := cmd.Flags().GetBool("json"); jsonOut {
+			// On mismatch, report where the contents differ
+			var data interface{}
+			switch err.(type) {
+			case *mismatchError, *checksumMismatchError:
+				data = err
+			}
+			return reportJSON(data, err)
+		}
+		return err
+	},
+}
+
+func runVerify(cmd *cobra.Command) error {
+	td, err := lookupTarget()
+	if err != nil {
+		return err
+	}
+
+	if cmd.Flags().Changed("checksum") {
+		if cmd.Flags().Changed("exclude") {
+			return errors.New("--exclude cannot be used with --checksum")
+		}
+		return verifyRegionChecksum(cmd, td)
+	}
+
+	config, _ := cmd.Flags().GetString("config")
+	image, _ := cmd.Flags().GetString("image")
+	aprom, _ := cmd.Flags().GetString("aprom")
+	ldrom, _ := cmd.Flags().GetString("ldrom")
+	retries, err := retryCount(cmd)
+	if err != nil {
+		return err
+	}
+	excludeArgs, _ := cmd.Flags().GetStringArray("exclude")
+	exclude, err := parseAddrRanges(excludeArgs)
+	if err != nil {
+		return err
+	}
+	data, err := ReadTargetData(config, nil, image, aprom, ldrom, td, true)
+	if err != nil {
+		return err
+	}
+
+	pgSize, err := pageSize(cmd, td)
+	if err != nil {
+		return err
+	}
+
+	dev, _, err := connectToTarget()
+	if err != nil {
+		return err
+	}
+	defer resetAndCloseDevice(dev)
+
+	return verifyTargetData(dev, data, pgSize, retries, exclude)
+}
+
+// Verifies the checksum of a region of the device against --checksum
+func verifyRegionChecksum(cmd *cobra.Command, td *target.Definition) error {
+	checksum, _ := cmd.Flags().GetString("checksum")
+	region, _ := cmd.Flags().GetString("region")
+	retries, err := retryCount(cmd)
+	if err != nil {
+		return err
+	}
+
+	expected, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(checksum), "0x"), 16, 32)
+	if err != nil {
+		return fmt.Errorf("'%s' not understood as a CRC32", checksum)
+	}
+
+	switch region {
+	case checksumAPROM, checksumLDROM, checksumAll:
+	default:
+		return fmt.Errorf("'%s' not understood for region; expected aprom, ldrom or all", region)
+	}
+
+	pgSize, err := pageSize(cmd, td)
+	if err != nil {
+		return err
+	}
+
+	dev, _, err := connectToTarget()
+	if err != nil {
+		return err
+	}
+	defer resetAndCloseDevice(dev)
+
+	d, _, err := readImage(dev, td, pgSize, retries, orderSequential)
+	if err != nil {
+		return err
+	}
+
+	actual, err := d.Checksum(region)
+	if err != nil {
+		return err
+	}
+
+	if actual != uint32(expected) {
+		return &checksumMismatchError{Region: region, Expected: uint32(expected), Actual: actual}
+	}
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(verifyCmd)
+	verifyCmd.Flags().StringP("image", "i", "", "Image file, e.g. image.ihx")
+	verifyCmd.Flags().StringP("config", "c", "", "Configuration, e.g. 6FFBFFFF or @config.json")
+	verifyCmd.Flags().StringP("aprom", "a", "", "APROM file e.g. aprom.ihx")
+	verifyCmd.Flags().StringP("ldrom", "l", "", "LDROM file e.g. ldrom.ihx")
+	verifyCmd.Flags().Int("page-size", 0, "Override the target's read page size")
+	verifyCmd.Flags().Int("retries", 3, "Number of times to retry each failed read")
+	verifyCmd.Flags().StringArray("exclude", nil, "Program space address range to ignore, e.g. 0x1F00-0x1FFF (repeatable)")
+	verifyCmd.Flags().String("checksum", "", "Verify against this CRC32 (hex) instead of an image")
+	verifyCmd.Flags().String("region", checksumAll, "Region to checksum: aprom, ldrom or all")
+	addJSONFlag(verifyCmd)
+}
@@ -0,0 +1,132 @@
+// Copyright © 2019 Erin Shepherd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/erincandescent/nuvoprog/protocol"
+	"github.com/erincandescent/nuvoprog/target"
+)
+
+func TestVerifyStopsAtFirstMismatch(t *testing.T) {
+	td := target.ByName("n76e003")
+	dev, sim := simDevice(td)
+	data := simImage(td, []byte{0x02, 0x00, 0x06})
+
+	err := verifyTargetData(dev, data, int(td.PageSize), 0, nil)
+	if e, ok := err.(*mismatchError); !ok || e.Address != 0 {
+		t.Fatalf("Expected mismatch at 0x0000, got %v", err)
+	}
+
+	pages := 0
+	for _, r := range simRequests(sim, protocol.CmdReadMemory) {
+		if r.Space == protocol.ProgramSpace {
+			pages++
+		}
+	}
+	if pages != 1 {
+		t.Errorf("Read %d pages after the first mismatched page", pages-1)
+	}
+}
+
+func TestVerifyConfigMismatch(t *testing.T) {
+	td := target.ByName("n76e003")
+	dev, _ := simDevice(td)
+	data := simImage(td, nil)
+	data.Config[1] = 0x00
+
+	err := verifyTargetData(dev, data, int(td.PageSize), 0, nil)
+	if e, ok := err.(*mismatchError); !ok || e.Region != "config" || e.Address != 1 {
+		t.Fatalf("Expected config mismatch at 0x0001, got %v", err)
+	}
+}
+
+func TestReadImage(t *testing.T) {
+	td := target.ByName("n76e003")
+	dev, sim := simDevice(td)
+	for i := range sim.Memory[protocol.ProgramSpace] {
+		sim.Memory[protocol.ProgramSpace][i] = byte(i)
+	}
+	sim.Memory[protocol.ConfigSpace][0] = 0x7F
+
+	d, err := ReadImage(dev, td)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(d.Data, sim.Memory[protocol.ProgramSpace][:len(d.Data)]) {
+		t.Error("Program memory differs from the device")
+	}
+	if !bytes.Equal(d.Config, sim.Memory[protocol.ConfigSpace][:td.Config.ReadSize]) {
+		t.Errorf("Config = %X, want %X", d.Config, sim.Memory[protocol.ConfigSpace][:td.Config.ReadSize])
+	}
+
+	// verify reads the device the same way
+	if err := verifyTargetData(dev, d, int(td.PageSize), 0, nil); err != nil {
+		t.Errorf("Verifying the image read from the device: %v", err)
+	}
+}
+
+func TestVerifyExclude(t *testing.T) {
+	td := target.ByName("n76e003")
+	dev, _ := simDevice(td)
+	data := simImage(td, []byte{0x02, 0x00, 0x06})
+
+	exclude, err := parseAddrRanges([]string{"0x0000-0x0002"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyTargetData(dev, data, int(td.PageSize), 0, exclude); err != nil {
+		t.Errorf("Excluded bytes were compared: %v", err)
+	}
+}
+
+// Benchmarks of verification by comparing each page as it is read, and
+// by reading the whole device before comparing. The simulated programmer
+// responds instantly, so these measure only the host side cost; with a
+// real programmer both are dominated by the time taken to read the device
+func benchmarkImage() (*target.Definition, *TargetData) {
+	td := target.ByName("n76e003")
+	return td, simImage(td, bytes.Repeat([]byte{0x5A}, int(td.ProgMemSize)))
+}
+
+func BenchmarkVerifyPipelined(b *testing.B) {
+	td, data := benchmarkImage()
+	dev, sim := simDevice(td)
+	copy(sim.Memory[protocol.ProgramSpace], data.Data)
+
+	for i := 0; i < b.N; i++ {
+		if err := verifyTargetData(dev, data, int(td.PageSize), 0, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkVerifyReadAll(b *testing.B) {
+	td, data := benchmarkImage()
+	dev, sim := simDevice(td)
+	copy(sim.Memory[protocol.ProgramSpace], data.Data)
+
+	for i := 0; i < b.N; i++ {
+		d, _, err := readImage(dev, td, int(td.PageSize), 0, orderSequential)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if !bytes.Equal(d.Data, data.Data) {
+			b.Fatal("Device contents differ")
+		}
+	}
+}
@@ -17,7 +17,11 @@ package ihex
 import (
 	"bufio"
 	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
 	"io"
+	"strings"
 )
 
 var (
@@ -26,8 +30,17 @@ var (
 	ErrInvalidEOL          = errors.New("Invalid line ending")
 	ErrInvalidChecksum     = errors.New("Invalid checksum")
 	ErrInvalidRecordLength = errors.New("Length invalid for record")
+	ErrInvalidTrailer      = errors.New("Invalid trailer")
+	ErrTrailerMismatch     = errors.New("Data does not match trailer length/CRC; file corrupt or truncated")
+	ErrAddressOverflow     = errors.New("Record extends past the end of the 32-bit address space")
 )
 
+// Prefix of the trailer comment optionally written after the EOF record.
+// The trailer records the length and CRC32 (IEEE) of all data bytes in
+// the order they appear in the file. Standard tools ignore anything after
+// the EOF record
+const trailerPrefix = ";nuvoprog "
+
 type PacketType byte
 
 const (
@@ -39,6 +52,25 @@ const (
 	StartLinearAddress
 )
 
+func (t PacketType) String() string {
+	switch t {
+	case Data:
+		return "Data"
+	case EOF:
+		return "EOF"
+	case ExtendedSegmentAddress:
+		return "ExtendedSegmentAddress"
+	case StartSegmentAddress:
+		return "StartSegmentAddress"
+	case ExtendedLinearAddress:
+		return "ExtendedLinearAddress"
+	case StartLinearAddress:
+		return "StartLinearAddress"
+	default:
+		return fmt.Sprintf("PacketType(%d)", byte(t))
+	}
+}
+
 type Packet struct {
 	Type    PacketType
 	Address uint16
@@ -73,7 +105,7 @@ func ExtendedLinearAddressPacket(seg uint16) Packet {
 	}
 }
 
-func readHexByte(rdr *bufio.Reader) (byte, error) {
+func readHexByte(rdr io.ByteReader) (byte, error) {
 	n0, err := rdr.ReadByte()
 	if err != nil {
 		return 0, err
@@ -109,7 +141,7 @@ func readHexByte(rdr *bufio.Reader) (byte, error) {
 	return b, nil
 }
 
-func readHexWord(rdr *bufio.Reader) (uint16, error) {
+func readHexWord(rdr io.ByteReader) (uint16, error) {
 	b0, err := readHexByte(rdr)
 	if err != nil {
 		return 0, err
@@ -122,6 +154,10 @@ func readHexWord(rdr *bufio.Reader) (uint16, error) {
 }
 
 func ReadPacket(rdr *bufio.Reader) (Packet, error) {
+	return readPacket(rdr)
+}
+
+func readPacket(rdr io.ByteReader) (Packet, error) {
 pfx:
 	for {
 		b, err := rdr.ReadByte()
@@ -234,10 +270,79 @@ func WritePacket(w io.Writer, p Packet) error {
 	return err
 }
 
+// Address range covered by a data record
+type Span struct {
+	Address uint32
+	Length  uint32
+}
+
+// Layout of the data records of a file, in the order they appear
+type Layout []Span
+
+// Returns the number of bytes from addr to the end of the record containing
+// it, and true; or, if no record contains addr, the number of bytes to the
+// start of the next record (or to the next recLen byte boundary, if sooner)
+// and false
+func (l Layout) recordAt(addr, recLen uint32) (uint32, bool) {
+	n := recLen - addr%recLen
+	for _, s := range l {
+		switch {
+		case addr >= s.Address && addr-s.Address < s.Length:
+			return s.Length - (addr - s.Address), true
+		case s.Address > addr && s.Address-addr < n:
+			n = s.Address - addr
+		}
+	}
+	return n, false
+}
+
+// Counts the lines of the bytes read through it
+type lineReader struct {
+	r         *bufio.Reader
+	line      int
+	pendingNL bool
+}
+
+func (l *lineReader) ReadByte() (byte, error) {
+	b, err := l.r.ReadByte()
+	if err != nil {
+		return b, err
+	}
+
+	if l.pendingNL {
+		l.line++
+	}
+	l.pendingNL = b == '\n'
+	return b, nil
+}
+
 type Reader struct {
-	r   *bufio.Reader
-	seg uint32
-	eof bool
+	// If set, a file which ends without an EOF record (e.g. one which was
+	// truncated) is an error. Otherwise the EOF record is optional, as for
+	// many other Intel Hex tools
+	RequireEOF bool
+
+	// If set, the address and length of each data record read is
+	// appended to Layout
+	KeepLayout bool
+	Layout     Layout
+
+	// If set, data records which are contiguous (by address, taking
+	// account of any segment or linear address records between them)
+	// are returned as a single block. Line then gives the line of the
+	// last record read, which may follow the block returned
+	Coalesce bool
+
+	// Record read ahead while coalescing, and any error encountered
+	pending *Block
+	err     error
+
+	r      *bufio.Reader
+	lr     lineReader
+	seg    uint32
+	eof    bool
+	length uint32
+	crc    hash.Hash32
 }
 
 type Block struct {
@@ -251,28 +356,129 @@ func NewReader(r io.Reader) *Reader {
 		br = bufio.NewReader(r)
 	}
 
-	return &Reader{br, 0, false}
+	return &Reader{r: br, lr: lineReader{r: br, line: 1}, crc: crc32.NewIEEE()}
+}
+
+// Line returns the line number of the record most recently read or, after
+// an error, of the line on which it was found
+func (r *Reader) Line() int {
+	return r.lr.line
+}
+
+// Checks the trailer following the EOF record, if present
+func (r *Reader) checkTrailer() error {
+	b, err := r.r.ReadByte()
+	for err == nil && (b == '\r' || b == '\n') {
+		b, err = r.r.ReadByte()
+	}
+
+	switch {
+	case err == io.EOF:
+		return nil
+	case err != nil:
+		return err
+	case b != ';':
+		return nil
+	}
+
+	line, err := r.r.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+	line = ";" + strings.TrimSpace(line)
+
+	if !strings.HasPrefix(line, trailerPrefix) {
+		return nil
+	}
+
+	var length, crc uint32
+	if _, err := fmt.Sscanf(line[len(trailerPrefix):], "length=%d crc32=%x", &length, &crc); err != nil {
+		return ErrInvalidTrailer
+	}
+
+	if length != r.length || crc != r.crc.Sum32() {
+		return ErrTrailerMismatch
+	}
+	return nil
 }
 
 func (r *Reader) Next() (Block, error) {
+	if !r.Coalesce {
+		return r.next()
+	}
+
+	var b Block
+	switch {
+	case r.pending != nil:
+		b, r.pending = *r.pending, nil
+	case r.err != nil:
+		return Block{}, r.err
+	default:
+		var err error
+		if b, err = r.next(); err != nil {
+			return Block{}, err
+		}
+	}
+
+	b.Data = append([]byte(nil), b.Data...)
+	for {
+		next, err := r.next()
+		if err != nil {
+			// Return the error after the data read so far
+			r.err = err
+			return b, nil
+		}
+
+		if uint64(b.Address)+uint64(len(b.Data)) != uint64(next.Address) {
+			r.pending = &next
+			return b, nil
+		}
+		b.Data = append(b.Data, next.Data...)
+	}
+}
+
+func (r *Reader) next() (Block, error) {
 	if r.eof {
 		return Block{}, io.EOF
 	}
 
 	for {
-		p, err := ReadPacket(r.r)
-		if err != nil {
+		p, err := readPacket(&r.lr)
+		if err == io.EOF {
+			// File ended without an EOF record
+			r.eof = true
+			if r.RequireEOF {
+				return Block{}, io.ErrUnexpectedEOF
+			}
+			return Block{}, io.EOF
+		} else if err != nil {
 			return Block{}, err
 		}
 
 		switch p.Type {
 		case Data:
+			// Data may not wrap around the top of the address space
+			if uint64(r.seg)+uint64(p.Address)+uint64(len(p.Data)) > 1<<32 {
+				return Block{}, ErrAddressOverflow
+			}
+
+			r.length += uint32(len(p.Data))
+			r.crc.Write(p.Data)
+			if r.KeepLayout {
+				r.Layout = append(r.Layout, Span{
+					Address: r.seg + uint32(p.Address),
+					Length:  uint32(len(p.Data)),
+				})
+			}
 			return Block{
 				Address: r.seg + uint32(p.Address),
 				Data:    p.Data,
 			}, nil
 		case EOF:
 			r.eof = true
+			if err := r.checkTrailer(); err != nil {
+				return Block{}, err
+			}
 			return Block{}, io.EOF
 		case ExtendedSegmentAddress:
 			if len(p.Data) != 2 {
@@ -293,16 +499,58 @@ func (r *Reader) Next() (Block, error) {
 }
 
 type Writer struct {
-	w   io.WriteCloser
-	seg uint32
+	// If set, a trailer recording the length and CRC of the data is
+	// written after the EOF record so that truncation can be detected
+	Trailer bool
+
+	// If set, data records consisting entirely of Fill bytes are omitted
+	// (e.g. to skip erased flash)
+	SkipFill bool
+	// Fill byte used by SkipFill
+	Fill byte
+
+	// Maximum length of data records (up to 255). Records are aligned to
+	// multiples of this length. Defaults to DefaultRecordLength
+	RecordLength int
+
+	// If set, data is split into records at the same boundaries as the
+	// records in Layout (e.g. as retained by a Reader), rather than into
+	// RecordLength byte records. Data outside of Layout's records is written
+	// in RecordLength byte records, omitting any consisting entirely of Fill
+	// bytes
+	Layout Layout
+
+	w      io.WriteCloser
+	seg    uint32
+	length uint32
+	crc    hash.Hash32
 }
 
+// Record length used by Writers unless otherwise specified
+const DefaultRecordLength = 32
+
 func NewWriter(w io.WriteCloser) *Writer {
-	return &Writer{w, 0}
+	return &Writer{w: w, Fill: 0xFF, RecordLength: DefaultRecordLength, crc: crc32.NewIEEE()}
+}
+
+func (w *Writer) recordLength() uint32 {
+	if w.RecordLength <= 0 || w.RecordLength > 255 {
+		return DefaultRecordLength
+	}
+	return uint32(w.RecordLength)
+}
+
+func (w *Writer) isFill(buf []byte) bool {
+	for _, b := range buf {
+		if b != w.Fill {
+			return false
+		}
+	}
+	return true
 }
 
 func (w *Writer) write(addr uint32, buf []byte) error {
-	if len(buf) == 0 {
+	if len(buf) == 0 || (w.SkipFill && w.isFill(buf)) {
 		return nil
 	}
 
@@ -316,41 +564,92 @@ func (w *Writer) write(addr uint32, buf []byte) error {
 		}
 	}
 
+	// Record addresses wrap within the segment, so a record may not cross
+	// a 64K boundary (as it may when the record length does not divide 64K)
+	if n := 0x10000 - off; uint32(len(buf)) > n {
+		if err := w.write(addr, buf[:n]); err != nil {
+			return err
+		}
+		return w.write(addr+n, buf[n:])
+	}
+
+	w.length += uint32(len(buf))
+	w.crc.Write(buf)
 	return WritePacket(w.w, DataPacket(uint16(off), buf))
 }
 
 func (w *Writer) Write(addr uint32, buf []byte) error {
-	lead := int(32 - (addr & 31))
-	if addr&31 != 0 && len(buf) > lead {
+	if w.Layout != nil {
+		return w.writeLayout(addr, buf)
+	}
+
+	n := w.recordLength()
+	lead := n - addr%n
+	if addr%n != 0 && uint32(len(buf)) > lead {
 		if err := w.write(addr, buf[:lead]); err != nil {
 			return err
 		}
-		addr += uint32(lead)
+		addr += lead
 		buf = buf[lead:]
 	}
 
-	for len(buf) > 32 {
-		if err := w.write(addr, buf[:32]); err != nil {
+	for uint32(len(buf)) > n {
+		if err := w.write(addr, buf[:n]); err != nil {
 			return err
 		}
-		addr += 32
-		buf = buf[32:]
+		addr += n
+		buf = buf[n:]
 	}
 
 	return w.write(addr, buf)
 }
 
+func (w *Writer) writeLayout(addr uint32, buf []byte) error {
+	for len(buf) > 0 {
+		n, inRecord := w.Layout.recordAt(addr, w.recordLength())
+		if n > uint32(len(buf)) {
+			n = uint32(len(buf))
+		}
+
+		if inRecord || !w.isFill(buf[:n]) {
+			if err := w.write(addr, buf[:n]); err != nil {
+				return err
+			}
+		}
+		addr += n
+		buf = buf[n:]
+	}
+	return nil
+}
+
 func (w *Writer) WriteBlock(b Block) {
 	w.Write(b.Address, b.Data)
 }
 
+// Flush flushes any data buffered by the underlying writer (if it
+// supports flushing), without writing the EOF record or closing it
+func (w *Writer) Flush() error {
+	if f, ok := w.w.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// Close writes the EOF record (and trailer, if enabled) and closes the
+// underlying writer. If writing fails, the underlying writer is left open
+// so that the caller may discard the incomplete output
 func (w *Writer) Close() error {
 	if err := WritePacket(w.w, EOFPacket()); err != nil {
-		w.w.Close()
-		w.w = nil
 		return err
 	}
 
+	if w.Trailer {
+		trailer := fmt.Sprintf("%slength=%d crc32=%08x\n", trailerPrefix, w.length, w.crc.Sum32())
+		if _, err := io.WriteString(w.w, trailer); err != nil {
+			return err
+		}
+	}
+
 	err := w.w.Close()
 	w.w = nil
 	return err
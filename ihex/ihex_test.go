@@ -0,0 +1,446 @@
+// Copyright © 2019 Erin Shepherd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ihex
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+// A buffer recording whether it was closed
+type buffer struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (b *buffer) Close() error {
+	b.closed = true
+	return nil
+}
+
+// Reads all blocks from an Intel Hex file
+func readAll(in string) ([]Block, error) {
+	return readAllFrom(NewReader(strings.NewReader(in)))
+}
+
+func readAllFrom(r *Reader) ([]Block, error) {
+	var blocks []Block
+	for {
+		b, err := r.Next()
+		if err == io.EOF {
+			return blocks, nil
+		} else if err != nil {
+			return blocks, err
+		}
+		blocks = append(blocks, b)
+	}
+}
+
+func TestAddressOverflow(t *testing.T) {
+	// Ends at the very top of the address space
+	blocks, err := readAll(":02000004FFFFFC\n:10FFF000AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA61\n:00000001FF\n")
+	if err != nil {
+		t.Fatalf("Record ending at 0xFFFFFFFF: %v", err)
+	} else if len(blocks) != 1 || blocks[0].Address != 0xFFFFFFF0 {
+		t.Errorf("Record ending at 0xFFFFFFFF read as %+v", blocks)
+	}
+
+	// Wraps around to 0x00000000
+	_, err = readAll(":02000004FFFFFC\n:10FFF800AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA59\n:00000001FF\n")
+	if err != ErrAddressOverflow {
+		t.Errorf("Record wrapping past 0xFFFFFFFF: got %v, expected ErrAddressOverflow", err)
+	}
+}
+
+func TestSegmentNearTop(t *testing.T) {
+	// The highest segment address does not wrap within 16 or 20 bits
+	blocks, err := readAll(":02000002FFFFFE\n:01FFFF00AA57\n:00000001FF\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks) != 1 || blocks[0].Address != 0x10FFEF {
+		t.Errorf("Read %+v, expected a block at 0x10FFEF", blocks)
+	}
+}
+
+// Writes buf at addr with a Writer configured by setup, returning the output
+func writeImage(t *testing.T, addr uint32, buf []byte, setup func(w *Writer)) string {
+	t.Helper()
+	var b buffer
+	w := NewWriter(&b)
+	if setup != nil {
+		setup(w)
+	}
+	if err := w.Write(addr, buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.String()
+}
+
+// Returns n bytes of test data
+func testData(n int) []byte {
+	buf := make([]byte, n)
+	for i := range buf {
+		buf[i] = byte(i*7 + 1)
+	}
+	return buf
+}
+
+func TestTrailerRoundTrip(t *testing.T) {
+	data := testData(100)
+	out := writeImage(t, 0x1000, data, func(w *Writer) { w.Trailer = true })
+	if !strings.Contains(out, ":00000001FF\n;nuvoprog length=100 crc32=") {
+		t.Fatalf("No trailer after the EOF record:\n%s", out)
+	}
+
+	r := NewReader(strings.NewReader(out))
+	r.Coalesce = true
+	blocks, err := readAllFrom(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks) != 1 || blocks[0].Address != 0x1000 || !bytes.Equal(blocks[0].Data, data) {
+		t.Errorf("Read back %+v", blocks)
+	}
+}
+
+func TestTrailerMismatch(t *testing.T) {
+	out := writeImage(t, 0, testData(64), func(w *Writer) { w.Trailer = true })
+
+	// Drop the second data record, leaving the EOF record and trailer
+	lines := strings.SplitAfter(out, "\n")
+	truncated := lines[0] + strings.Join(lines[2:], "")
+	if _, err := readAll(truncated); err != ErrTrailerMismatch {
+		t.Errorf("Record missing: got %v, expected ErrTrailerMismatch", err)
+	}
+
+	corrupt := strings.Replace(out, "length=64", "length=65", 1)
+	if _, err := readAll(corrupt); err != ErrTrailerMismatch {
+		t.Errorf("Length altered: got %v, expected ErrTrailerMismatch", err)
+	}
+
+	invalid := strings.Replace(out, "length=64", "length=x", 1)
+	if _, err := readAll(invalid); err != ErrInvalidTrailer {
+		t.Errorf("Invalid trailer: got %v, expected ErrInvalidTrailer", err)
+	}
+
+	// Other comments are ignored
+	other := strings.Replace(out, ";nuvoprog", ";other", 1)
+	if _, err := readAll(other); err != nil {
+		t.Errorf("Other comment: %v", err)
+	}
+}
+
+func TestMissingEOF(t *testing.T) {
+	out := writeImage(t, 0, testData(64), func(w *Writer) { w.Trailer = true })
+	truncated := out[:strings.Index(out, ":00000001FF")]
+
+	// The EOF record is optional unless required
+	blocks, err := readAll(truncated)
+	if err != nil {
+		t.Errorf("Missing EOF record: %v", err)
+	} else if len(blocks) != 2 {
+		t.Errorf("Read %d blocks, expected 2", len(blocks))
+	}
+
+	r := NewReader(strings.NewReader(truncated))
+	r.RequireEOF = true
+	if _, err := readAllFrom(r); err != io.ErrUnexpectedEOF {
+		t.Errorf("Missing EOF record with RequireEOF: got %v, expected io.ErrUnexpectedEOF", err)
+	}
+
+	r = NewReader(strings.NewReader(out))
+	r.RequireEOF = true
+	if _, err := readAllFrom(r); err != nil {
+		t.Errorf("Complete file with RequireEOF: %v", err)
+	}
+}
+
+func TestRecordLength(t *testing.T) {
+	tests := []struct {
+		length   int
+		expected uint32
+	}{
+		{16, 16},
+		{64, 64},
+		{255, 255},
+		{20, 20}, // does not divide 64K
+		{0, DefaultRecordLength},
+		{-1, DefaultRecordLength},
+		{256, DefaultRecordLength},
+	}
+
+	for _, tt := range tests {
+		// Unaligned, and crossing a 64K boundary
+		addr := uint32(0xFF05)
+		data := testData(1000)
+		out := writeImage(t, addr, data, func(w *Writer) { w.RecordLength = tt.length })
+
+		blocks, err := readAll(out)
+		if err != nil {
+			t.Errorf("RecordLength %d: %v", tt.length, err)
+			continue
+		}
+
+		var read []byte
+		for i, b := range blocks {
+			if b.Address != addr+uint32(len(read)) {
+				t.Errorf("RecordLength %d: record %d at 0x%X, expected 0x%X",
+					tt.length, i, b.Address, addr+uint32(len(read)))
+			}
+			if uint32(len(b.Data)) > tt.expected {
+				t.Errorf("RecordLength %d: record %d is %d bytes long", tt.length, i, len(b.Data))
+			}
+			if i > 0 && b.Address%tt.expected != 0 && b.Address%0x10000 != 0 {
+				t.Errorf("RecordLength %d: record %d at 0x%X is unaligned", tt.length, i, b.Address)
+			}
+			if b.Address>>16 != (b.Address+uint32(len(b.Data))-1)>>16 {
+				t.Errorf("RecordLength %d: record %d at 0x%X crosses a 64K boundary", tt.length, i, b.Address)
+			}
+			read = append(read, b.Data...)
+		}
+		if !bytes.Equal(read, data) {
+			t.Errorf("RecordLength %d: read back %X", tt.length, read)
+		}
+	}
+}
+
+func TestSkipFill(t *testing.T) {
+	// Erased, except for a few runs of data
+	image := bytes.Repeat([]byte{0xFF}, 0x400)
+	copy(image[0x10:], testData(40))
+	copy(image[0x200:], testData(3))
+	image[0x3FF] = 0x00
+
+	out := writeImage(t, 0, image, func(w *Writer) { w.SkipFill = true })
+	blocks, err := readAll(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	padded := bytes.Repeat([]byte{0xFF}, len(image))
+	for _, b := range blocks {
+		if bytes.Count(b.Data, []byte{0xFF}) == len(b.Data) {
+			t.Errorf("Erased record at 0x%X written", b.Address)
+		}
+		copy(padded[b.Address:], b.Data)
+	}
+	if len(blocks) != 4 {
+		t.Errorf("Wrote %d records, expected 4", len(blocks))
+	}
+	if !bytes.Equal(padded, image) {
+		t.Errorf("Read back and padded:\n%X\nexpected:\n%X", padded, image)
+	}
+}
+
+// Returns an Intel Hex file of the given records, followed by an EOF record
+func hexFile(t *testing.T, packets ...Packet) string {
+	t.Helper()
+	var b strings.Builder
+	for _, p := range append(packets, EOFPacket()) {
+		if err := WritePacket(&b, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return b.String()
+}
+
+func TestCoalesce(t *testing.T) {
+	data := testData(64)
+	in := hexFile(t,
+		// Adjacent
+		DataPacket(0x0000, data[:7]),
+		DataPacket(0x0007, data[7:20]),
+		// Overlapping
+		DataPacket(0x0030, data[:4]),
+		DataPacket(0x0032, data[4:8]),
+		// Out of order
+		DataPacket(0x0010, data[8:12]),
+		// Adjacent across a 64K boundary
+		DataPacket(0xFFF8, data[:8]),
+		ExtendedLinearAddressPacket(0x0001),
+		DataPacket(0x0000, data[8:16]),
+	)
+
+	r := NewReader(strings.NewReader(in))
+	r.Coalesce = true
+	blocks, err := readAllFrom(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Block{
+		{0x0000, data[:20]},
+		{0x0030, data[:4]},
+		{0x0032, data[4:8]},
+		{0x0010, data[8:12]},
+		{0xFFF8, data[:16]},
+	}
+	if len(blocks) != len(expected) {
+		t.Fatalf("Read %+v, expected %+v", blocks, expected)
+	}
+	for i, b := range blocks {
+		if b.Address != expected[i].Address || !bytes.Equal(b.Data, expected[i].Data) {
+			t.Errorf("Block %d is %+v, expected %+v", i, b, expected[i])
+		}
+	}
+}
+
+func TestLayoutRoundTrip(t *testing.T) {
+	data := testData(64)
+	tests := []struct {
+		name string
+		in   string
+	}{
+		{"adjacent", hexFile(t,
+			DataPacket(0x0000, data[:7]),
+			DataPacket(0x0007, data[7:20]),
+			DataPacket(0x001B, data[20:64]),
+		)},
+		{"out of order", hexFile(t,
+			DataPacket(0x0020, data[:5]),
+			DataPacket(0x0000, data[5:14]),
+			DataPacket(0x0009, data[14:17]),
+		)},
+	}
+
+	for _, tt := range tests {
+		r := NewReader(strings.NewReader(tt.in))
+		r.Coalesce = true
+		r.KeepLayout = true
+		blocks, err := readAllFrom(r)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+
+		var b buffer
+		w := NewWriter(&b)
+		w.Layout = r.Layout
+		for _, blk := range blocks {
+			if err := w.Write(blk.Address, blk.Data); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if b.String() != tt.in {
+			t.Errorf("%s: rewritten as\n%s\nexpected\n%s", tt.name, b.String(), tt.in)
+		}
+	}
+}
+
+func TestLayoutOverlapping(t *testing.T) {
+	data := testData(16)
+	r := NewReader(strings.NewReader(hexFile(t,
+		DataPacket(0x0000, data[:8]),
+		DataPacket(0x0004, data[8:16]),
+	)))
+	r.KeepLayout = true
+
+	// Later records take precedence
+	image := bytes.Repeat([]byte{0xFF}, 0x20)
+	for {
+		b, err := r.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		copy(image[b.Address:], b.Data)
+	}
+
+	out := writeImage(t, 0, image, func(w *Writer) { w.Layout = r.Layout })
+	blocks, err := readAll(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The overlapping records cannot be reproduced, but their data is
+	expected := []Block{{0x0000, image[:8]}, {0x0008, image[8:12]}}
+	if len(blocks) != len(expected) {
+		t.Fatalf("Wrote %+v, expected %+v", blocks, expected)
+	}
+	for i, b := range blocks {
+		if b.Address != expected[i].Address || !bytes.Equal(b.Data, expected[i].Data) {
+			t.Errorf("Record %d is %+v, expected %+v", i, b, expected[i])
+		}
+	}
+}
+
+// A buffered writer which may be flushed, recording what has been flushed
+type flushBuffer struct {
+	*bufio.Writer
+	out buffer
+}
+
+func newFlushBuffer() *flushBuffer {
+	b := new(flushBuffer)
+	b.Writer = bufio.NewWriterSize(&b.out, 4096)
+	return b
+}
+
+func (b *flushBuffer) Close() error {
+	if err := b.Flush(); err != nil {
+		return err
+	}
+	return b.out.Close()
+}
+
+func TestFlush(t *testing.T) {
+	data := testData(100)
+	b := newFlushBuffer()
+	w := NewWriter(b)
+	if err := w.Write(0x1000, data); err != nil {
+		t.Fatal(err)
+	}
+	if b.out.Len() != 0 {
+		t.Fatal("Output not buffered")
+	}
+
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	flushed := b.out.String()
+
+	// The data written so far is complete, lacking only the EOF record
+	r := NewReader(strings.NewReader(flushed))
+	r.Coalesce = true
+	blocks, err := readAllFrom(r)
+	if err != nil {
+		t.Fatalf("Reading flushed output: %v", err)
+	}
+	if len(blocks) != 1 || blocks[0].Address != 0x1000 || !bytes.Equal(blocks[0].Data, data) {
+		t.Errorf("Flushed output read as %+v", blocks)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if out := b.out.String(); out != flushed+":00000001FF\n" {
+		t.Errorf("Closing after Flush wrote\n%s\nexpected\n%s:00000001FF", out, flushed)
+	}
+	if !b.out.closed {
+		t.Error("Underlying writer not closed")
+	}
+}
@@ -17,6 +17,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"log"
 )
@@ -25,7 +26,7 @@ func unmarshal(buf []byte, dst interface{}) error {
 	return binary.Read(bytes.NewReader(buf), binary.LittleEndian, dst)
 }
 
-func marshalCommand(cmd uint32, body interface{}) ([]byte, error) {
+func marshalCommand(cmd CommandCode, body interface{}) ([]byte, error) {
 	buf := new(bytes.Buffer)
 	if err := binary.Write(buf, binary.LittleEndian, cmd); err != nil {
 		return nil, err
@@ -36,25 +37,56 @@ func marshalCommand(cmd uint32, body interface{}) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
-func checkResp(cmd uint32, buf []byte) error {
-	var respc uint32
-	if err := unmarshal(buf, &respc); err != nil {
-		return err
+// Returned by CheckID when no target appears to be connected.
+//
+// Responses to other commands carry no known status field (the programmer
+// echoes the command word whether or not the target responded), so a
+// missing or unpowered target is detected from the ID it reports
+var ErrTargetNotResponding = errors.New("Target not responding (is it connected and powered?)")
+
+// ResponseError is returned when the programmer's response does not echo
+// the command that was sent. Response holds the complete raw response,
+// which often reveals a status code or a loss of framing sync
+type ResponseError struct {
+	Command  CommandCode
+	Response []byte
+}
+
+func (e *ResponseError) Error() string {
+	if len(e.Response) < 4 {
+		return fmt.Sprintf("Short response to %s: %s",
+			e.Command, hex.EncodeToString(e.Response))
 	}
 
-	if respc != cmd {
-		return fmt.Errorf("Invalid response command %08x, expected %08x", respc, cmd)
+	got := CommandCode(binary.LittleEndian.Uint32(e.Response))
+	return fmt.Sprintf("Invalid response command %08x, expected %08x (%s); response: %s",
+		uint32(got), uint32(e.Command), e.Command, hex.EncodeToString(e.Response))
+}
+
+func checkResp(cmd CommandCode, buf []byte) error {
+	var respc CommandCode
+	if err := unmarshal(buf, &respc); err != nil || respc != cmd {
+		return &ResponseError{Command: cmd, Response: buf}
 	}
 
 	return nil
 }
 
+// FirmwareVersion is the programmer's firmware build number. It is a
+// plain binary integer, not BCD; other Nu-Link tools (e.g. OpenOCD's
+// nulink driver) also display it in decimal, so versions compare
+// numerically.
 type FirmwareVersion uint32
 
 const (
-	FirmwareVersion6909 FirmwareVersion = 6069
+	FirmwareVersion6069 FirmwareVersion = 6069
+
+	// Deprecated: misnamed (the value has always been 6069); use
+	// FirmwareVersion6069
+	FirmwareVersion6909 = FirmwareVersion6069
 
-	FirmwareVersionRequired = FirmwareVersion6909
+	// Oldest firmware version known to work
+	FirmwareVersionRequired = FirmwareVersion6069
 )
 
 func (v FirmwareVersion) String() string {
@@ -98,14 +130,25 @@ func (vi VersionInfo) String() string {
 	s := fmt.Sprintf("%16s - Firmware Version %s", vi.ProductID, vi.FirmwareVersion)
 
 	if vi.Flags&FlagIsNulinkPro != 0 {
-		s = fmt.Sprintf("%s (Target voltage: %f; USB voltage %f)", s,
-			float64(vi.TargetVoltage)/1000,
-			float64(vi.USBVoltage)/1000)
+		target := "no target detected"
+		if !vi.NoTargetVoltage() {
+			target = fmt.Sprintf("%.2fV", float64(vi.TargetVoltage)/1000)
+		}
+
+		s = fmt.Sprintf("%s (Target voltage: %s; USB voltage %.2fV)", s,
+			target, float64(vi.USBVoltage)/1000)
 	}
 
 	return s
 }
 
+// Reports whether the programmer senses voltage, but none from the target
+// (which is then probably unpowered or not connected). Always false for
+// programmers other than the Nu-Link Pro, which cannot sense it
+func (vi VersionInfo) NoTargetVoltage() bool {
+	return vi.Flags&FlagIsNulinkPro != 0 && vi.TargetVoltage == 0
+}
+
 func (d *Device) GetVersion() (VersionInfo, error) {
 	req := make([]byte, d.MaxPayloadSize())
 	for i := range req {
@@ -149,16 +192,44 @@ func (f ChipFamily) String() string {
 }
 
 type Config struct {
-	Clock       uint32
-	ChipFamily  ChipFamily
+	// ICP clock in kHz
+	Clock      uint32
+	ChipFamily ChipFamily
+	// Target voltage in mV
 	Voltage     uint32
 	PowerTarget uint32
 	USBFuncE    uint32
 }
 
+// Sanity limits on configuration values. These are deliberately loose;
+// they exist to catch mistakes (e.g. a voltage in volts rather than mV),
+// not to describe the capabilities of any particular programmer
+const (
+	MinClock   = 1     // kHz
+	MaxClock   = 20000 // kHz
+	MinVoltage = 1800  // mV
+	MaxVoltage = 5500  // mV
+)
+
+// Validate checks that the configuration values are in range
+func (c Config) Validate() error {
+	if c.Clock < MinClock || c.Clock > MaxClock {
+		return fmt.Errorf("ICP clock %d kHz out of range (%d-%d kHz)", c.Clock, MinClock, MaxClock)
+	}
+
+	if c.Voltage < MinVoltage || c.Voltage > MaxVoltage {
+		return fmt.Errorf("Voltage %d mV out of range (%d-%d mV)", c.Voltage, MinVoltage, MaxVoltage)
+	}
+	return nil
+}
+
 func (d *Device) SetConfig(c Config) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+
 	log.Print("Setting config ", c)
-	cmdBuf, err := marshalCommand(0xA2, c)
+	cmdBuf, err := marshalCommand(CmdSetConfig, c)
 	if err != nil {
 		log.Print("Marshalling error ", err)
 		return err
@@ -170,7 +241,7 @@ func (d *Device) SetConfig(c Config) error {
 		return err
 	}
 
-	if err := checkResp(0xA2, resp); err != nil {
+	if err := checkResp(CmdSetConfig, resp); err != nil {
 		log.Print("Response error ", err)
 		return err
 	}
@@ -271,7 +342,7 @@ type Reset struct {
 
 func (d *Device) Reset(r Reset) error {
 	log.Print("Performing reset ", r)
-	cmdBuf, err := marshalCommand(0xE2, r)
+	cmdBuf, err := marshalCommand(CmdReset, r)
 	if err != nil {
 		log.Println("Marshalling error ", err)
 		return err
@@ -283,7 +354,7 @@ func (d *Device) Reset(r Reset) error {
 		return err
 	}
 
-	if err := checkResp(0xE2, resp); err != nil {
+	if err := checkResp(CmdReset, resp); err != nil {
 		log.Print("Response error ", err)
 		return err
 	}
@@ -318,11 +389,13 @@ func (id DeviceID) String() string {
 	}
 }
 
-func (d *Device) CheckID() (DeviceID, error) {
+// Reads the target's device ID. Unlike CheckID, the ID is returned as read,
+// even if it suggests that no target is connected
+func (d *Device) ReadID() (DeviceID, error) {
 	log.Print("Checking device ID")
 
 	var fill uint32
-	cmdBuf, err := marshalCommand(0xA3, fill)
+	cmdBuf, err := marshalCommand(CmdCheckID, fill)
 	if err != nil {
 		log.Println("Marshalling error ", err)
 		return 0, err
@@ -334,7 +407,7 @@ func (d *Device) CheckID() (DeviceID, error) {
 		return 0, err
 	}
 
-	if err := checkResp(0xA3, resp); err != nil {
+	if err := checkResp(CmdCheckID, resp); err != nil {
 		log.Print("Response error ", err)
 		return 0, err
 	}
@@ -344,11 +417,30 @@ func (d *Device) CheckID() (DeviceID, error) {
 		log.Print("Unmarshalling error ", err)
 		return 0, err
 	}
+	return did, nil
+}
+
+func (d *Device) CheckID() (DeviceID, error) {
+	did, err := d.ReadID()
+	if err != nil {
+		return 0, err
+	}
+
+	// With no target attached (or powered), the ICP data line is held
+	// or floats to a constant level, so the ID reads as all zeros or ones
+	if did == 0 || did == 0xFFFFFFFF {
+		log.Println("No target, Device ID ", did)
+		return 0, ErrTargetNotResponding
+	}
 
 	log.Println("OK, Device ID ", did)
 	return did, nil
 }
 
+// Memory space. Addresses are byte offsets from the start of the space:
+// program space addresses flash as seen by the programmer (with LDROM at
+// the target's LDROM offset), while config space addresses the
+// configuration bytes, starting at 0
 type MemorySpace uint16
 
 const (
@@ -356,6 +448,27 @@ const (
 	ConfigSpace  MemorySpace = 0x0003
 )
 
+var ErrAddressOutOfRange = errors.New("Address out of range for memory space")
+
+// SetSpaceSize sets the size of a memory space of the connected target.
+// Reads and writes outside of the space will then be rejected rather than
+// sent to the programmer
+func (d *Device) SetSpaceSize(space MemorySpace, size uint32) {
+	if d.spaceSize == nil {
+		d.spaceSize = map[MemorySpace]uint32{}
+	}
+	d.spaceSize[space] = size
+}
+
+func (d *Device) checkBounds(space MemorySpace, address uint16, length int) error {
+	size, ok := d.spaceSize[space]
+	if ok && uint32(address)+uint32(length) > size {
+		log.Printf("%d bytes at %s 0x%04x exceeds space size 0x%x", length, space, address, size)
+		return ErrAddressOutOfRange
+	}
+	return nil
+}
+
 func (s MemorySpace) String() string {
 	switch s {
 	case ProgramSpace:
@@ -376,8 +489,15 @@ type memCmd struct {
 }
 
 func (d *Device) ReadMemory(space MemorySpace, address uint16, length uint8) ([]byte, error) {
+	if length == 0 {
+		return []byte{}, nil
+	}
+	if err := d.checkBounds(space, address, int(length)); err != nil {
+		return nil, err
+	}
+
 	log.Printf("Reading %d bytes from %s 0x%04x", length, space, address)
-	cmdBuf, err := marshalCommand(0xA1, memCmd{
+	cmdBuf, err := marshalCommand(CmdReadMemory, memCmd{
 		Addr:   address,
 		Space:  space,
 		Length: uint32(length),
@@ -387,20 +507,35 @@ func (d *Device) ReadMemory(space MemorySpace, address uint16, length uint8) ([]
 		return nil, err
 	}
 
-	resp, err := d.Request(cmdBuf)
+	if err := d.Send(cmdBuf); err != nil {
+		log.Println("Communications error ", err)
+		return nil, err
+	}
+
+	resp, err := d.ReceiveLength(int(length))
 	if err != nil {
 		log.Println("Communications error ", err)
 		return nil, err
 	}
 
-	log.Printf("OK %x", resp)
+	// A short response would otherwise be returned as if it were the whole
+	// read; e.g. a truncated configuration may still decode plausibly
+	if len(resp) < int(length) {
+		log.Printf("Short read: %d of %d bytes", len(resp), length)
+		return nil, fmt.Errorf("Short read from %s 0x%04x: got %d of %d bytes",
+			space, address, len(resp), length)
+	}
+	resp = resp[:length]
+
+	log.Print("OK")
+	FrameLog.Print("Data ", hex.EncodeToString(resp))
 
 	return resp, nil
 }
 
 func (d *Device) EraseFlashChip() error {
 	log.Print("Erasing flash")
-	cmdBuf, err := marshalCommand(0xA4, struct{}{})
+	cmdBuf, err := marshalCommand(CmdEraseFlashChip, struct{}{})
 	if err != nil {
 		log.Println("Marshalling error ", err)
 		return err
@@ -412,7 +547,7 @@ func (d *Device) EraseFlashChip() error {
 		return err
 	}
 
-	if err := checkResp(0xA4, resp); err != nil {
+	if err := checkResp(CmdEraseFlashChip, resp); err != nil {
 		log.Print("Response error ", err)
 		return err
 	}
@@ -421,8 +556,16 @@ func (d *Device) EraseFlashChip() error {
 }
 
 func (d *Device) WriteMemory(space MemorySpace, address uint16, data []byte) error {
-	log.Printf("Writing %d bytes to %s 0x%04x %s", len(data), space, address, hex.EncodeToString(data))
-	cmdBuf, err := marshalCommand(0xA0, memCmd{
+	if len(data) == 0 {
+		return nil
+	}
+	if err := d.checkBounds(space, address, len(data)); err != nil {
+		return err
+	}
+
+	log.Printf("Writing %d bytes to %s 0x%04x", len(data), space, address)
+	FrameLog.Print("Data ", hex.EncodeToString(data))
+	cmdBuf, err := marshalCommand(CmdWriteMemory, memCmd{
 		Addr:   address,
 		Space:  space,
 		Length: uint32(len(data)),
@@ -441,7 +584,7 @@ func (d *Device) WriteMemory(space MemorySpace, address uint16, data []byte) err
 		return err
 	}
 
-	if err := checkResp(0xA0, resp); err != nil {
+	if err := checkResp(CmdWriteMemory, resp); err != nil {
 		log.Print("Response error ", err)
 		return err
 	}
@@ -452,7 +595,7 @@ func (d *Device) WriteMemory(space MemorySpace, address uint16, data []byte) err
 // Not sure what this command does, but Nuvoton's software issues it
 func (d *Device) UnknownA5() error {
 	log.Print("A5")
-	cmdBuf, err := marshalCommand(0xA5, struct{}{})
+	cmdBuf, err := marshalCommand(CmdUnknownA5, struct{}{})
 	if err != nil {
 		log.Println("Marshalling error ", err)
 		return err
@@ -468,7 +611,7 @@ func (d *Device) UnknownA5() error {
 		return err
 	}
 
-	if err := checkResp(0xA5, resp); err != nil {
+	if err := checkResp(CmdUnknownA5, resp); err != nil {
 		log.Print("Response error ", err)
 		return err
 	}
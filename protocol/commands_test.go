@@ -0,0 +1,208 @@
+// Copyright © 2019 Erin Shepherd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package protocol_test
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/erincandescent/nuvoprog/protocol"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(ioutil.Discard)
+	os.Exit(m.Run())
+}
+
+// Returns a device connected to a simulated programmer with an 18KB
+// program space
+func simDevice() (*protocol.Device, *protocol.SimTransport) {
+	sim := protocol.NewSimTransport(protocol.DeviceN76E003, map[protocol.MemorySpace]uint32{
+		protocol.ProgramSpace: 18 * 1024,
+		protocol.ConfigSpace:  32,
+	})
+	return protocol.NewDevice("sim", sim, protocol.NewV1Framer()), sim
+}
+
+func TestEmptyTransfers(t *testing.T) {
+	dev, sim := simDevice()
+
+	buf, err := dev.ReadMemory(protocol.ProgramSpace, 0, 0)
+	if err != nil {
+		t.Errorf("ReadMemory of 0 bytes: %v", err)
+	} else if buf == nil || len(buf) != 0 {
+		t.Errorf("ReadMemory of 0 bytes = %#v, expected an empty slice", buf)
+	}
+
+	if err := dev.WriteMemory(protocol.ProgramSpace, 0, nil); err != nil {
+		t.Errorf("WriteMemory of no data: %v", err)
+	}
+
+	// Not even out of range addresses are sent to the programmer
+	if _, err := dev.ReadMemory(protocol.ProgramSpace, 0xFFFF, 0); err != nil {
+		t.Errorf("ReadMemory of 0 bytes at 0xFFFF: %v", err)
+	}
+
+	if len(sim.Requests) != 0 {
+		t.Errorf("Empty transfers sent %d requests", len(sim.Requests))
+	}
+}
+
+func TestSpaceBounds(t *testing.T) {
+	dev, sim := simDevice()
+	dev.SetSpaceSize(protocol.ProgramSpace, 18*1024)
+	dev.SetSpaceSize(protocol.ConfigSpace, 32)
+
+	cases := []struct {
+		space   protocol.MemorySpace
+		address uint16
+		length  int
+		ok      bool
+	}{
+		{protocol.ProgramSpace, 0x0000, 32, true},
+		{protocol.ProgramSpace, 0x47E0, 32, true},
+		{protocol.ProgramSpace, 0x47F0, 32, false},
+		{protocol.ProgramSpace, 0x4800, 1, false},
+		{protocol.ConfigSpace, 0x00, 32, true},
+		{protocol.ConfigSpace, 0x1F, 1, true},
+		{protocol.ConfigSpace, 0x01, 32, false},
+		{protocol.ConfigSpace, 0x20, 1, false},
+	}
+	for _, c := range cases {
+		before := len(sim.Requests)
+		_, rerr := dev.ReadMemory(c.space, c.address, uint8(c.length))
+		werr := dev.WriteMemory(c.space, c.address, make([]byte, c.length))
+
+		for _, err := range []error{rerr, werr} {
+			if c.ok && err != nil {
+				t.Errorf("%d bytes at %s 0x%04x: %v", c.length, c.space, c.address, err)
+			} else if !c.ok && err != protocol.ErrAddressOutOfRange {
+				t.Errorf("%d bytes at %s 0x%04x: got %v, expected out of range", c.length, c.space, c.address, err)
+			}
+		}
+		if !c.ok && len(sim.Requests) != before {
+			t.Errorf("%d bytes at %s 0x%04x: out of range access was sent", c.length, c.space, c.address)
+		}
+	}
+}
+
+func TestShortRead(t *testing.T) {
+	dev, sim := simDevice()
+	sim.ReadHook = func(space protocol.MemorySpace, addr uint16, data []byte) []byte {
+		return data[:len(data)-1]
+	}
+
+	if buf, err := dev.ReadMemory(protocol.ConfigSpace, 0, 8); err == nil {
+		t.Errorf("Short read returned %X", buf)
+	}
+}
+
+func TestMultiFrameRead(t *testing.T) {
+	dev, sim := simDevice()
+	mem := sim.Memory[protocol.ProgramSpace]
+	for i := range mem {
+		mem[i] = byte(i * 7)
+	}
+
+	// Spanning a partial frame, and exactly filling two frames
+	for _, n := range []uint8{100, 124, 255} {
+		buf, err := dev.ReadMemory(protocol.ProgramSpace, 0x100, n)
+		if err != nil {
+			t.Errorf("Read of %d bytes: %v", n, err)
+		} else if expected := mem[0x100 : 0x100+int(n)]; !bytes.Equal(buf, expected) {
+			t.Errorf("Read of %d bytes returned %X, expected %X", n, buf, expected)
+		}
+	}
+}
+
+func TestShortMultiFrameRead(t *testing.T) {
+	dev, sim := simDevice()
+	sim.ReadHook = func(space protocol.MemorySpace, addr uint16, data []byte) []byte {
+		return data[:70]
+	}
+
+	if buf, err := dev.ReadMemory(protocol.ProgramSpace, 0, 100); err == nil {
+		t.Errorf("Short read returned %X", buf)
+	}
+}
+
+// Wraps a simulated programmer, returning the given invalid frames before
+// its responses
+type badFrames struct {
+	*protocol.SimTransport
+	bad   [][]byte
+	reads int
+}
+
+func (t *badFrames) Read(buf []byte) (int, error) {
+	t.reads++
+	if len(t.bad) != 0 {
+		n := copy(buf, t.bad[0])
+		t.bad = t.bad[1:]
+		return n, nil
+	}
+	return t.SimTransport.Read(buf)
+}
+
+func TestReceiveDiscardsBadFrames(t *testing.T) {
+	_, sim := simDevice()
+	copy(sim.Memory[protocol.ProgramSpace], []byte{0x02, 0x00, 0x06})
+
+	framer := protocol.NewV1Framer()
+	tr := &badFrames{
+		SimTransport: sim,
+		bad:          [][]byte{make([]byte, 10), make([]byte, framer.FrameLength())},
+	}
+	dev := protocol.NewDevice("sim", tr, framer)
+
+	buf, err := dev.ReadMemory(protocol.ProgramSpace, 0, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, []byte{0x02, 0x00, 0x06}) {
+		t.Errorf("Read %X after discarding invalid frames", buf)
+	}
+}
+
+func TestReceiveOnlyBadFrames(t *testing.T) {
+	_, sim := simDevice()
+	tr := &badFrames{SimTransport: sim}
+	for i := 0; i < 100; i++ {
+		tr.bad = append(tr.bad, make([]byte, 10))
+	}
+	dev := protocol.NewDevice("sim", tr, protocol.NewV1Framer())
+
+	if _, err := dev.ReadMemory(protocol.ProgramSpace, 0, 3); err == nil {
+		t.Fatal("Read succeeded with only invalid frames")
+	}
+	if tr.reads >= 100 {
+		t.Errorf("Read %d frames before giving up", tr.reads)
+	}
+}
+
+func TestCheckIDNoTarget(t *testing.T) {
+	for _, id := range []protocol.DeviceID{0, 0xFFFFFFFF} {
+		dev, sim := simDevice()
+		sim.DeviceID = id
+
+		if _, err := dev.CheckID(); !errors.Is(err, protocol.ErrTargetNotResponding) {
+			t.Errorf("CheckID with ID %s: got %v, expected ErrTargetNotResponding", id, err)
+		}
+	}
+}
@@ -16,7 +16,11 @@ package protocol
 import (
 	"encoding/hex"
 	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"time"
 
 	"github.com/karalabe/hid"
 )
@@ -25,8 +29,23 @@ var (
 	ErrWriteSizeIncorrect      = errors.New("Write of incorrect size")
 	ErrReadSizeIncorrect       = errors.New("Read of incorrect size")
 	ErrSequenceNumberIncorrect = errors.New("Incorrect sequence number")
+	ErrEmptyFrame              = errors.New("Empty frame received")
 )
 
+// Number of invalid (short or empty) frames we will discard before
+// giving up. Some OSes return a stale or short report on the first
+// read after opening the device
+const maxDiscardedFrames = 5
+
+// Transport is the link used to exchange frames with a programmer;
+// normally a HID device, but may be substituted (e.g. for testing)
+type Transport interface {
+	io.ReadWriteCloser
+}
+
+// Logger for raw frame contents; discarded by default as it is very noisy
+var FrameLog = log.New(ioutil.Discard, "", log.LstdFlags)
+
 type deviceConfig struct {
 	NewFramer func() Framer
 	EPOut     int
@@ -46,17 +65,58 @@ var devices = map[uint32]*deviceConfig{
 		EPOut:     0x04,
 		EPIn:      0x83,
 	},
+	// Nu-Link2 family (PIDs taken from OpenOCD)
+	0x04165200: &deviceConfig{
+		NewFramer: NewV2Framer,
+	},
+	0x04165201: &deviceConfig{
+		NewFramer: NewV2Framer,
+	},
+	0x04165202: &deviceConfig{
+		NewFramer: NewV2Framer,
+	},
+	0x04165203: &deviceConfig{
+		NewFramer: NewV2Framer,
+	},
+}
+
+// USB vendor ID used by Nuvoton programmers
+const VendorNuvoton = 0x0416
+
+// IsSupported returns whether the given USB vendor & product ID
+// identify a supported programmer
+func IsSupported(vid, pid uint16) bool {
+	return devices[(uint32(vid)<<16)|uint32(pid)] != nil
 }
 
 type Device struct {
 	config *deviceConfig
 	framer Framer
 	seqNo  uint8
-	dev    *hid.Device
+	path   string
+	serial string
+	dev    Transport
+
+	// Size of each memory space, where known
+	spaceSize map[MemorySpace]uint32
+}
+
+// NewDevice creates a device communicating over the specified transport
+func NewDevice(path string, t Transport, framer Framer) *Device {
+	return &Device{
+		framer: framer,
+		path:   path,
+		dev:    t,
+	}
 }
 
 func (d *Device) Path() string {
-	return d.dev.Path
+	return d.path
+}
+
+// Serial returns the programmer's USB serial number, if known
+func (d *Device) Serial() string {
+	return d.serial
 }
 
 func (d *Device) MaxPayloadSize() int {
@@ -80,7 +140,8 @@ func (d *Device) Send(body []byte) error {
 	}
 
 	msgBytes := msg.Bytes()
-	log.Println("> ", hex.EncodeToString([]byte(msgBytes)))
+	log.Println("> ", DescribeRequest(body))
+	FrameLog.Println("> ", hex.EncodeToString([]byte(msgBytes)))
 	l, err := d.dev.Write([]byte(msgBytes))
 	if err != nil {
 		return err
@@ -95,15 +156,29 @@ func (d *Device) Receive() ([]byte, error) {
 	inBuf := make([]byte, d.framer.FrameLength())
 
 	attempt := 0
+	discarded := 0
 	for {
 		l, err := d.dev.Read(inBuf)
-		if err != nil {
+		switch {
+		case err != nil:
 			return nil, err
-		} else if l != d.framer.FrameLength() {
-			return nil, ErrReadSizeIncorrect
+		case l != d.framer.FrameLength():
+			err = ErrReadSizeIncorrect
+		case isEmptyFrame(inBuf):
+			err = ErrEmptyFrame
+		}
+
+		if err != nil {
+			log.Println("Discarding invalid frame: ", err, " ", hex.EncodeToString(inBuf[:l]))
+			discarded++
+			if discarded == maxDiscardedFrames {
+				return nil, err
+			} else {
+				continue
+			}
 		}
 
-		log.Println("< ", hex.EncodeToString([]byte(inBuf)))
+		FrameLog.Println("< ", hex.EncodeToString([]byte(inBuf)))
 		respf, err := d.framer.Unframe(inBuf)
 		if err != nil {
 			return nil, err
@@ -121,6 +196,34 @@ func (d *Device) Receive() ([]byte, error) {
 	}
 }
 
+func isEmptyFrame(buf []byte) bool {
+	for _, b := range buf {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// ReceiveLength receives a response of (at least) n bytes, which may span
+// multiple frames. A frame which is not full ends the response, even if
+// fewer than n bytes have been received
+func (d *Device) ReceiveLength(n int) ([]byte, error) {
+	var resp []byte
+	for len(resp) < n {
+		body, err := d.Receive()
+		if err != nil {
+			return nil, err
+		}
+
+		resp = append(resp, body...)
+		if len(body) < d.framer.MaxBodyLength() {
+			break
+		}
+	}
+	return resp, nil
+}
+
 func (d *Device) Request(body []byte) ([]byte, error) {
 	if err := d.Send(body); err != nil {
 		return nil, err
@@ -136,6 +239,42 @@ func (d *Device) Close() {
 	}
 }
 
+// Opening a device which has just re-enumerated (e.g. after being reset)
+// can fail transiently (e.g. "device busy" on Linux), so opens are retried
+const (
+	openAttempts   = 5
+	openRetryDelay = 200 * time.Millisecond
+)
+
+func openHID(info hid.DeviceInfo) (*hid.Device, error) {
+	var err error
+	for attempt := 1; attempt <= openAttempts; attempt++ {
+		var dev *hid.Device
+		if dev, err = info.Open(); err == nil {
+			return dev, nil
+		}
+
+		log.Printf("Opening %s failed (attempt %d of %d): %v", info.Path, attempt, openAttempts, err)
+		if attempt < openAttempts {
+			time.Sleep(openRetryDelay)
+		}
+	}
+	return nil, fmt.Errorf("Unable to open programmer %s: %v", info.Path, err)
+}
+
+// OpenPath opens the programmer at the given HID path (e.g. /dev/hidraw0)
+// without enumerating devices. As the product ID is not known, a Nu-Link-Me
+// compatible configuration is assumed.
+func OpenPath(path string) (*Device, error) {
+	dev, err := openHID(hid.DeviceInfo{Path: path})
+	if err != nil {
+		return nil, err
+	}
+
+	devcfg := devices[0x0416511c]
+	return NewDevice(path, dev, devcfg.NewFramer()), nil
+}
+
 func Connect() ([]*Device, error) {
 	var nldevs []*Device
 	defer func() {
@@ -152,7 +291,7 @@ func Connect() ([]*Device, error) {
 			continue
 		}
 
-		dev, err := deviceInfo.Open()
+		dev, err := openHID(deviceInfo)
 		if err != nil {
 			return nil, err
 		}
@@ -161,6 +300,8 @@ func Connect() ([]*Device, error) {
 			config: devcfg,
 			framer: devcfg.NewFramer(),
 			seqNo:  0,
+			path:   deviceInfo.Path,
+			serial: deviceInfo.Serial,
 			dev:    dev,
 		})
 	}
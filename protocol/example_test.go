@@ -0,0 +1,100 @@
+// Copyright © 2019 Erin Shepherd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package protocol_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+
+	"github.com/erincandescent/nuvoprog/ihex"
+	"github.com/erincandescent/nuvoprog/protocol"
+	"github.com/erincandescent/nuvoprog/target"
+	_ "github.com/erincandescent/nuvoprog/target/all"
+)
+
+// Programs and verifies a small image, using a simulated programmer in
+// place of protocol.Connect
+func Example() {
+	td := target.ByName("n76e003")
+	sim := protocol.NewSimTransport(td.DeviceID, map[protocol.MemorySpace]uint32{
+		protocol.ProgramSpace: uint32(td.ProgMemSize),
+		protocol.ConfigSpace:  uint32(td.Config.WriteSize),
+	})
+	dev := protocol.NewDevice("sim", sim, protocol.NewV1Framer())
+	defer dev.Close()
+
+	// Enter ICP mode and check that the expected target is attached
+	if err := dev.SetConfig(protocol.Config{
+		Clock:      td.DefaultClock,
+		ChipFamily: td.Family,
+		Voltage:    3300,
+	}); err != nil {
+		log.Fatal(err)
+	}
+	for _, t := range []protocol.ResetType{protocol.ResetAuto, protocol.ResetNoneNuLink} {
+		if err := dev.Reset(protocol.Reset{
+			Type:       t,
+			Connection: protocol.ConnectICPMode,
+			Mode:       protocol.ResetExtMode,
+		}); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	id, err := dev.CheckID()
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("Device:", id)
+
+	config, err := dev.ReadMemory(protocol.ConfigSpace, 0, uint8(td.Config.ReadSize))
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Config: %X\n", config)
+
+	// Erase, then program and verify each block of the image
+	if err := dev.EraseFlashChip(); err != nil {
+		log.Fatal(err)
+	}
+
+	rd := ihex.NewReader(strings.NewReader(":0400000075813022B4\n:00000001FF\n"))
+	for {
+		b, err := rd.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			log.Fatal(err)
+		}
+
+		if err := dev.WriteMemory(protocol.ProgramSpace, uint16(b.Address), b.Data); err != nil {
+			log.Fatal(err)
+		}
+
+		readback, err := dev.ReadMemory(protocol.ProgramSpace, uint16(b.Address), uint8(len(b.Data)))
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("0x%04x: %X verified: %v\n", b.Address, readback, bytes.Equal(readback, b.Data))
+	}
+
+	// Output:
+	// Device: N76E003
+	// Config: FFFFFFFFFFFFFFFF
+	// 0x0000: 75813022 verified: true
+}
@@ -103,3 +103,72 @@ func (f V1Framer) Unframe(pkg []byte) (Frame, error) {
 func NewV1Framer() Framer {
 	return new(V1Framer)
 }
+
+// Version 2 (Nu-Link2) frames, which have a 16-bit little endian
+// length field
+type V2Frame []byte
+
+func (f V2Frame) SequenceNumber() byte {
+	return f[0]
+}
+
+func (f V2Frame) BodyLength() int {
+	return int(binary.LittleEndian.Uint16(f[1:]))
+}
+
+func (f V2Frame) Body() []byte {
+	reqLen := 3 + f.BodyLength()
+	return f[3:reqLen]
+}
+
+func (f V2Frame) Command() (uint32, error) {
+	body := f.Body()
+	if len(body) < 4 {
+		return 0, ErrTooShortForCommand
+	}
+
+	return binary.LittleEndian.Uint32(body), nil
+}
+
+func (f V2Frame) Bytes() []byte {
+	return []byte(f)
+}
+
+type V2Framer struct{}
+
+func (f V2Framer) FrameLength() int {
+	return 1024
+}
+
+func (f V2Framer) MaxBodyLength() int {
+	return 1021
+}
+
+func (f V2Framer) Frame(seqno byte, body []byte) (Frame, error) {
+	if len(body) > 1021 {
+		return nil, ErrBodyLengthTooLong
+	}
+
+	buf := make([]byte, 1024)
+	buf[0] = seqno
+	binary.LittleEndian.PutUint16(buf[1:], uint16(len(body)))
+	copy(buf[3:], body)
+
+	return V2Frame(buf), nil
+}
+
+func (f V2Framer) Unframe(pkg []byte) (Frame, error) {
+	if len(pkg) != 1024 {
+		return nil, ErrFrameLengthIncorrect
+	}
+
+	if binary.LittleEndian.Uint16(pkg[1:]) > 1021 {
+		return nil, ErrBodyLengthTooLong
+	}
+
+	return V2Frame(pkg), nil
+}
+
+func NewV2Framer() Framer {
+	return new(V2Framer)
+}
@@ -0,0 +1,95 @@
+// Copyright © 2019 Erin Shepherd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package protocol_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/erincandescent/nuvoprog/protocol"
+)
+
+func TestV2Frame(t *testing.T) {
+	framer := protocol.NewV2Framer()
+
+	for _, n := range []int{0, 4, 62, 63, 1021} {
+		body := bytes.Repeat([]byte{0xA5}, n)
+		f, err := framer.Frame(0x42, body)
+		if err != nil {
+			t.Errorf("Framing %d bytes: %v", n, err)
+			continue
+		}
+
+		buf := f.Bytes()
+		if len(buf) != framer.FrameLength() {
+			t.Errorf("Frame of %d bytes is %d long, expected %d", n, len(buf), framer.FrameLength())
+		}
+		if buf[1] != byte(n) || buf[2] != byte(n>>8) {
+			t.Errorf("Frame of %d bytes has length field %02X %02X", n, buf[1], buf[2])
+		}
+
+		uf, err := framer.Unframe(buf)
+		if err != nil {
+			t.Errorf("Unframing %d bytes: %v", n, err)
+			continue
+		}
+		if uf.SequenceNumber() != 0x42 || uf.BodyLength() != n || !bytes.Equal(uf.Body(), body) {
+			t.Errorf("Frame of %d bytes decoded as seq %02X, %d bytes %X",
+				n, uf.SequenceNumber(), uf.BodyLength(), uf.Body())
+		}
+	}
+}
+
+func TestV2FrameErrors(t *testing.T) {
+	framer := protocol.NewV2Framer()
+
+	if _, err := framer.Frame(0, make([]byte, 1022)); err != protocol.ErrBodyLengthTooLong {
+		t.Errorf("Framing 1022 bytes: got %v, expected ErrBodyLengthTooLong", err)
+	}
+
+	tooLong := make([]byte, 1024)
+	tooLong[1], tooLong[2] = 0xFE, 0x03
+	short, _ := framer.Frame(0, []byte{1, 2, 3, 4})
+
+	tests := []struct {
+		name  string
+		frame []byte
+		err   error
+	}{
+		{"body length too long", tooLong, protocol.ErrBodyLengthTooLong},
+		{"truncated frame", short.Bytes()[:64], protocol.ErrFrameLengthIncorrect},
+		{"empty frame", nil, protocol.ErrFrameLengthIncorrect},
+		{"oversized frame", make([]byte, 1025), protocol.ErrFrameLengthIncorrect},
+	}
+	for _, tt := range tests {
+		if _, err := framer.Unframe(tt.frame); err != tt.err {
+			t.Errorf("Unframing %s: got %v, expected %v", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestV2FrameCommand(t *testing.T) {
+	framer := protocol.NewV2Framer()
+
+	f, _ := framer.Frame(0, []byte{0xA2, 0, 0, 0, 0xFF})
+	if cmd, err := f.Command(); err != nil || cmd != 0xA2 {
+		t.Errorf("Command() = %02X, %v, expected A2", cmd, err)
+	}
+
+	f, _ = framer.Frame(0, []byte{0xA2})
+	if _, err := f.Command(); err != protocol.ErrTooShortForCommand {
+		t.Errorf("Command() of a 1 byte body: got %v, expected ErrTooShortForCommand", err)
+	}
+}
@@ -13,4 +13,40 @@
 // limitations under the License.
 
 // package protocol defines and implements the NuLink communications protocol
+//
+// A typical session connects to a programmer, puts the target into ICP
+// mode, and then reads or writes its memory:
+//
+//	devs, err := protocol.Connect()
+//	// ... check exactly one device was found
+//	dev := devs[0]
+//	defer dev.Close()
+//
+//	err = dev.SetConfig(protocol.Config{
+//		Clock:      1000,
+//		ChipFamily: protocol.ChipFamily1T8051,
+//		Voltage:    3300,
+//	})
+//	err = dev.Reset(protocol.Reset{
+//		Type:       protocol.ResetAuto,
+//		Connection: protocol.ConnectICPMode,
+//		Mode:       protocol.ResetExtMode,
+//	})
+//	err = dev.Reset(protocol.Reset{
+//		Type:       protocol.ResetNoneNuLink,
+//		Connection: protocol.ConnectICPMode,
+//		Mode:       protocol.ResetExtMode,
+//	})
+//
+//	id, err := dev.CheckID()
+//	config, err := dev.ReadMemory(protocol.ConfigSpace, 0, 8)
+//
+//	err = dev.EraseFlashChip()
+//	err = dev.WriteMemory(protocol.ProgramSpace, 0, page)
+//	readback, err := dev.ReadMemory(protocol.ProgramSpace, 0, uint8(len(page)))
+//
+// The sizes and layout of each memory space depend upon the target; see
+// the target package. For testing without hardware, NewDevice accepts any
+// Transport, such as a SimTransport simulating a programmer and target, or
+// a ReplayTransport replaying a session recorded with Device.Record.
 package protocol
@@ -0,0 +1,154 @@
+// Copyright © 2019 Erin Shepherd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Direction of a recorded frame
+const (
+	DirectionOut = "out"
+	DirectionIn  = "in"
+)
+
+// A single frame in a recorded session
+type RecordEntry struct {
+	Time      time.Time `json:"time"`
+	Direction string    `json:"dir"`
+	Data      string    `json:"data"`
+}
+
+// RecordingTransport wraps a transport, recording every frame exchanged
+// as one JSON object per line
+type RecordingTransport struct {
+	t   Transport
+	log io.WriteCloser
+	enc *json.Encoder
+}
+
+func NewRecordingTransport(t Transport, log io.WriteCloser) *RecordingTransport {
+	return &RecordingTransport{t, log, json.NewEncoder(log)}
+}
+
+func (r *RecordingTransport) record(dir string, buf []byte) error {
+	return r.enc.Encode(RecordEntry{
+		Time:      time.Now(),
+		Direction: dir,
+		Data:      hex.EncodeToString(buf),
+	})
+}
+
+func (r *RecordingTransport) Write(buf []byte) (int, error) {
+	n, err := r.t.Write(buf)
+	if n > 0 {
+		if rerr := r.record(DirectionOut, buf[:n]); rerr != nil && err == nil {
+			err = rerr
+		}
+	}
+	return n, err
+}
+
+func (r *RecordingTransport) Read(buf []byte) (int, error) {
+	n, err := r.t.Read(buf)
+	if n > 0 {
+		if rerr := r.record(DirectionIn, buf[:n]); rerr != nil && err == nil {
+			err = rerr
+		}
+	}
+	return n, err
+}
+
+func (r *RecordingTransport) Close() error {
+	err := r.t.Close()
+	if lerr := r.log.Close(); err == nil {
+		err = lerr
+	}
+	return err
+}
+
+// Record wraps the device's transport so that all subsequent traffic is
+// recorded to log
+func (d *Device) Record(log io.WriteCloser) {
+	d.dev = NewRecordingTransport(d.dev, log)
+}
+
+var ErrReplayMismatch = errors.New("Request does not match recorded session")
+
+// ReplayTransport replays a recorded session, checking that each frame
+// written matches the recording and returning recorded responses
+type ReplayTransport struct {
+	entries []RecordEntry
+}
+
+func NewReplayTransport(r io.Reader) (*ReplayTransport, error) {
+	t := &ReplayTransport{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		var e RecordEntry
+		if err := json.Unmarshal(line, &e); err != nil {
+			return nil, err
+		}
+		t.entries = append(t.entries, e)
+	}
+	return t, scanner.Err()
+}
+
+func (t *ReplayTransport) next(dir string) ([]byte, error) {
+	if len(t.entries) == 0 {
+		return nil, io.EOF
+	}
+
+	e := t.entries[0]
+	if e.Direction != dir {
+		return nil, fmt.Errorf("Recorded session has %s frame, expected %s", e.Direction, dir)
+	}
+	t.entries = t.entries[1:]
+	return hex.DecodeString(e.Data)
+}
+
+func (t *ReplayTransport) Write(buf []byte) (int, error) {
+	exp, err := t.next(DirectionOut)
+	if err != nil {
+		return 0, err
+	} else if !bytes.Equal(exp, buf) {
+		return 0, ErrReplayMismatch
+	}
+	return len(buf), nil
+}
+
+func (t *ReplayTransport) Read(buf []byte) (int, error) {
+	data, err := t.next(DirectionIn)
+	if err != nil {
+		return 0, err
+	}
+	return copy(buf, data), nil
+}
+
+func (t *ReplayTransport) Close() error {
+	return nil
+}
@@ -0,0 +1,88 @@
+// Copyright © 2019 Erin Shepherd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package protocol_test
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/erincandescent/nuvoprog/protocol"
+)
+
+// A buffer which may be used as a session log
+type logBuffer struct {
+	bytes.Buffer
+}
+
+func (*logBuffer) Close() error { return nil }
+
+// A short session: read, write and read back some program memory
+func session(dev *protocol.Device) ([]byte, error) {
+	if err := dev.WriteMemory(protocol.ProgramSpace, 0x10, []byte{0x75, 0x81, 0x30}); err != nil {
+		return nil, err
+	}
+	return dev.ReadMemory(protocol.ProgramSpace, 0x0E, 6)
+}
+
+// Records a session with a simulated programmer, returning the log
+func recordSession(t *testing.T) []byte {
+	t.Helper()
+	_, sim := simDevice()
+	var log logBuffer
+	dev := protocol.NewDevice("sim", protocol.NewRecordingTransport(sim, &log), protocol.NewV1Framer())
+
+	if _, err := session(dev); err != nil {
+		t.Fatal(err)
+	}
+	dev.Close()
+	return log.Bytes()
+}
+
+func TestReplay(t *testing.T) {
+	log := recordSession(t)
+
+	replay, err := protocol.NewReplayTransport(bytes.NewReader(log))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev := protocol.NewDevice("replay", replay, protocol.NewV1Framer())
+
+	buf, err := session(dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []byte{0xFF, 0xFF, 0x75, 0x81, 0x30, 0xFF}; !bytes.Equal(buf, expected) {
+		t.Errorf("Replayed read returned %X, expected %X", buf, expected)
+	}
+
+	// The session is complete
+	if _, err := dev.ReadMemory(protocol.ProgramSpace, 0, 1); err != io.EOF {
+		t.Errorf("Request beyond the end of the session: got %v, expected io.EOF", err)
+	}
+}
+
+func TestReplayDivergence(t *testing.T) {
+	replay, err := protocol.NewReplayTransport(bytes.NewReader(recordSession(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev := protocol.NewDevice("replay", replay, protocol.NewV1Framer())
+
+	err = dev.WriteMemory(protocol.ProgramSpace, 0x20, []byte{0x75, 0x81, 0x30})
+	if err != protocol.ErrReplayMismatch {
+		t.Errorf("Diverging request: got %v, expected ErrReplayMismatch", err)
+	}
+}
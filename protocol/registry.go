@@ -0,0 +1,85 @@
+// Copyright © 2019 Erin Shepherd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"reflect"
+)
+
+// Command code, the first word of each request
+type CommandCode uint32
+
+const (
+	CmdWriteMemory    CommandCode = 0xA0
+	CmdReadMemory     CommandCode = 0xA1
+	CmdSetConfig      CommandCode = 0xA2
+	CmdCheckID        CommandCode = 0xA3
+	CmdEraseFlashChip CommandCode = 0xA4
+	CmdUnknownA5      CommandCode = 0xA5
+	CmdReset          CommandCode = 0xE2
+
+	// GetVersion requests are a payload of all 0xFF bytes
+	CmdGetVersion CommandCode = 0xFFFFFFFF
+)
+
+// Known metadata about a command
+type commandInfo struct {
+	Name string
+	// Type of the request body following the command code, if known
+	Request reflect.Type
+}
+
+var commands = map[CommandCode]commandInfo{
+	CmdWriteMemory:    {"WriteMemory", reflect.TypeOf(memCmd{})},
+	CmdReadMemory:     {"ReadMemory", reflect.TypeOf(memCmd{})},
+	CmdSetConfig:      {"SetConfig", reflect.TypeOf(Config{})},
+	CmdCheckID:        {"CheckID", nil},
+	CmdEraseFlashChip: {"EraseFlashChip", nil},
+	CmdUnknownA5:      {"UnknownA5", nil},
+	CmdReset:          {"Reset", reflect.TypeOf(Reset{})},
+	CmdGetVersion:     {"GetVersion", nil},
+}
+
+func (c CommandCode) String() string {
+	if info, ok := commands[c]; ok {
+		return info.Name
+	}
+	return fmt.Sprintf("0x%08x", uint32(c))
+}
+
+// DescribeRequest returns a human readable description of a request body,
+// decoding its parameters where they are known
+func DescribeRequest(body []byte) string {
+	var code CommandCode
+	if err := unmarshal(body, &code); err != nil {
+		return "(truncated command)"
+	}
+
+	info, ok := commands[code]
+	if !ok || info.Request == nil {
+		return code.String()
+	}
+
+	req := reflect.New(info.Request)
+	if len(body)-4 < binary.Size(req.Interface()) {
+		return code.String() + " (truncated)"
+	}
+	if err := unmarshal(body[4:], req.Interface()); err != nil {
+		return code.String()
+	}
+	return fmt.Sprintf("%s %+v", code, req.Elem().Interface())
+}
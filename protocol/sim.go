@@ -0,0 +1,209 @@
+// Copyright © 2019 Erin Shepherd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+var ErrSimNoResponse = errors.New("No simulated response pending")
+
+// A request received by a SimTransport
+type SimRequest struct {
+	Command CommandCode
+	// For memory reads and writes, the space, address and length accessed
+	Space   MemorySpace
+	Address uint16
+	Length  int
+}
+
+// SimTransport simulates a programmer with a target attached, for testing
+// without hardware. It uses version 1 framing, so should be used with
+// NewDevice(path, sim, NewV1Framer()).
+//
+// Memory behaves as flash: EraseFlashChip sets program and config space to
+// 0xFF, and writes can only clear bits
+type SimTransport struct {
+	Version  VersionInfo
+	DeviceID DeviceID
+
+	// Contents of each memory space
+	Memory map[MemorySpace][]byte
+
+	// Requests received, in order
+	Requests []SimRequest
+
+	// If set, called with the data of each read before it is returned. It
+	// may modify or truncate the data, e.g. to simulate a faulty target
+	ReadHook func(space MemorySpace, address uint16, data []byte) []byte
+
+	framer  Framer
+	pending [][]byte
+}
+
+// NewSimTransport returns a simulated programmer attached to the target
+// with the given ID, which has memory spaces of the given sizes, all erased
+func NewSimTransport(id DeviceID, sizes map[MemorySpace]uint32) *SimTransport {
+	s := &SimTransport{
+		Version: VersionInfo{
+			FirmwareVersion: FirmwareVersionRequired,
+			ProductID:       ProductIDNuLinkME,
+		},
+		DeviceID: id,
+		Memory:   map[MemorySpace][]byte{},
+		framer:   NewV1Framer(),
+	}
+	for space, size := range sizes {
+		s.Memory[space] = bytes.Repeat([]byte{0xFF}, int(size))
+	}
+	return s
+}
+
+// Returns the simulated memory of length bytes at address in space
+func (s *SimTransport) memory(space MemorySpace, address uint16, length uint32) ([]byte, error) {
+	mem := s.Memory[space]
+	end := uint32(address) + length
+	if end > uint32(len(mem)) {
+		return nil, fmt.Errorf("Simulated %d byte access at %s 0x%04x out of range", length, space, address)
+	}
+	return mem[address:end], nil
+}
+
+// Handles a request, returning the response body
+func (s *SimTransport) handle(cmd CommandCode, args []byte) ([]byte, error) {
+	resp := make([]byte, 4)
+	binary.LittleEndian.PutUint32(resp, uint32(cmd))
+
+	req := SimRequest{Command: cmd}
+	var mc memCmd
+	if cmd == CmdReadMemory || cmd == CmdWriteMemory {
+		if err := unmarshal(args, &mc); err != nil {
+			return nil, err
+		}
+		req.Space, req.Address, req.Length = mc.Space, mc.Addr, int(mc.Length)
+	}
+	s.Requests = append(s.Requests, req)
+
+	switch cmd {
+	case CmdGetVersion:
+		buf := new(bytes.Buffer)
+		err := binary.Write(buf, binary.LittleEndian, s.Version)
+		return buf.Bytes(), err
+
+	case CmdSetConfig, CmdReset, CmdUnknownA5:
+		return resp, nil
+
+	case CmdCheckID:
+		id := make([]byte, 4)
+		binary.LittleEndian.PutUint32(id, uint32(s.DeviceID))
+		return append(resp, id...), nil
+
+	case CmdEraseFlashChip:
+		for _, space := range []MemorySpace{ProgramSpace, ConfigSpace} {
+			for i := range s.Memory[space] {
+				s.Memory[space][i] = 0xFF
+			}
+		}
+		return resp, nil
+
+	case CmdReadMemory:
+		mem, err := s.memory(mc.Space, mc.Addr, mc.Length)
+		if err != nil {
+			return nil, err
+		}
+
+		data := append([]byte{}, mem...)
+		if s.ReadHook != nil {
+			data = s.ReadHook(mc.Space, mc.Addr, data)
+		}
+		return data, nil
+
+	case CmdWriteMemory:
+		data := args[8:]
+		if uint32(len(data)) < mc.Length {
+			return nil, fmt.Errorf("Simulated write of %d bytes has only %d", mc.Length, len(data))
+		}
+
+		mem, err := s.memory(mc.Space, mc.Addr, mc.Length)
+		if err != nil {
+			return nil, err
+		}
+		for i := range mem {
+			mem[i] &= data[i]
+		}
+		return resp, nil
+
+	default:
+		return nil, fmt.Errorf("Simulated programmer does not support %s", cmd)
+	}
+}
+
+// Write receives a request frame, queueing the frames of its response
+func (s *SimTransport) Write(buf []byte) (int, error) {
+	f, err := s.framer.Unframe(buf)
+	if err != nil {
+		return 0, err
+	}
+
+	cmd, err := f.Command()
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := s.handle(CommandCode(cmd), f.Body()[4:])
+	if err != nil {
+		return 0, err
+	}
+
+	// Long responses span multiple frames; a response which exactly fills
+	// its last frame needs no terminating short frame, as the reader knows
+	// how much to expect
+	for {
+		n := len(resp)
+		if n > s.framer.MaxBodyLength() {
+			n = s.framer.MaxBodyLength()
+		}
+
+		rf, err := s.framer.Frame(f.SequenceNumber(), resp[:n])
+		if err != nil {
+			return 0, err
+		}
+		s.pending = append(s.pending, rf.Bytes())
+
+		resp = resp[n:]
+		if len(resp) == 0 {
+			break
+		}
+	}
+	return len(buf), nil
+}
+
+// Read returns the next frame of the response to the last request
+func (s *SimTransport) Read(buf []byte) (int, error) {
+	if len(s.pending) == 0 {
+		return 0, ErrSimNoResponse
+	}
+
+	n := copy(buf, s.pending[0])
+	s.pending = s.pending[1:]
+	return n, nil
+}
+
+func (s *SimTransport) Close() error {
+	return nil
+}
@@ -0,0 +1,334 @@
+// Copyright © 2019 Erin Shepherd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package srec reads and writes Motorola S-record files
+package srec
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/erincandescent/nuvoprog/ihex"
+)
+
+// Record types
+const (
+	header  = '0'
+	data16  = '1'
+	data24  = '2'
+	data32  = '3'
+	count16 = '5'
+	count24 = '6'
+	start32 = '7'
+	start24 = '8'
+	start16 = '9'
+)
+
+var (
+	ErrInvalidPrefix       = errors.New("S prefix missing")
+	ErrInvalidHex          = errors.New("Invalid hex digit")
+	ErrInvalidChecksum     = errors.New("Invalid checksum")
+	ErrInvalidRecordType   = errors.New("Invalid record type")
+	ErrInvalidRecordLength = errors.New("Length invalid for record")
+	ErrHeaderTooLong       = errors.New("Header too long for S0 record")
+)
+
+// Maximum length of Writer.Header: the record's count byte also covers its
+// two byte address and checksum
+const MaxHeaderLength = 0xFF - 3
+
+// An error in the record on a given line
+type LineError struct {
+	Line int
+	Err  error
+}
+
+func (e *LineError) Error() string {
+	return fmt.Sprintf("Line %d: %v", e.Line, e.Err)
+}
+
+// Returns the length of the address field of records of type t, or -1
+// for unknown types
+func addressLength(t byte) int {
+	switch t {
+	case header, data16, count16, start16:
+		return 2
+	case data24, count24, start24:
+		return 3
+	case data32, start32:
+		return 4
+	default:
+		return -1
+	}
+}
+
+func unhex(c byte) (byte, bool) {
+	switch {
+	case c >= '0' && c <= '9':
+		return c - '0', true
+	case c >= 'A' && c <= 'F':
+		return c - 'A' + 10, true
+	case c >= 'a' && c <= 'f':
+		return c - 'a' + 10, true
+	default:
+		return 0, false
+	}
+}
+
+// Reader reads the data records of an S-record file as blocks. Header,
+// count and start address records are checked but otherwise ignored
+type Reader struct {
+	r    *bufio.Reader
+	line int
+	done bool
+}
+
+func NewReader(r io.Reader) *Reader {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return &Reader{r: br}
+}
+
+// Line returns the line number of the record most recently read
+func (r *Reader) Line() int {
+	return r.line
+}
+
+// Parses the record on line, returning its type, address and data
+func parseRecord(line string) (byte, uint32, []byte, error) {
+	if len(line) < 4 || line[0] != 'S' {
+		return 0, 0, nil, ErrInvalidPrefix
+	}
+
+	t := line[1]
+	alen := addressLength(t)
+	if alen < 0 {
+		return 0, 0, nil, ErrInvalidRecordType
+	}
+
+	if len(line)%2 != 0 {
+		return 0, 0, nil, ErrInvalidHex
+	}
+	buf := make([]byte, 0, (len(line)-2)/2)
+	for i := 2; i < len(line); i += 2 {
+		hi, ok1 := unhex(line[i])
+		lo, ok2 := unhex(line[i+1])
+		if !ok1 || !ok2 {
+			return 0, 0, nil, ErrInvalidHex
+		}
+		buf = append(buf, hi<<4|lo)
+	}
+
+	// The count covers the address, data and checksum
+	count := int(buf[0])
+	if count != len(buf)-1 || count < alen+1 {
+		return 0, 0, nil, ErrInvalidRecordLength
+	}
+
+	// The checksum is the ones' complement of the sum of the count,
+	// address and data bytes
+	var sum byte
+	for _, b := range buf[:len(buf)-1] {
+		sum += b
+	}
+	if ^sum != buf[len(buf)-1] {
+		return 0, 0, nil, ErrInvalidChecksum
+	}
+
+	var addr uint32
+	for _, b := range buf[1 : 1+alen] {
+		addr = addr<<8 | uint32(b)
+	}
+	return t, addr, buf[1+alen : len(buf)-1], nil
+}
+
+// Next returns the next data record as a block, or io.EOF after the
+// termination record or the end of the file
+func (r *Reader) Next() (ihex.Block, error) {
+	for !r.done {
+		line, err := r.r.ReadString('\n')
+		if err == io.EOF {
+			if line == "" {
+				break
+			}
+		} else if err != nil {
+			return ihex.Block{}, err
+		}
+		r.line++
+
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			continue
+		}
+
+		t, addr, data, err := parseRecord(line)
+		if err != nil {
+			return ihex.Block{}, &LineError{r.line, err}
+		}
+
+		switch t {
+		case data16, data24, data32:
+			if uint64(addr)+uint64(len(data)) > 1<<32 {
+				return ihex.Block{}, &LineError{r.line, ihex.ErrAddressOverflow}
+			}
+			return ihex.Block{Address: addr, Data: data}, nil
+		case start16, start24, start32:
+			r.done = true
+		}
+	}
+	return ihex.Block{}, io.EOF
+}
+
+type record struct {
+	addr uint32
+	data []byte
+}
+
+// Writer writes data as S-records. As the record type (S1, S2 or S3)
+// depends upon the highest address written, records are buffered until
+// Close, which writes the file
+type Writer struct {
+	// Contents of the S0 header record (e.g. a module name). Close fails
+	// with ErrHeaderTooLong if this exceeds MaxHeaderLength bytes
+	Header string
+
+	w       io.WriteCloser
+	records []record
+	maxAddr uint32
+}
+
+func NewWriter(w io.WriteCloser) *Writer {
+	return &Writer{w: w}
+}
+
+func (w *Writer) write(addr uint32, buf []byte) error {
+	if len(buf) == 0 {
+		return nil
+	}
+
+	w.records = append(w.records, record{addr, append([]byte(nil), buf...)})
+	if end := addr + uint32(len(buf)) - 1; end > w.maxAddr {
+		w.maxAddr = end
+	}
+	return nil
+}
+
+// Write writes buf at addr, in records of up to 32 bytes aligned as in
+// Intel Hex output
+func (w *Writer) Write(addr uint32, buf []byte) error {
+	lead := int(32 - (addr & 31))
+	if addr&31 != 0 && len(buf) > lead {
+		if err := w.write(addr, buf[:lead]); err != nil {
+			return err
+		}
+		addr += uint32(lead)
+		buf = buf[lead:]
+	}
+
+	for len(buf) > 32 {
+		if err := w.write(addr, buf[:32]); err != nil {
+			return err
+		}
+		addr += 32
+		buf = buf[32:]
+	}
+
+	return w.write(addr, buf)
+}
+
+func (w *Writer) WriteBlock(b ihex.Block) {
+	w.Write(b.Address, b.Data)
+}
+
+var hlut = "0123456789ABCDEF"
+
+// Writes a record of type t, with an address of addrLen bytes
+func writeRecord(w io.Writer, t byte, addrLen int, addr uint32, data []byte) error {
+	count := byte(addrLen + len(data) + 1)
+	sum := count
+
+	buf := make([]byte, 0, 4+2*int(count)+1)
+	buf = append(buf, 'S', t, hlut[count>>4], hlut[count&0xF])
+	for i := addrLen - 1; i >= 0; i-- {
+		b := byte(addr >> (8 * uint(i)))
+		sum += b
+		buf = append(buf, hlut[b>>4], hlut[b&0xF])
+	}
+	for _, b := range data {
+		sum += b
+		buf = append(buf, hlut[b>>4], hlut[b&0xF])
+	}
+	sum = ^sum
+	buf = append(buf, hlut[sum>>4], hlut[sum&0xF], '\n')
+
+	_, err := w.Write(buf)
+	return err
+}
+
+// Close writes the header, data, count and termination records, and
+// closes the underlying writer. If writing fails, the underlying writer is
+// left open so that the caller may discard the incomplete output
+func (w *Writer) Close() error {
+	if err := w.writeAll(); err != nil {
+		return err
+	}
+
+	err := w.w.Close()
+	w.w = nil
+	return err
+}
+
+func (w *Writer) writeAll() error {
+	if len(w.Header) > MaxHeaderLength {
+		return ErrHeaderTooLong
+	}
+
+	dataType, startType, addrLen := byte(data16), byte(start16), 2
+	switch {
+	case w.maxAddr > 0xFFFFFF:
+		dataType, startType, addrLen = data32, start32, 4
+	case w.maxAddr > 0xFFFF:
+		dataType, startType, addrLen = data24, start24, 3
+	}
+
+	if err := writeRecord(w.w, header, 2, 0, []byte(w.Header)); err != nil {
+		return err
+	}
+
+	for _, r := range w.records {
+		if err := writeRecord(w.w, dataType, addrLen, r.addr, r.data); err != nil {
+			return err
+		}
+	}
+
+	// The count record is optional, and cannot represent more than
+	// 0xFFFFFF records
+	switch n := uint32(len(w.records)); {
+	case n <= 0xFFFF:
+		if err := writeRecord(w.w, count16, 2, n, nil); err != nil {
+			return err
+		}
+	case n <= 0xFFFFFF:
+		if err := writeRecord(w.w, count24, 3, n, nil); err != nil {
+			return err
+		}
+	}
+
+	return writeRecord(w.w, startType, addrLen, 0, nil)
+}
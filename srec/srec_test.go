@@ -0,0 +1,173 @@
+// Copyright © 2019 Erin Shepherd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package srec
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/erincandescent/nuvoprog/ihex"
+)
+
+// A buffer recording whether it was closed
+type buffer struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (b *buffer) Close() error {
+	b.closed = true
+	return nil
+}
+
+func TestHeaderLength(t *testing.T) {
+	var b buffer
+	w := NewWriter(&b)
+	w.Header = strings.Repeat("x", MaxHeaderLength)
+	w.Write(0, []byte{0x02})
+	if err := w.Close(); err != nil {
+		t.Fatalf("Header of %d bytes: %v", MaxHeaderLength, err)
+	}
+	if !strings.HasPrefix(b.String(), "S0FF0000") {
+		t.Errorf("Header record begins %q, want count FF", b.String()[:8])
+	}
+
+	b = buffer{}
+	w = NewWriter(&b)
+	w.Header = strings.Repeat("x", MaxHeaderLength+1)
+	if err := w.Close(); err != ErrHeaderTooLong {
+		t.Errorf("Header of %d bytes: got %v, want ErrHeaderTooLong", MaxHeaderLength+1, err)
+	}
+	if b.Len() != 0 || b.closed {
+		t.Error("Output written or closed despite invalid header")
+	}
+}
+
+// Reads all blocks from an S-record file
+func readAll(t *testing.T, in string) []ihex.Block {
+	t.Helper()
+	var blocks []ihex.Block
+	r := NewReader(strings.NewReader(in))
+	for {
+		b, err := r.Next()
+		if err == io.EOF {
+			return blocks
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		blocks = append(blocks, b)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	cases := []struct {
+		addr uint32
+		typ  string
+	}{
+		{0x1000, "S1"},
+		{0xFFFF - 3, "S1"},
+		{0x30000, "S2"},
+		{0xFFFFFF - 3, "S2"},
+		{0x1000000, "S3"},
+		{0xFFFFFFF0, "S3"},
+	}
+	data := []byte{0x02, 0x00, 0x06, 0x75}
+
+	for _, c := range cases {
+		var b buffer
+		w := NewWriter(&b)
+		if err := w.Write(c.addr, data); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if !b.closed {
+			t.Errorf("0x%x: Close did not close the output", c.addr)
+		}
+
+		out := b.String()
+		if !strings.Contains(out, "\n"+c.typ) {
+			t.Errorf("0x%x: no %s data record in\n%s", c.addr, c.typ, out)
+		}
+
+		blocks := readAll(t, out)
+		if len(blocks) != 1 || blocks[0].Address != c.addr || !bytes.Equal(blocks[0].Data, data) {
+			t.Errorf("0x%x: read back %+v", c.addr, blocks)
+		}
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	// The ones' complement of the sum of the count, address and data bytes
+	const rec = "S1137AF00A0A0D0000000000000000000000000061\n"
+	blocks := readAll(t, rec)
+	if len(blocks) != 1 || blocks[0].Address != 0x7AF0 {
+		t.Fatalf("Read %+v", blocks)
+	}
+
+	var b buffer
+	w := NewWriter(&b)
+	w.Write(0x7AF0, blocks[0].Data)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(b.String(), rec) {
+		t.Errorf("Wrote\n%s\nwant record %s", b.String(), rec)
+	}
+}
+
+func TestBadChecksumLine(t *testing.T) {
+	in := "S00600004844521B\n" +
+		"S1137AF00A0A0D0000000000000000000000000061\n" +
+		"S1137B000A0A0D0000000000000000000000000000\n"
+	r := NewReader(strings.NewReader(in))
+	if _, err := r.Next(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := r.Next()
+	if e, ok := err.(*LineError); !ok || e.Line != 3 || e.Err != ErrInvalidChecksum {
+		t.Errorf("Got %v, want invalid checksum on line 3", err)
+	}
+}
+
+// A writer which fails after n bytes
+type failingWriter struct {
+	buffer
+	n int
+}
+
+func (w *failingWriter) Write(buf []byte) (int, error) {
+	if w.Len()+len(buf) > w.n {
+		return 0, errors.New("Write failed")
+	}
+	return w.buffer.Write(buf)
+}
+
+func TestCloseLeavesOutputOpenOnError(t *testing.T) {
+	fw := &failingWriter{n: 20}
+	w := NewWriter(fw)
+	w.Write(0, []byte{0x02, 0x00, 0x06})
+	if err := w.Close(); err == nil {
+		t.Fatal("Close succeeded despite a failed write")
+	}
+	if fw.closed {
+		t.Error("Close closed the output after a failed write")
+	}
+}
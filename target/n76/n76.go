@@ -15,6 +15,22 @@
 // package n76 contians N76 family device definitions
 package n76
 
+import (
+	"github.com/erincandescent/nuvoprog/target"
+)
+
+// Interrupt vectors common to all 8052 compatible parts. Targets whose full
+// vector table has not been described list only these
+var vectors8052 = []target.Vector{
+	{Name: "reset", Address: 0x0000},
+	{Name: "int0", Address: 0x0003},
+	{Name: "timer0", Address: 0x000B},
+	{Name: "int1", Address: 0x0013},
+	{Name: "timer1", Address: 0x001B},
+	{Name: "serial0", Address: 0x0023},
+	{Name: "timer2", Address: 0x002B},
+}
+
 type BootSelect int
 
 const (
@@ -22,6 +38,8 @@ const (
 	BootFromAPROM
 )
 
+func (BootSelect) Values() []string { return target.EnumStrings(BootSelectValues()) }
+
 //go:generate enumer -type=N76E003LDROMSize -trimprefix=N76E003LDROM -transform=snake -json -text
 
 type BODVoltage885 byte
@@ -36,6 +54,9 @@ const (
         BODVoltage8852v0
         BODVoltage8851v7
 )
+
+func (BODVoltage885) Values() []string { return target.EnumStrings(BODVoltage885Values()) }
+
 //go:generate enumer -type=BODVoltage885 -trimprefix=BODVoltage885 -transform=snake -json -text
 
 type BODVoltage byte
@@ -47,6 +68,8 @@ const (
 	BODVoltage2v2
 )
 
+func (BODVoltage) Values() []string { return target.EnumStrings(BODVoltageValues()) }
+
 //go:generate enumer -type=BODVoltage -trimprefix=BODVoltage -transform=snake -json -text
 
 type WDTMode byte
@@ -57,4 +80,6 @@ const (
 	WDTEnabledAlways
 )
 
+func (WDTMode) Values() []string { return target.EnumStrings(WDTModeValues()) }
+
 //go:generate enumer -type=WDTMode -trimprefix=WDT -transform=snake -json -text
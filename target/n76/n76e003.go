@@ -32,6 +32,8 @@ const (
 	N76E003LDROM4KB
 )
 
+func (N76E003LDROMSize) Values() []string { return target.EnumStrings(N76E003LDROMSizeValues()) }
+
 type N76E003Config struct {
 	// CONFIG0.CBS[7]
 	BootSelect BootSelect `json:"boot_select"`
@@ -66,7 +68,7 @@ type N76E003Config struct {
 
 func (cfg *N76E003Config) UnmarshalBinary(buf []byte) error {
 	if len(buf) < 4 {
-		return errors.New("Too short for config bytes")
+		return &target.ConfigError{Offset: len(buf), Err: errors.New("Too short for config bytes")}
 	}
 
 	cfg.BootSelect = BootFromAPROM
@@ -202,6 +204,10 @@ func (cfg *N76E003Config) MarshalBinary() ([]byte, error) {
 	return buf, nil
 }
 
+func (c *N76E003Config) IsLocked() bool {
+	return c.Locked
+}
+
 func (c *N76E003Config) GetLDROMSize() uint {
 	switch c.LDROMSize {
 	case N76E003LDROM0KB:
@@ -221,16 +227,39 @@ func (c *N76E003Config) GetLDROMSize() uint {
 
 var N76E003 = &target.Definition{
 	Name:        "N76E003",
+	Aliases:     []string{"n76"},
 	Family:      protocol.ChipFamily1T8051,
 	DeviceID:    protocol.DeviceN76E003,
 	ProgMemSize: 18 * 1024,
 	LDROMOffset: 0x3800,
+	Vectors: []target.Vector{
+		{Name: "reset", Address: 0x0000},
+		{Name: "int0", Address: 0x0003},
+		{Name: "timer0", Address: 0x000B},
+		{Name: "int1", Address: 0x0013},
+		{Name: "timer1", Address: 0x001B},
+		{Name: "serial0", Address: 0x0023},
+		{Name: "timer2", Address: 0x002B},
+		{Name: "i2c", Address: 0x0033},
+		{Name: "pin", Address: 0x003B},
+		{Name: "bod", Address: 0x0043},
+		{Name: "spi", Address: 0x004B},
+		{Name: "wdt", Address: 0x0053},
+		{Name: "adc", Address: 0x005B},
+		{Name: "capture", Address: 0x0063},
+		{Name: "pwm", Address: 0x006B},
+		{Name: "brake", Address: 0x0073},
+		{Name: "serial1", Address: 0x007B},
+		{Name: "timer3", Address: 0x0083},
+		{Name: "wkt", Address: 0x008B},
+	},
 	Config: target.ConfigSpace{
-		IHexOffset: 0x30000,
-		MinSize:    4,
-		ReadSize:   8,
-		WriteSize:  32,
-		NewConfig:  func() target.Config { return new(N76E003Config) },
+		IHexOffset:  0x30000,
+		MinSize:     4,
+		ReadSize:    8,
+		WriteSize:   32,
+		NewConfig:   func() target.Config { return new(N76E003Config) },
+		ModeledBits: []byte{0xB6, 0x07, 0xBC, 0xF0},
 	},
 }
 
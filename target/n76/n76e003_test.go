@@ -0,0 +1,121 @@
+// Copyright © 2019 Erin Shepherd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package n76
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestEncodePreserving(t *testing.T) {
+	// Every modeled bit is clear, and a pattern is set in the unmodeled
+	// bits of the modeled bytes and in the bytes beyond them
+	base := []byte{0x48, 0xA0, 0x43, 0x05, 0x12, 0x34, 0x56, 0x78}
+
+	cs := &N76E003.Config
+	cfg, err := cs.Decode(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.(*N76E003Config).Locked = false
+
+	buf, err := cs.EncodePreserving(cfg, base)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []byte{0x4A, 0xA3, 0x43, 0x05, 0x12, 0x34, 0x56, 0x78}
+	if !bytes.Equal(buf, expected) {
+		t.Errorf("EncodePreserving = %X, expected %X", buf, expected)
+	}
+
+	for i := range base {
+		var m byte
+		if i < len(cs.ModeledBits) {
+			m = cs.ModeledBits[i]
+		}
+		if (buf[i]^base[i])&^m != 0 {
+			t.Errorf("Unmodeled bits of byte %d changed from %02X to %02X", i, base[i], buf[i])
+		}
+	}
+}
+
+func TestEncodePreservingRequiresModeledBits(t *testing.T) {
+	cs := N76E003.Config
+	cs.ModeledBits = nil
+
+	cfg, err := cs.Decode(make([]byte, 8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cs.EncodePreserving(cfg, make([]byte, 8)); err == nil {
+		t.Error("EncodePreserving succeeded without ModeledBits")
+	}
+}
+
+func TestConfigSizes(t *testing.T) {
+	cs := &N76E003.Config
+	if cs.MinSize != 4 || cs.ReadSize != 8 || cs.WriteSize != 32 {
+		t.Fatalf("Sizes are %d/%d/%d, expected 4/8/32", cs.MinSize, cs.ReadSize, cs.WriteSize)
+	}
+
+	// Only the first MinSize bytes are decoded, whatever follows them
+	expected, err := cs.Decode([]byte{0x7F, 0xFB, 0x7B, 0x5F})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []uint{cs.MinSize, uint(cs.ReadSize), uint(cs.WriteSize)} {
+		buf := bytes.Repeat([]byte{0x00}, int(n))
+		copy(buf, []byte{0x7F, 0xFB, 0x7B, 0x5F})
+
+		cfg, err := cs.Decode(buf)
+		if err != nil {
+			t.Errorf("Decoding %d bytes: %v", n, err)
+		} else if !reflect.DeepEqual(cfg, expected) {
+			t.Errorf("Decoding %d bytes = %+v, expected %+v", n, cfg, expected)
+		}
+	}
+
+	if _, err := cs.Decode([]byte{0xFF, 0xFF, 0xFF}); err == nil {
+		t.Error("Decoded 3 bytes")
+	}
+
+	// The encoded form covers the bytes read from the device
+	buf, err := expected.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	} else if len(buf) != int(cs.ReadSize) {
+		t.Errorf("Encoded %d bytes, expected %d", len(buf), cs.ReadSize)
+	}
+}
+
+func TestUnmodeledBytes(t *testing.T) {
+	cs := &N76E003.Config
+	cases := []struct {
+		buf      []byte
+		expected []int
+	}{
+		{[]byte{0x00, 0x00, 0x00, 0x00}, nil},
+		{[]byte{0x00, 0x00, 0x00, 0x00, 0xFF, 0xFF, 0xFF, 0xFF}, nil},
+		{[]byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0x12, 0xFF, 0x00}, []int{5, 7}},
+		{append(bytes.Repeat([]byte{0xFF}, 31), 0x00), []int{31}},
+	}
+	for _, c := range cases {
+		if got := cs.UnmodeledBytes(c.buf); !reflect.DeepEqual(got, c.expected) {
+			t.Errorf("UnmodeledBytes(%X) = %v, expected %v", c.buf, got, c.expected)
+		}
+	}
+}
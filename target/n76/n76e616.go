@@ -32,6 +32,8 @@ const (
 	N76E616LDROM4KB
 )
 
+func (N76E616LDROMSize) Values() []string { return target.EnumStrings(N76E616LDROMSizeValues()) }
+
 type N76E616Config struct {
 	// CONFIG0.CBS[7]
 	BootSelect BootSelect `json:"boot_select"`
@@ -64,7 +66,7 @@ type N76E616Config struct {
 
 func (cfg *N76E616Config) UnmarshalBinary(buf []byte) error {
 	if len(buf) < 4 {
-		return errors.New("Too short for config bytes")
+		return &target.ConfigError{Offset: len(buf), Err: errors.New("Too short for config bytes")}
 	}
 
 	cfg.BootSelect = BootFromAPROM
@@ -195,6 +197,10 @@ func (cfg *N76E616Config) MarshalBinary() ([]byte, error) {
 	return buf, nil
 }
 
+func (c *N76E616Config) IsLocked() bool {
+	return c.Locked
+}
+
 func (c *N76E616Config) GetLDROMSize() uint {
 	switch c.LDROMSize {
 	case N76E616LDROM0KB:
@@ -218,12 +224,15 @@ var N76E616 = &target.Definition{
 	DeviceID:    protocol.DeviceN76E616,
 	ProgMemSize: 18 * 1024,
 	LDROMOffset: 0x3800,
+	// Device specific vectors (from 0x0033) are not yet described
+	Vectors: vectors8052,
 	Config: target.ConfigSpace{
-		IHexOffset: 0x30000,
-		MinSize:    4,
-		ReadSize:   8,
-		WriteSize:  32,
-		NewConfig:  func() target.Config { return new(N76E616Config) },
+		IHexOffset:  0x30000,
+		MinSize:     4,
+		ReadSize:    8,
+		WriteSize:   32,
+		NewConfig:   func() target.Config { return new(N76E616Config) },
+		ModeledBits: []byte{0x96, 0x07, 0xBC, 0xF0},
 	},
 }
 
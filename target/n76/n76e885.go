@@ -32,6 +32,8 @@ const (
 	N76E885LDROM4KB
 )
 
+func (N76E885LDROMSize) Values() []string { return target.EnumStrings(N76E885LDROMSizeValues()) }
+
 type N76E885Config struct {
 	// CONFIG0.CBS[7]
 	BootSelect BootSelect `json:"boot_select"`
@@ -66,7 +68,7 @@ type N76E885Config struct {
 
 func (cfg *N76E885Config) UnmarshalBinary(buf []byte) error {
 	if len(buf) < 4 {
-		return errors.New("Too short for config bytes")
+		return &target.ConfigError{Offset: len(buf), Err: errors.New("Too short for config bytes")}
 	}
 
 	cfg.BootSelect = BootFromAPROM
@@ -218,6 +220,10 @@ func (cfg *N76E885Config) MarshalBinary() ([]byte, error) {
 	return buf, nil
 }
 
+func (c *N76E885Config) IsLocked() bool {
+	return c.Locked
+}
+
 func (c *N76E885Config) GetLDROMSize() uint {
 	switch c.LDROMSize {
 	case N76E885LDROM0KB:
@@ -241,12 +247,15 @@ var N76E885 = &target.Definition{
 	DeviceID:    protocol.DeviceN76E885,
 	ProgMemSize: 18 * 1024,
 	LDROMOffset: 0x3800,
+	// Device specific vectors (from 0x0033) are not yet described
+	Vectors: vectors8052,
 	Config: target.ConfigSpace{
-		IHexOffset: 0x30000,
-		MinSize:    4,
-		ReadSize:   8,
-		WriteSize:  32,
-		NewConfig:  func() target.Config { return new(N76E885Config) },
+		IHexOffset:  0x30000,
+		MinSize:     4,
+		ReadSize:    8,
+		WriteSize:   32,
+		NewConfig:   func() target.Config { return new(N76E885Config) },
+		ModeledBits: []byte{0xB6, 0x07, 0xFC, 0xF0},
 	},
 }
 
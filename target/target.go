@@ -15,7 +15,10 @@ package target
 
 import (
 	"encoding"
+	"errors"
 	"fmt"
+	"reflect"
+	"sort"
 	"strings"
 
 	"github.com/erincandescent/nuvoprog/protocol"
@@ -28,6 +31,30 @@ type Config interface {
 	// Returns the LDROM size specified by this config,
 	// (0 if not present)
 	GetLDROMSize() uint
+
+	// Returns whether the device is locked (flash cannot be read out)
+	IsLocked() bool
+}
+
+// Error encountered decoding or encoding configuration
+type ConfigError struct {
+	// Name of the offending field (as used in JSON), if known
+	Field string
+	// Offset of the offending byte, or -1 if not known
+	Offset int
+	// Underlying error
+	Err error
+}
+
+func (e *ConfigError) Error() string {
+	switch {
+	case e.Field != "":
+		return fmt.Sprintf("Configuration field '%s': %s", e.Field, e.Err)
+	case e.Offset >= 0:
+		return fmt.Sprintf("Configuration byte %d: %s", e.Offset, e.Err)
+	default:
+		return e.Err.Error()
+	}
 }
 
 // Configuration space configuration for target
@@ -36,28 +63,141 @@ type ConfigSpace struct {
 	// at this offset
 	IHexOffset uint32
 
-	// Minimum size of configuration data to be valid
+	// Size of the configuration data modeled by Config objects; this
+	// is the minimum size of configuration data to be valid. Bytes
+	// beyond this are not decoded
 	MinSize uint
-	// Size to use when issuing reads
+	// Size to use when issuing reads (at least MinSize)
 	ReadSize uint8
 	// Size to use when issuing writes (data will be padded with FFs)
 	WriteSize uint8
 
 	// Create a new Config object
 	NewConfig func() Config
+
+	// Mask of the bits of each configuration byte which are represented
+	// by Config objects. Other bits are preserved by EncodePreserving
+	ModeledBits []byte
+}
+
+// Encode config on top of the existing configuration bytes base,
+// preserving any bits not represented by the Config object
+func (cs *ConfigSpace) EncodePreserving(cfg Config, base []byte) ([]byte, error) {
+	if cs.ModeledBits == nil {
+		return nil, errors.New("Target does not describe which configuration bits are modeled")
+	}
+
+	buf, err := cfg.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	n := len(buf)
+	if len(base) > n {
+		n = len(base)
+	}
+
+	out := make([]byte, n)
+	for i := range out {
+		var b, c, m byte = 0xFF, 0xFF, 0x00
+		if i < len(base) {
+			b = base[i]
+		}
+		if i < len(buf) {
+			c = buf[i]
+		}
+		if i < len(cs.ModeledBits) {
+			m = cs.ModeledBits[i]
+		}
+		out[i] = c&m | b&^m
+	}
+	return out, nil
 }
 
-// Decode config bytes
+// Decode config bytes. Only the first MinSize bytes are decoded
 func (cs *ConfigSpace) Decode(buf []byte) (Config, error) {
+	if uint(len(buf)) > cs.MinSize {
+		buf = buf[:cs.MinSize]
+	}
+
 	cfgo := cs.NewConfig()
 	return cfgo, cfgo.UnmarshalBinary(buf)
 }
 
+// Returns the offsets of any bytes beyond the modeled (MinSize) region
+// which are not in their erased (0xFF) state
+func (cs *ConfigSpace) UnmodeledBytes(buf []byte) []int {
+	var offsets []int
+	for i := int(cs.MinSize); i < len(buf); i++ {
+		if buf[i] != 0xFF {
+			offsets = append(offsets, i)
+		}
+	}
+	return offsets
+}
+
+// Implemented by configuration field types which take one of a fixed
+// set of values
+type Enum interface {
+	// Returns the names of all permitted values
+	Values() []string
+}
+
+// EnumStrings converts a slice of enum values (as returned by the
+// enumer generated Values functions) to their string names
+func EnumStrings(values interface{}) []string {
+	v := reflect.ValueOf(values)
+	s := make([]string, v.Len())
+	for i := range s {
+		s[i] = v.Index(i).Interface().(fmt.Stringer).String()
+	}
+	return s
+}
+
+// Description of a configuration field
+type ConfigField struct {
+	// Field name (as used in JSON)
+	Name string
+	// Permitted values (nil if not constrained)
+	Values []string
+}
+
+// Fields describes each field of this target's Config object
+func (cs *ConfigSpace) Fields() []ConfigField {
+	var enumType = reflect.TypeOf((*Enum)(nil)).Elem()
+
+	t := reflect.TypeOf(cs.NewConfig()).Elem()
+	var fields []ConfigField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "-" || f.PkgPath != "" {
+			continue
+		} else if name == "" {
+			name = f.Name
+		}
+
+		field := ConfigField{Name: name}
+		switch {
+		case f.Type.Kind() == reflect.Bool:
+			field.Values = []string{"false", "true"}
+		case f.Type.Implements(enumType):
+			field.Values = reflect.Zero(f.Type).Interface().(Enum).Values()
+		}
+		fields = append(fields, field)
+	}
+
+	return fields
+}
+
 // Definition of a target
 type Definition struct {
 	// Name of target device
 	Name string
 
+	// Alternative names (e.g. "n76") by which the target may be selected
+	Aliases []string
+
 	// Device family
 	Family protocol.ChipFamily
 
@@ -72,18 +212,138 @@ type Definition struct {
 	// program space from the perspective of the programmer
 	LDROMOffset uint
 
+	// ICP clock (kHz) to use by default (defaults to DefaultClock)
+	DefaultClock uint32
+	// Maximum ICP clock (kHz) supported, if known
+	MaxClock uint32
+
+	// Interrupt vectors (including reset), if known. This may be a
+	// subset of the device's vectors
+	Vectors []Vector
+
+	// Size of each program space read/write transaction
+	// (defaults to DefaultPageSize)
+	PageSize uint
+
 	// Config space configuration
 	Config ConfigSpace
+
+	// Memory spaces beyond program and config space (e.g. SPROM) which
+	// the target supports
+	Spaces []Space
 }
 
+// A memory space of a target, as selected by name
+type Space struct {
+	// Name (e.g. "sprom")
+	Name string
+	// Memory space to use in programmer commands
+	Space protocol.MemorySpace
+	// Size in bytes
+	Size uint32
+}
+
+// Returns the memory spaces of the target: program space, config space,
+// and any additional Spaces
+func (td *Definition) MemorySpaces() []Space {
+	return append([]Space{
+		{Name: "program", Space: protocol.ProgramSpace, Size: uint32(td.ProgMemSize)},
+		{Name: "config", Space: protocol.ConfigSpace, Size: uint32(td.Config.WriteSize)},
+	}, td.Spaces...)
+}
+
+// Returns the memory space of the target with the given name
+func (td *Definition) SpaceByName(name string) (Space, error) {
+	var names []string
+	for _, s := range td.MemorySpaces() {
+		if strings.EqualFold(s.Name, name) {
+			return s, nil
+		}
+		names = append(names, s.Name)
+	}
+	return Space{}, fmt.Errorf("%s has no memory space '%s' (spaces: %s)", td.Name, name, strings.Join(names, ", "))
+}
+
+// A range of program space, as addressed by the programmer
+type Region struct {
+	Start uint `json:"start"`
+	Size  uint `json:"size"`
+}
+
+// Address of the last byte of the region
+func (r Region) End() uint {
+	return r.Start + r.Size - 1
+}
+
+// Partitioning of program memory between APROM and LDROM
+type Layout struct {
+	APROM Region `json:"aprom"`
+	LDROM Region `json:"ldrom"`
+}
+
+// Returns the program memory layout selected by cfg. LDROM is empty
+// (Size 0) if cfg does not enable it
+func (td *Definition) Layout(cfg Config) Layout {
+	ldromSize := cfg.GetLDROMSize()
+	return Layout{
+		APROM: Region{Start: 0, Size: td.ProgMemSize - ldromSize},
+		LDROM: Region{Start: td.LDROMOffset, Size: ldromSize},
+	}
+}
+
+// Translates an address in the flat address space used by image files
+// (program space at 0, config space at Config.IHexOffset) to a memory
+// space and address within it
+func (td *Definition) SpaceAddress(flat uint32) (protocol.MemorySpace, uint16, error) {
+	switch {
+	case flat < uint32(td.ProgMemSize):
+		return protocol.ProgramSpace, uint16(flat), nil
+	case flat >= td.Config.IHexOffset && flat-td.Config.IHexOffset < uint32(td.Config.WriteSize):
+		return protocol.ConfigSpace, uint16(flat - td.Config.IHexOffset), nil
+	default:
+		return 0, 0, protocol.ErrAddressOutOfRange
+	}
+}
+
+// Translates a memory space and address to the flat address space used by
+// image files; the inverse of SpaceAddress
+func (td *Definition) FlatAddress(space protocol.MemorySpace, addr uint16) (uint32, error) {
+	switch {
+	case space == protocol.ProgramSpace && uint(addr) < td.ProgMemSize:
+		return uint32(addr), nil
+	case space == protocol.ConfigSpace && addr < uint16(td.Config.WriteSize):
+		return td.Config.IHexOffset + uint32(addr), nil
+	default:
+		return 0, protocol.ErrAddressOutOfRange
+	}
+}
+
+// An interrupt (or reset) vector in program memory
+type Vector struct {
+	Name    string
+	Address uint32
+}
+
+const (
+	DefaultPageSize = 32
+	DefaultClock    = 1000
+)
+
+// Targets are identified by the combination of chip family and device ID;
+// many devices share a family
 var (
 	targetByName = map[string]*Definition{}
 	targetByID   = map[uint64]*Definition{}
+	targetNames  []string
 )
 
+func targetID(f protocol.ChipFamily, d protocol.DeviceID) uint64 {
+	return uint64(f)<<32 | uint64(d)
+}
+
 func Register(td *Definition) {
 	name := strings.ToLower(td.Name)
-	id := uint64(td.Family)<<32 | uint64(td.DeviceID)
+	id := targetID(td.Family, td.DeviceID)
 
 	if _, ok := targetByName[name]; ok {
 		panic("Target already registered with name " + name)
@@ -93,8 +353,39 @@ func Register(td *Definition) {
 		panic(fmt.Sprintf("Target already registered with ID %08x:%08x", td.Family, td.DeviceID))
 	}
 
+	if td.PageSize == 0 {
+		td.PageSize = DefaultPageSize
+	}
+
+	if td.DefaultClock == 0 {
+		td.DefaultClock = DefaultClock
+	}
+
+	spaces := map[string]bool{}
+	for _, s := range td.MemorySpaces() {
+		if spaces[strings.ToLower(s.Name)] {
+			panic("Target " + td.Name + " has multiple memory spaces named " + s.Name)
+		}
+		spaces[strings.ToLower(s.Name)] = true
+	}
+
+	for _, alias := range td.Aliases {
+		alias = strings.ToLower(alias)
+		if _, ok := targetByName[alias]; ok {
+			panic("Target already registered with name " + alias)
+		}
+		targetByName[alias] = td
+	}
+
 	targetByName[name] = td
 	targetByID[id] = td
+	targetNames = append(targetNames, td.Name)
+	sort.Strings(targetNames)
+}
+
+// Names returns the (canonical) names of all registered targets
+func Names() []string {
+	return append([]string(nil), targetNames...)
 }
 
 func ByName(name string) *Definition {
@@ -102,5 +393,5 @@ func ByName(name string) *Definition {
 }
 
 func ByID(f protocol.ChipFamily, d protocol.DeviceID) *Definition {
-	return targetByID[uint64(f)<<32|uint64(d)]
+	return targetByID[targetID(f, d)]
 }
@@ -0,0 +1,135 @@
+// Copyright © 2019 Erin Shepherd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package target
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/erincandescent/nuvoprog/protocol"
+)
+
+// A synthetic target with a 64KB program space, so that program addresses
+// span the whole of the protocol's 16-bit address field
+var testTarget = &Definition{
+	Name:        "test",
+	ProgMemSize: 64 * 1024,
+	Config: ConfigSpace{
+		IHexOffset: 0x30000,
+		MinSize:    4,
+		ReadSize:   8,
+		WriteSize:  32,
+	},
+}
+
+func TestAddressRoundTrip(t *testing.T) {
+	cases := []struct {
+		flat  uint32
+		space protocol.MemorySpace
+		addr  uint16
+	}{
+		{0x0000, protocol.ProgramSpace, 0x0000},
+		{0x1234, protocol.ProgramSpace, 0x1234},
+		{0xFFFF, protocol.ProgramSpace, 0xFFFF},
+		{0x30000, protocol.ConfigSpace, 0x00},
+		{0x30007, protocol.ConfigSpace, 0x07},
+		{0x3001F, protocol.ConfigSpace, 0x1F},
+	}
+
+	for _, c := range cases {
+		space, addr, err := testTarget.SpaceAddress(c.flat)
+		if err != nil {
+			t.Errorf("SpaceAddress(0x%x): %v", c.flat, err)
+			continue
+		} else if space != c.space || addr != c.addr {
+			t.Errorf("SpaceAddress(0x%x) = %s 0x%04x, expected %s 0x%04x", c.flat, space, addr, c.space, c.addr)
+		}
+
+		flat, err := testTarget.FlatAddress(space, addr)
+		if err != nil {
+			t.Errorf("FlatAddress(%s, 0x%04x): %v", space, addr, err)
+		} else if flat != c.flat {
+			t.Errorf("FlatAddress(%s, 0x%04x) = 0x%x, expected 0x%x", space, addr, flat, c.flat)
+		}
+	}
+}
+
+func TestAddressOutOfRange(t *testing.T) {
+	for _, flat := range []uint32{0x10000, 0x2FFFF, 0x30020, 0xFFFFFFFF} {
+		if space, addr, err := testTarget.SpaceAddress(flat); err != protocol.ErrAddressOutOfRange {
+			t.Errorf("SpaceAddress(0x%x) = %s 0x%04x, %v; expected out of range", flat, space, addr, err)
+		}
+	}
+
+	small := &Definition{ProgMemSize: 18 * 1024, Config: testTarget.Config}
+	cases := []struct {
+		space protocol.MemorySpace
+		addr  uint16
+	}{
+		{protocol.ProgramSpace, 0x4800},
+		{protocol.ConfigSpace, 0x20},
+		{protocol.MemorySpace(0x0005), 0x0000},
+	}
+	for _, c := range cases {
+		if flat, err := small.FlatAddress(c.space, c.addr); err != protocol.ErrAddressOutOfRange {
+			t.Errorf("FlatAddress(%s, 0x%04x) = 0x%x, %v; expected out of range", c.space, c.addr, flat, err)
+		}
+	}
+}
+
+// Registers td for the duration of the test
+func registerTest(t *testing.T, td *Definition) {
+	t.Helper()
+	Register(td)
+	t.Cleanup(func() {
+		delete(targetByName, strings.ToLower(td.Name))
+		delete(targetByID, targetID(td.Family, td.DeviceID))
+		for i, name := range targetNames {
+			if name == td.Name {
+				targetNames = append(targetNames[:i], targetNames[i+1:]...)
+				break
+			}
+		}
+	})
+}
+
+func TestByIDSameFamily(t *testing.T) {
+	a := &Definition{Name: "test-a", Family: protocol.ChipFamily1T8051, DeviceID: 0x123401, ProgMemSize: 1024}
+	b := &Definition{Name: "test-b", Family: protocol.ChipFamily1T8051, DeviceID: 0x123402, ProgMemSize: 1024}
+	registerTest(t, a)
+	registerTest(t, b)
+
+	if td := ByID(protocol.ChipFamily1T8051, a.DeviceID); td != a {
+		t.Errorf("ByID(%06x) = %v, expected test-a", a.DeviceID, td)
+	}
+	if td := ByID(protocol.ChipFamily1T8051, b.DeviceID); td != b {
+		t.Errorf("ByID(%06x) = %v, expected test-b", b.DeviceID, td)
+	}
+	if td := ByID(protocol.ChipFamilyM2351, a.DeviceID); td != nil {
+		t.Errorf("ByID with another family = %v, expected none", td.Name)
+	}
+}
+
+func TestRegisterDuplicateID(t *testing.T) {
+	a := &Definition{Name: "test-a", Family: protocol.ChipFamily1T8051, DeviceID: 0x123401, ProgMemSize: 1024}
+	registerTest(t, a)
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Registering a second target with the same ID did not panic")
+		}
+	}()
+	Register(&Definition{Name: "test-c", Family: a.Family, DeviceID: a.DeviceID, ProgMemSize: 1024})
+}